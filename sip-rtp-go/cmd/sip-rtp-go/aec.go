@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+	"sync"
+	"time"
+)
+
+// Acoustic echo cancellation on caller audio (AI mode): the playback worker hands over what it
+// sends as the far-end reference, and an adaptive filter as long as the echo tail (the round trip
+// included) subtracts its estimate of the AI's echo from the caller audio. Adaptation stops during
+// double talk (Geigel detector: the caller louder than half the recent far-end peak, held 50 ms)
+// and while the AI is silent.
+//
+// The filter is a partitioned-block frequency-domain NLMS (MDF): the tail is cut into blocks of
+// aecBlock, each one a filter partition in the frequency domain, and each block one partition in
+// turn is constrained back to a block's length in the time domain (AUMDF). A 200 ms tail at 16 kHz (3200
+// taps) costs about five 256-point FFTs and 2x25 spectrum products per 128 samples, roughly a tenth
+// of the time-domain NLMS. Caller audio comes out up to one block late when frames don't divide
+// into blocks (4 ms for 20 ms frames).
+const (
+	defaultEchoTail = 200 * time.Millisecond
+	maxEchoTail     = 500 * time.Millisecond
+	// Above this the filter gets too long to run per call; caller audio is cancelled at 16 kHz.
+	maxEchoRate = 16000
+	// Block (partition) length: 8 ms at the canceller's rate, rounded to a power of two.
+	aecBlock = 8 * time.Millisecond
+
+	aecStep        = 0.5
+	aecGeigel      = 0.5
+	aecHold        = 50 * time.Millisecond
+	aecFarMinDBFS  = -50
+	aecMaxSlackDur = 60 * time.Millisecond // reference allowed to run ahead of the caller audio
+	// Smoothing of the per-bin reference power that normalizes the step.
+	aecPowSmooth = 0.1
+)
+
+type aecStats struct {
+	frames, farOnly, doubleTalk uint64
+	// Power summed over frames with only the AI talking: reference, caller audio (its echo) and
+	// what was left after cancellation.
+	farPow, echoPow, residualPow float64
+}
+
+func (s aecStats) String() string {
+	db := func(num, den float64) string {
+		if num <= 0 || den <= 0 {
+			return "n/a"
+		}
+		return fmt.Sprintf("%.1fdB", 10*math.Log10(num/den))
+	}
+	dt := 0.0
+	if s.frames > 0 {
+		dt = 100 * float64(s.doubleTalk) / float64(s.frames)
+	}
+	return fmt.Sprintf("frames=%d far-only=%d double-talk=%.1f%% erl=%s erle=%s",
+		s.frames, s.farOnly, dt, db(s.farPow, s.echoPow), db(s.echoPow, s.residualPow))
+}
+
+type echoCanceller struct {
+	rate int
+
+	mu    sync.Mutex
+	fifo  []float64 // reference not yet matched with caller audio
+	stats aecStats
+
+	block int            // samples per block; the FFTs are twice that
+	parts int            // filter partitions
+	x     [][]complex128 // spectra of the last parts reference windows, x[head] the newest
+	w     [][]complex128 // filter partitions, w[p] applies to x p blocks back
+	head  int
+	next  int       // partition constrained next
+	pow   []float64 // smoothed per-bin reference power
+	prev  []float64 // previous reference block (first half of the window)
+	peaks []float64 // far-end peak per block, over the tail
+	hold  int       // double-talk samples left
+
+	// Caller audio, its reference and whether it may adapt, waiting for a full block; processed
+	// audio waiting to go out.
+	inD, inX []float64
+	inAdapt  []bool
+	out      []int16
+}
+
+func newEchoCanceller(rate int, tail time.Duration) *echoCanceller {
+	if tail <= 0 {
+		tail = defaultEchoTail
+	}
+	if tail > maxEchoTail {
+		tail = maxEchoTail
+	}
+	block := 1
+	for float64(2*block) <= aecBlock.Seconds()*float64(rate) {
+		block *= 2
+	}
+	taps := int(tail.Seconds() * float64(rate))
+	parts := (taps + block - 1) / block
+	e := &echoCanceller{
+		rate:  rate,
+		block: block,
+		parts: parts,
+		x:     make([][]complex128, parts),
+		w:     make([][]complex128, parts),
+		pow:   make([]float64, 2*block),
+		prev:  make([]float64, block),
+		peaks: make([]float64, parts+1),
+	}
+	for p := range e.x {
+		e.x[p] = make([]complex128, 2*block)
+		e.w[p] = make([]complex128, 2*block)
+	}
+	return e
+}
+
+// reference takes audio just sent to the caller, at the canceller's rate.
+func (e *echoCanceller) reference(pcm []int16) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, s := range pcm {
+		e.fifo = append(e.fifo, float64(s))
+	}
+	if over := len(e.fifo) - e.rate; over > 0 {
+		e.fifo = e.fifo[over:]
+	}
+}
+
+// process cancels the echo in one frame of caller audio at the canceller's rate. The filter only
+// adapts on real audio (adapt=false for concealed frames).
+func (e *echoCanceller) process(pcm []int16, adapt bool) []int16 {
+	n := len(pcm)
+	if n == 0 {
+		return pcm
+	}
+	// The reference for this frame: the oldest not yet used. After a stall on the caller side,
+	// drop what ran too far ahead so the two streams stay aligned.
+	ref := make([]float64, n)
+	e.mu.Lock()
+	if over := len(e.fifo) - n - int(aecMaxSlackDur.Seconds()*float64(e.rate)); over > 0 {
+		e.fifo = e.fifo[over:]
+	}
+	k := copy(ref, e.fifo)
+	e.fifo = e.fifo[k:]
+	e.mu.Unlock()
+
+	for i, s := range pcm {
+		e.inD = append(e.inD, float64(s))
+		e.inX = append(e.inX, ref[i])
+		e.inAdapt = append(e.inAdapt, adapt)
+	}
+	for len(e.inD) >= e.block {
+		blockAdapt := true
+		for _, a := range e.inAdapt[:e.block] {
+			blockAdapt = blockAdapt && a
+		}
+		e.out = append(e.out, e.processBlock(e.inD[:e.block], e.inX[:e.block], blockAdapt)...)
+		e.inD = append(e.inD[:0], e.inD[e.block:]...)
+		e.inX = append(e.inX[:0], e.inX[e.block:]...)
+		e.inAdapt = append(e.inAdapt[:0], e.inAdapt[e.block:]...)
+	}
+	// Frames that don't divide into blocks: the output falls behind by the shortfall, once.
+	if short := n - len(e.out); short > 0 {
+		e.out = append(make([]int16, short), e.out...)
+	}
+	out := append([]int16(nil), e.out[:n]...)
+	e.out = append(e.out[:0], e.out[n:]...)
+	return out
+}
+
+// processBlock filters one block of caller audio d with its reference x.
+func (e *echoCanceller) processBlock(d, x []float64, adapt bool) []int16 {
+	b, m := e.block, 2*e.block
+
+	// Spectrum of the window [previous block, this block], the newest partition input.
+	e.head = (e.head + e.parts - 1) % e.parts
+	xf := e.x[e.head]
+	var peak, farPow float64
+	for i := 0; i < b; i++ {
+		xf[i] = complex(e.prev[i], 0)
+		xf[b+i] = complex(x[i], 0)
+		peak = math.Max(peak, math.Abs(x[i]))
+		farPow += x[i] * x[i]
+	}
+	copy(e.prev, x)
+	fft(xf, false)
+	copy(e.peaks, e.peaks[1:])
+	e.peaks[len(e.peaks)-1] = peak
+	for _, p := range e.peaks {
+		peak = math.Max(peak, p)
+	}
+	for f, v := range xf {
+		pw := real(v)*real(v) + imag(v)*imag(v)
+		e.pow[f] += aecPowSmooth * (pw - e.pow[f])
+	}
+
+	// Echo estimate: the last half of the filtered window (overlap-save).
+	y := make([]complex128, m)
+	for p := 0; p < e.parts; p++ {
+		xp, wp := e.x[(e.head+p)%e.parts], e.w[p]
+		for f := range y {
+			y[f] += wp[f] * xp[f]
+		}
+	}
+	fft(y, true)
+	out := make([]int16, b)
+	errf := make([]complex128, m)
+	var echoPow, residualPow, nearPeak float64
+	for i := 0; i < b; i++ {
+		err := d[i] - real(y[b+i])
+		out[i] = sat16f(err)
+		errf[b+i] = complex(err, 0)
+		echoPow += d[i] * d[i]
+		residualPow += err * err
+		nearPeak = math.Max(nearPeak, math.Abs(d[i]))
+	}
+
+	farActive := peak > 32768*math.Pow(10, aecFarMinDBFS/20.0)
+	if nearPeak > aecGeigel*peak {
+		e.hold = int(aecHold.Seconds() * float64(e.rate))
+	}
+	dt := e.hold > 0
+	if dt {
+		e.hold -= b
+	}
+	if adapt && farActive && !dt {
+		fft(errf, false)
+		// Per-bin NLMS step: the window's power is about 2x a block's, and the tail holds parts
+		// blocks. Regularization is about the power of a quiet line, so near-silence doesn't blow up
+		// the step.
+		reg := float64(e.parts*m) * 100
+		for f := range errf {
+			errf[f] *= complex(2*aecStep/(float64(e.parts)*e.pow[f]+reg), 0)
+		}
+		for p := 0; p < e.parts; p++ {
+			xp, wp := e.x[(e.head+p)%e.parts], e.w[p]
+			for f := range wp {
+				wp[f] += cmplx.Conj(xp[f]) * errf[f]
+			}
+		}
+		// Constrain one partition per block back to a block's length in the time domain (the
+		// others drift meanwhile, which costs a little convergence speed).
+		wp := e.w[e.next]
+		fft(wp, true)
+		for i := b; i < m; i++ {
+			wp[i] = 0
+		}
+		fft(wp, false)
+		e.next = (e.next + 1) % e.parts
+	}
+
+	e.mu.Lock()
+	e.stats.frames++
+	switch {
+	case dt:
+		e.stats.doubleTalk++
+	case farActive && adapt:
+		e.stats.farOnly++
+		e.stats.farPow += farPow
+		e.stats.echoPow += echoPow
+		e.stats.residualPow += residualPow
+	}
+	e.mu.Unlock()
+	return out
+}
+
+func (e *echoCanceller) snapshot() aecStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.stats
+}
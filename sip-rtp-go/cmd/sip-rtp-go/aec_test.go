@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// echoPath is a synthetic room + trunk: a pure delay, then a decaying, ringing tail; erlDB is its
+// loss for white noise.
+func echoPath(rate int, delay time.Duration, erlDB float64) []float64 {
+	d := int(delay.Seconds() * float64(rate))
+	h := make([]float64, d+rate/50)
+	var energy float64
+	for i := d; i < len(h); i++ {
+		k := float64(i - d)
+		h[i] = math.Exp(-k/float64(rate/400)) * math.Cos(k*0.7)
+		energy += h[i] * h[i]
+	}
+	g := math.Pow(10, -erlDB/20) / math.Sqrt(energy)
+	for i := range h {
+		h[i] *= g
+	}
+	return h
+}
+
+func TestEchoCancellerERLE(t *testing.T) {
+	for _, tc := range []struct {
+		rate  int
+		frame time.Duration
+	}{
+		{8000, 20 * time.Millisecond},
+		{16000, 20 * time.Millisecond},
+		{8000, 10 * time.Millisecond}, // frames that don't divide into blocks
+	} {
+		t.Run(fmt.Sprintf("%d-%s", tc.rate, tc.frame), func(t *testing.T) {
+			const secs = 6
+			rng := rand.New(rand.NewSource(1))
+			h := echoPath(tc.rate, 40*time.Millisecond, 10)
+			far := make([]float64, secs*tc.rate)
+			for i := range far {
+				far[i] = 3000 * rng.NormFloat64()
+			}
+			near := make([]int16, len(far))
+			for i := range near {
+				var v float64
+				for j, c := range h {
+					if i-j >= 0 {
+						v += c * far[i-j]
+					}
+				}
+				near[i] = sat16f(v + 10*rng.NormFloat64())
+			}
+
+			e := newEchoCanceller(tc.rate, 0)
+			n := int(tc.frame.Seconds() * float64(tc.rate))
+			var out []int16
+			for i := 0; i+n <= len(far); i += n {
+				ref := make([]int16, n)
+				for j := range ref {
+					ref[j] = sat16f(far[i+j])
+				}
+				e.reference(ref)
+				y := e.process(near[i:i+n], true)
+				if len(y) != n {
+					t.Fatalf("frame of %d samples came out as %d", n, len(y))
+				}
+				out = append(out, y...)
+			}
+
+			// ERLE over the last second (the echo is stationary, so the canceller's output lag doesn't matter).
+			var echo, residual float64
+			for i := len(out) - tc.rate; i < len(out); i++ {
+				echo += float64(near[i]) * float64(near[i])
+				residual += float64(out[i]) * float64(out[i])
+			}
+			if erle := 10 * math.Log10(echo/residual); erle < 25 {
+				t.Errorf("ERLE %.1f dB after %ds, want at least 25 dB", erle, secs)
+			}
+			if s := e.snapshot(); s.echoPow <= s.residualPow {
+				t.Errorf("stats ERLE not positive: %s", s)
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"sip-rtp-go/internal/resample"
+)
+
+// Answer modes (per agent):
+//   - immediate: 180 Ringing, then 200 OK (after answerDelayMs of generated ringback when set)
+//   - early:     183 with SDP, early media (prompt, then the AI/echo session), 200 OK after answerDelayMs
+//     (or once the prompt has played when no delay is set)
+//   - earlyOnly: 183 with SDP and early media only; never answered, ends with 480 after earlyMediaMaxSec
+const (
+	answerImmediate = "immediate"
+	answerEarly     = "early"
+	answerEarlyOnly = "earlyOnly"
+
+	defaultEarlyMediaMax = 120 * time.Second
+)
+
+func parseAnswerMode(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "early":
+		return answerEarly
+	case "earlyonly", "early-only", "early_only":
+		return answerEarlyOnly
+	default:
+		return answerImmediate
+	}
+}
+
+// toneCadence is a call-progress tone: summed sine frequencies with an on/off pattern in ms.
+type toneCadence struct {
+	freqs   []float64
+	pattern []int // alternating on/off durations, starting with "on"
+}
+
+var ringbackCadences = map[string]toneCadence{
+	"us": {freqs: []float64{440, 480}, pattern: []int{2000, 4000}},
+	"eu": {freqs: []float64{425}, pattern: []int{1000, 4000}},
+	"uk": {freqs: []float64{400, 450}, pattern: []int{400, 200, 400, 2000}},
+}
+
+// pcm8k renders n samples of the tone starting at absolute sample position pos.
+func (t toneCadence) pcm8k(pos, n int) []int16 {
+	out := make([]int16, n)
+	cycle := 0
+	for _, ms := range t.pattern {
+		cycle += ms * 8
+	}
+	if cycle == 0 || len(t.freqs) == 0 {
+		return out
+	}
+	// ~-13 dBm0 total, split across the frequencies.
+	amp := 4500.0 / float64(len(t.freqs))
+	for i := 0; i < n; i++ {
+		p := (pos + i) % cycle
+		on := false
+		for j, ms := range t.pattern {
+			if p < ms*8 {
+				on = j%2 == 0
+				break
+			}
+			p -= ms * 8
+		}
+		if !on {
+			continue
+		}
+		var v float64
+		for _, f := range t.freqs {
+			v += amp * math.Sin(2*math.Pi*f*float64(pos+i)/8000)
+		}
+		out[i] = int16(v)
+	}
+	return out
+}
+
+// loadPromptPcm8k loads a mono PCM16 WAV prompt as 8 kHz samples.
+func loadPromptPcm8k(path string) ([]int16, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pcm, rate, err := wavToPCM16Mono(raw)
+	if err != nil {
+		return nil, err
+	}
+	if rate != 8000 {
+		pcm = resample.Convert(pcm, rate, 8000)
+	}
+	return pcm, nil
+}
+
+// promptSender paces 20ms frames of 8 kHz prompts/tones, in the negotiated codec, to the caller before the AI/echo session runs
+// (early media, queue hold). It starts with the SDP peer since there may be no inbound RTP to learn from yet.
+type promptSender struct {
+	cs     *callSession
+	enc    *rtpEncoder
+	ssrc   uint32
+	seq    uint16
+	ts     uint32
+	marker bool
+
+	mu   sync.Mutex
+	addr net.Addr
+}
+
+func newPromptSender(logger *log.Logger, cs *callSession) *promptSender {
+	return &promptSender{
+		cs:     cs,
+		enc:    cs.newEncoder(logger),
+		ssrc:   rand.Uint32(),
+		seq:    uint16(rand.Uint32()),
+		ts:     rand.Uint32(),
+		marker: true,
+		addr:   cs.remoteRtp,
+	}
+}
+
+func (e *promptSender) setAddr(a net.Addr) {
+	e.mu.Lock()
+	e.addr = a
+	e.mu.Unlock()
+}
+
+func (e *promptSender) send(frame []int16) {
+	payload := e.enc.encode8k(frame)
+	ts := e.ts
+	e.ts += uint32(len(frame) * e.enc.codec.clockRate / 8000)
+	if payload == nil {
+		// Opus DTX: nothing to send for silence.
+		e.marker = true
+		return
+	}
+	p := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         e.marker,
+			PayloadType:    e.enc.pt(),
+			SequenceNumber: e.seq,
+			Timestamp:      ts,
+			SSRC:           e.ssrc,
+		},
+		Payload: payload,
+	}
+	e.marker = false
+	e.mu.Lock()
+	addr := e.addr
+	e.mu.Unlock()
+	if raw, err := p.Marshal(); err == nil && addr != nil {
+		_, _ = e.cs.rtp.WriteTo(raw, addr)
+	}
+	e.seq++
+}
+
+// drainRtp reads inbound RTP until stop fires: keeps the RTP guard fed and learns the peer if SDP
+// had none.
+func (e *promptSender) drainRtp(stop <-chan struct{}) {
+	cs := e.cs
+	buf := make([]byte, 4096)
+	var p rtp.Packet
+	for {
+		select {
+		case <-stop:
+			return
+		case <-cs.stopCh:
+			return
+		default:
+		}
+		_ = cs.rtp.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		n, addr, err := cs.rtp.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		if p.Unmarshal(buf[:n]) != nil {
+			continue
+		}
+		cs.markRtp()
+		e.setAddr(addr)
+	}
+}
+
+// playPcm sends pcm in real time; it returns false if stop fired first.
+func (e *promptSender) playPcm(pcm []int16, stop <-chan struct{}) bool {
+	const frameSamples = 160
+	t := time.NewTicker(20 * time.Millisecond)
+	defer t.Stop()
+	for off := 0; off < len(pcm); off += frameSamples {
+		frame := make([]int16, frameSamples)
+		copy(frame, pcm[off:])
+		select {
+		case <-e.cs.stopCh:
+			return false
+		case <-stop:
+			return false
+		case <-t.C:
+		}
+		e.send(frame)
+	}
+	return true
+}
+
+// playTone sends a generated call-progress tone until stop fires.
+func (e *promptSender) playTone(tone toneCadence, stop <-chan struct{}) {
+	const frameSamples = 160
+	t := time.NewTicker(20 * time.Millisecond)
+	defer t.Stop()
+	for pos := 0; ; pos += frameSamples {
+		select {
+		case <-e.cs.stopCh:
+			return
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		e.send(tone.pcm8k(pos, frameSamples))
+	}
+}
+
+// answerWithEarlyMedia runs the 183 Session Progress part of an answer mode, then sends the 200 OK
+// (or the final 480 for earlyOnly). The call is already registered; startMedia starts the AI/echo session.
+func answerWithEarlyMedia(logger *log.Logger, st *runtimeState, cs *callSession, sdp string, answer func() bool, startMedia func()) {
+	o := cs.opts
+	inv := cs.inv
+	extra := map[string][]string{
+		"Content-Type": {"application/sdp"},
+		"Allow":        {sipAllow},
+	}
+	if _, err := inv.sendProvisional(183, "Session Progress", extra, []byte(sdp)); err != nil {
+		if st.finishPendingInvite(cs.callID, inv) {
+			sendSIPResponse(inv.conn, inv.addr, inv.req, inv.toWithTag, "", 500, "Server Internal Error", nil, nil)
+		}
+		endCall(logger, cs.callID, st, "early media setup failed: "+err.Error())
+		return
+	}
+	logger.Printf("early media: 183 sent (call-id=%s mode=%s delay=%s)", cs.callID, o.answerMode, o.answerDelay)
+
+	var prompt []int16
+	if o.earlyMediaPrompt != "" {
+		pcm, err := loadPromptPcm8k(o.earlyMediaPrompt)
+		if err != nil {
+			logger.Printf("early media: prompt %q: %v", o.earlyMediaPrompt, err)
+		} else {
+			prompt = pcm
+		}
+	}
+
+	sender := newPromptSender(logger, cs)
+	stopEarly := make(chan struct{})
+	promptDone := make(chan struct{})
+	mediaStarted := false // written before promptDone closes
+
+	// Until the media session reads the socket itself, inbound RTP is drained here (it learns the
+	// caller's address and keeps the RTP timeout from firing).
+	drainStop, drainDone := make(chan struct{}), make(chan struct{})
+	var drainOnce sync.Once
+	stopDrain := func() {
+		drainOnce.Do(func() {
+			close(drainStop)
+			_ = cs.rtp.SetReadDeadline(time.Now())
+		})
+		<-drainDone
+	}
+	go func() {
+		defer close(drainDone)
+		sender.drainRtp(drainStop)
+	}()
+	defer stopDrain()
+
+	go func() {
+		defer close(promptDone)
+		switch o.answerMode {
+		case answerEarly, answerEarlyOnly:
+			if len(prompt) > 0 && !sender.playPcm(prompt, stopEarly) {
+				return
+			}
+			// The AI greeting (or echo) now runs as early media.
+			stopDrain()
+			startMedia()
+			mediaStarted = true
+		default:
+			tone, ok := ringbackCadences[o.ringbackTone]
+			if !ok {
+				return
+			}
+			sender.playTone(tone, stopEarly)
+		}
+	}()
+
+	if o.answerMode == answerEarlyOnly {
+		maxEarly := o.earlyMediaMax
+		if maxEarly <= 0 {
+			maxEarly = defaultEarlyMediaMax
+		}
+		select {
+		case <-cs.stopCh:
+		case <-time.After(maxEarly):
+			logger.Printf("early media: max duration reached (call-id=%s)", cs.callID)
+			hangupCall(logger, st, cs, q850NormalClearing, "early media finished")
+		}
+		close(stopEarly)
+		return
+	}
+
+	var answerAt <-chan time.Time
+	if o.answerDelay > 0 {
+		answerAt = time.After(o.answerDelay)
+	} else {
+		c := make(chan time.Time)
+		go func() {
+			<-promptDone
+			close(c)
+		}()
+		answerAt = c
+	}
+	select {
+	case <-cs.stopCh:
+		close(stopEarly)
+		return
+	case <-answerAt:
+	}
+	close(stopEarly)
+	<-promptDone
+
+	if !answer() {
+		return
+	}
+	if !mediaStarted {
+		// Ringback (or a prompt cut short by the answer): the AI/echo session starts now.
+		stopDrain()
+		startMedia()
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// Comfort noise (RFC 3389). While the AI has nothing to play, the caller hears low noise at the
+// level of the AI audio's background instead of dead silence (which makes people hang up). If the
+// caller accepted CN, a long gap is sent as SID packets and the phone makes the noise itself.
+// Caller CN packets are turned into noise at their level for the backend.
+const (
+	comfortNoiseAuto     = "auto"     // SID packets when negotiated, else generated noise
+	comfortNoiseGenerate = "generate" // always generated noise
+	comfortNoiseOff      = "off"      // digital silence
+
+	cnDefaultDBFS = -58.0
+	cnMinDBFS     = -62.0
+	cnMaxDBFS     = -45.0
+	// Gap (in 20 ms frames) before switching to SID packets, and how often the SID is repeated.
+	cnSidAfterFrames = 5
+	cnSidEveryFrames = 50
+	// Noise is low-passed here, closer to real line noise than white noise.
+	cnCornerHz = 1500
+)
+
+func parseComfortNoiseMode(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "generate":
+		return comfortNoiseGenerate
+	case "off", "none":
+		return comfortNoiseOff
+	default:
+		return comfortNoiseAuto
+	}
+}
+
+// parseSDPComfortNoise returns CN at the given clock rate from an SDP body (an a=rtpmap for CN/clock,
+// or the static payload type 13, CN/8000).
+func parseSDPComfortNoise(body []byte, clock int) (audioCodec, bool) {
+	for _, c := range parseSDPAudioCodecs(body) {
+		if strings.EqualFold(c.name, codecCN.name) && c.clockRate == clock {
+			return c, true
+		}
+	}
+	return audioCodec{}, false
+}
+
+// isComfortNoise reports whether pt carries CN on this call (13 is CN/8000 even if not negotiated).
+func (cs *callSession) isComfortNoise(pt uint8) bool {
+	return pt == codecCN.pt || (cs.cn.name != "" && pt == cs.cn.pt)
+}
+
+// rtpClock is the RTP clock of a received payload type, 0 for ones we ignore. CN has no decoder but
+// shares the audio's timestamps, so it is buffered on the audio clock.
+func (cs *callSession) rtpClock(dec *rtpDecoder, pt uint8) int {
+	if cs.isComfortNoise(pt) {
+		return cs.sendCodec().clockRate
+	}
+	return dec.clockRate(pt)
+}
+
+type comfortNoise struct {
+	rate  int
+	level float64 // dBFS
+	lp, a float64
+	rng   *rand.Rand
+
+	// Background level of the audio it stands in for (tracked like the VAD's noise floor).
+	floor  float64
+	primed bool
+}
+
+func newComfortNoise(rate int) *comfortNoise {
+	return &comfortNoise{
+		rate:  rate,
+		level: cnDefaultDBFS,
+		a:     math.Exp(-2 * math.Pi * cnCornerHz / float64(rate)),
+		rng:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// learn takes a frame of real audio; the noise level follows its background, within bounds.
+func (c *comfortNoise) learn(pcm []int16) {
+	level := levelDBFS(pcm)
+	if level <= -100 {
+		return
+	}
+	dur := float64(len(pcm)) / float64(c.rate)
+	switch {
+	case !c.primed:
+		c.floor, c.primed = level, true
+	case level < c.floor:
+		c.floor += (level - c.floor) * math.Min(1, dur/vadFloorFall.Seconds())
+	default:
+		c.floor += math.Min(level-c.floor, vadFloorRiseDBs*dur)
+	}
+	c.level = math.Max(cnMinDBFS, math.Min(cnMaxDBFS, c.floor))
+}
+
+// setSID takes the level of a received CN payload (-dBov; spectral coefficients are ignored).
+func (c *comfortNoise) setSID(payload []byte) {
+	if len(payload) > 0 {
+		c.level = -float64(payload[0] & 0x7f)
+	}
+}
+
+// sid is a CN payload for the current level, without spectral information.
+func (c *comfortNoise) sid() []byte {
+	return []byte{byte(math.Max(0, math.Min(127, math.Round(-c.level))))}
+}
+
+func (c *comfortNoise) generate(n int) []int16 {
+	// One-pole low-pass of white noise: its RMS is sqrt((1-a)/(1+a)) of the input's.
+	gain := 32768 * math.Pow(10, c.level/20) * math.Sqrt((1+c.a)/(1-c.a))
+	out := make([]int16, n)
+	for i := range out {
+		c.lp = c.a*c.lp + (1-c.a)*c.rng.NormFloat64()
+		out[i] = sat16f(c.lp * gain)
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// A SID packet from the caller goes through the read path (clock lookup, jitter buffer) and comes out
+// in order between the audio packets, at its level.
+func TestComfortNoiseReadPath(t *testing.T) {
+	dynCN := audioCodec{name: "CN", pt: 118, clockRate: 8000, sampleRate: 8000, channels: 1}
+	for _, tc := range []struct {
+		codecs []audioCodec
+		cn     audioCodec
+		pt     uint8
+	}{
+		{[]audioCodec{codecPCMU}, audioCodec{}, codecCN.pt},
+		{[]audioCodec{codecPCMU}, dynCN, dynCN.pt},
+		{[]audioCodec{codecG722, codecPCMU}, dynCN, dynCN.pt},
+	} {
+		t.Run(fmt.Sprintf("%s-pt%d", tc.codecs[0].name, tc.pt), func(t *testing.T) {
+			cs := &callSession{codecs: tc.codecs, cn: tc.cn}
+			dec := newRtpDecoder(cs.codecs)
+			if got, want := cs.rtpClock(dec, tc.pt), tc.codecs[0].clockRate; got != want {
+				t.Fatalf("CN clock %d, want %d", got, want)
+			}
+
+			// Deep enough to hold all four packets without catching up.
+			jb := newJitterBuffer(80*time.Millisecond, 200*time.Millisecond)
+			now := time.Now()
+			const sidDBov = 50
+			pts := []uint8{tc.codecs[0].pt, tc.codecs[0].pt, tc.pt, tc.codecs[0].pt}
+			for i, pt := range pts {
+				p := rtp.Packet{
+					Header:  rtp.Header{PayloadType: pt, SequenceNumber: uint16(1000 + i), Timestamp: uint32(160 * i), SSRC: 1},
+					Payload: make([]byte, 160),
+				}
+				if pt == tc.pt {
+					p.Payload = []byte{sidDBov}
+				}
+				clock := cs.rtpClock(dec, p.PayloadType)
+				if clock == 0 {
+					t.Fatalf("packet %d (pt %d) dropped", i, pt)
+				}
+				jb.push(&p, clock, now.Add(time.Duration(i)*20*time.Millisecond))
+			}
+
+			for i, want := range pts {
+				p, res := jb.pop()
+				if res != jbPacket {
+					t.Fatalf("pop %d: result %d, want a packet", i, res)
+				}
+				if p.PayloadType != want {
+					t.Fatalf("pop %d: pt %d, want %d", i, p.PayloadType, want)
+				}
+				if !cs.isComfortNoise(p.PayloadType) {
+					continue
+				}
+				cn := newComfortNoise(8000)
+				cn.setSID(p.Payload)
+				if got := levelDBFS(cn.generate(8000)); math.Abs(got+sidDBov) > 1.5 {
+					t.Errorf("noise at %.1f dBFS, want -%d ±1.5", got, sidDBov)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pion/rtp"
+
+	"sip-rtp-go/internal/resample"
+)
+
+// audioCodec is an RTP audio format as negotiated in SDP.
+type audioCodec struct {
+	name       string // encoding name as in a=rtpmap (PCMU, PCMA, G722)
+	pt         uint8
+	clockRate  int // RTP timestamp rate (8000 for G.722, see RFC 3551 §4.5.2)
+	sampleRate int // rate of the PCM it carries
+	channels   int
+	fmtp       string
+}
+
+var (
+	codecPCMU = audioCodec{name: "PCMU", pt: 0, clockRate: 8000, sampleRate: 8000, channels: 1}
+	codecPCMA = audioCodec{name: "PCMA", pt: 8, clockRate: 8000, sampleRate: 8000, channels: 1}
+	codecG722 = audioCodec{name: "G722", pt: 9, clockRate: 8000, sampleRate: 16000, channels: 1}
+	// Opus is always signalled as opus/48000/2 (RFC 7587); we code mono at 24 kHz, the AI's output rate.
+	codecOpus = audioCodec{name: "opus", pt: 111, clockRate: 48000, sampleRate: opusSampleRate, channels: 2}
+	// Uncompressed 16-bit PCM, mono, network byte order (RFC 3551 §4.5.11) on dynamic payload types.
+	codecL16_8k  = audioCodec{name: "L16", pt: 96, clockRate: 8000, sampleRate: 8000, channels: 1}
+	codecL16_16k = audioCodec{name: "L16", pt: 97, clockRate: 16000, sampleRate: 16000, channels: 1}
+	codecL16_24k = audioCodec{name: "L16", pt: 98, clockRate: 24000, sampleRate: 24000, channels: 1}
+	codecL16_48k = audioCodec{name: "L16", pt: 99, clockRate: 48000, sampleRate: 48000, channels: 1}
+	// Comfort noise (RFC 3389), on the static payload type; never an audio codec of its own (cng.go).
+	codecCN = audioCodec{name: "CN", pt: 13, clockRate: 8000, sampleRate: 8000, channels: 1}
+
+	// Codecs we support, in our default order of preference: lossless L16 when the caller offers it (LAN
+	// trunks), then wideband, the AI hears it better. L16 at 16 kHz is the AI's own input rate.
+	// Opus (when built in) comes last unless the agent prefers it.
+	supportedCodecs = func() []audioCodec {
+		out := []audioCodec{codecL16_16k, codecL16_24k, codecL16_48k, codecG722, codecL16_8k, codecPCMU, codecPCMA}
+		if opusAvailable {
+			out = append(out, codecOpus)
+		}
+		return out
+	}()
+)
+
+const (
+	opusSampleRate = 24000
+	opusMaxPacket  = 1500
+	// Loss rate the encoder plans for when in-band FEC is on (FEC is sized from it).
+	opusExpectedLossPct = 10
+	// Longest gap (in packets) we rebuild with FEC/PLC; longer ones are skipped.
+	maxConcealedPackets = 5
+)
+
+// frameSamples is the number of PCM samples in one 20 ms frame.
+func (c audioCodec) frameSamples() int { return c.sampleRate / 50 }
+
+// frameTicks is the RTP timestamp increment of one 20 ms frame.
+func (c audioCodec) frameTicks() int { return c.clockRate / 50 }
+
+func (c audioCodec) rtpmap() string {
+	if c.channels > 1 {
+		return fmt.Sprintf("a=rtpmap:%d %s/%d/%d", c.pt, c.name, c.clockRate, c.channels)
+	}
+	return fmt.Sprintf("a=rtpmap:%d %s/%d", c.pt, c.name, c.clockRate)
+}
+
+// sameFormat reports whether o is the same encoding as c (ignoring the payload type).
+func (c audioCodec) sameFormat(o audioCodec) bool {
+	return strings.EqualFold(c.name, o.name) && c.clockRate == o.clockRate && max(c.channels, 1) == max(o.channels, 1)
+}
+
+// parseSDPAudioCodecs returns the formats of the first m=audio section in the offerer's order, with
+// rtpmap/fmtp applied (static payload types without an rtpmap use their RFC 3551 defaults).
+func parseSDPAudioCodecs(body []byte) []audioCodec {
+	pts := parseSDPAudioPayloads(body)
+	if len(pts) == 0 {
+		return nil
+	}
+	rtpmap := map[uint8]audioCodec{}
+	fmtp := map[uint8]string{}
+	inAudio := false
+	for _, ln := range strings.Split(string(body), "\n") {
+		ln = strings.TrimSpace(strings.TrimRight(ln, "\r"))
+		lower := strings.ToLower(ln)
+		if strings.HasPrefix(lower, "m=") {
+			if inAudio {
+				break
+			}
+			inAudio = strings.HasPrefix(lower, "m=audio ")
+			continue
+		}
+		if !inAudio {
+			continue
+		}
+		if strings.HasPrefix(lower, "a=rtpmap:") {
+			f := strings.Fields(ln[len("a=rtpmap:"):])
+			if len(f) < 2 {
+				continue
+			}
+			n, err := strconv.Atoi(f[0])
+			if err != nil || n < 0 || n > 127 {
+				continue
+			}
+			enc := strings.Split(f[1], "/")
+			c := audioCodec{name: enc[0], pt: uint8(n), channels: 1}
+			if len(enc) > 1 {
+				c.clockRate, _ = strconv.Atoi(enc[1])
+			}
+			if len(enc) > 2 {
+				c.channels, _ = strconv.Atoi(enc[2])
+			}
+			rtpmap[uint8(n)] = c
+		} else if strings.HasPrefix(lower, "a=fmtp:") {
+			f := strings.SplitN(ln[len("a=fmtp:"):], " ", 2)
+			if n, err := strconv.Atoi(f[0]); err == nil && n >= 0 && n < 128 && len(f) == 2 {
+				fmtp[uint8(n)] = strings.TrimSpace(f[1])
+			}
+		}
+	}
+
+	var out []audioCodec
+	for _, pt := range pts {
+		c, ok := rtpmap[pt]
+		if !ok {
+			switch pt {
+			case 0:
+				c = codecPCMU
+			case 8:
+				c = codecPCMA
+			case 9:
+				c = codecG722
+			case 13:
+				c = codecCN
+			default:
+				continue
+			}
+		}
+		c.fmtp = fmtp[pt]
+		out = append(out, c)
+	}
+	return out
+}
+
+// agentCodecs is what we offer/accept for an agent: its preferredCodecs first (in its order), then
+// the rest of supportedCodecs, with our Opus fmtp from the agent's FEC/DTX settings.
+func agentCodecs(o callOptions) []audioCodec {
+	out := make([]audioCodec, 0, len(supportedCodecs))
+	used := make([]bool, len(supportedCodecs))
+	add := func(i int) {
+		if used[i] {
+			return
+		}
+		used[i] = true
+		c := supportedCodecs[i]
+		if c.sameFormat(codecOpus) {
+			c.fmtp = opusFmtp(o)
+		}
+		out = append(out, c)
+	}
+	for _, name := range o.preferredCodecs {
+		for i, c := range supportedCodecs {
+			// "L16" matches every L16 rate, "L16/24000" just one.
+			if strings.EqualFold(c.name, name) || strings.EqualFold(fmt.Sprintf("%s/%d", c.name, c.clockRate), name) {
+				add(i)
+			}
+		}
+	}
+	for i := range supportedCodecs {
+		add(i)
+	}
+	return out
+}
+
+// opusFmtp is our Opus format parameters: mono, capped at our coding rate, and whether we want the
+// caller to send in-band FEC and to use DTX (RFC 7587 §6.1).
+func opusFmtp(o callOptions) string {
+	f := fmt.Sprintf("maxplaybackrate=%d;sprop-maxcapturerate=%d;stereo=0;sprop-stereo=0", opusSampleRate, opusSampleRate)
+	if o.opusFec {
+		f += ";useinbandfec=1"
+	}
+	if o.opusDtx {
+		f += ";usedtx=1"
+	}
+	return f
+}
+
+// fmtpParam returns one parameter of an a=fmtp value ("a=1;b=2").
+func fmtpParam(fmtp, name string) string {
+	for _, kv := range strings.Split(fmtp, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		if strings.EqualFold(k, name) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// negotiateCodecs intersects an offer with ours (see agentCodecs). The first result is the codec we
+// send; the rest are listed in our answer too (we accept any of them).
+func negotiateCodecs(offer, ours []audioCodec) []audioCodec {
+	var out []audioCodec
+	for _, ours := range ours {
+		for _, theirs := range offer {
+			if ours.sameFormat(theirs) {
+				c := ours
+				c.pt = theirs.pt
+				out = append(out, c)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// audioDecoder decodes one RTP payload to PCM16 at the codec's sample rate.
+type audioDecoder interface {
+	decode(payload []byte) []int16
+}
+
+// lossDecoder is implemented by decoders that can rebuild lost packets (Opus FEC/PLC): lost frames
+// of samples each, just before next.
+type lossDecoder interface {
+	decodeLost(next []byte, lost, samples int) []int16
+}
+
+// l16Decoder decodes big-endian 16-bit PCM.
+type l16Decoder struct{}
+
+func (l16Decoder) decode(payload []byte) []int16 {
+	out := make([]int16, len(payload)/2)
+	for i := range out {
+		out[i] = int16(binary.BigEndian.Uint16(payload[2*i:]))
+	}
+	return out
+}
+
+// encodeL16 is the L16 payload for pcm.
+func encodeL16(pcm []int16) []byte {
+	out := make([]byte, len(pcm)*2)
+	for i, s := range pcm {
+		binary.BigEndian.PutUint16(out[2*i:], uint16(s))
+	}
+	return out
+}
+
+type g711Decoder uint8
+
+func (d g711Decoder) decode(payload []byte) []int16 { return decodeG711(uint8(d), payload) }
+
+func newAudioDecoder(c audioCodec) audioDecoder {
+	switch strings.ToUpper(c.name) {
+	case "PCMU":
+		return g711Decoder(0)
+	case "PCMA":
+		return g711Decoder(8)
+	case "G722":
+		return newG722Decoder()
+	case "L16":
+		if max(c.channels, 1) == 1 {
+			return l16Decoder{}
+		}
+	case "OPUS":
+		// We only get FEC if our fmtp asked for it.
+		if d, err := newOpusDecoder(c.sampleRate, fmtpParam(c.fmtp, "useinbandfec") == "1"); err == nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// rtpDecoder decodes inbound audio for one call, keeping codec state per payload type.
+type rtpDecoder struct {
+	codecs map[uint8]audioCodec
+	dec    map[uint8]audioDecoder
+
+	// Last sequence number seen, to spot lost packets.
+	seq     uint16
+	haveSeq bool
+
+	to8k *resample.Converter
+}
+
+func newRtpDecoder(codecs []audioCodec) *rtpDecoder {
+	d := &rtpDecoder{codecs: map[uint8]audioCodec{}, dec: map[uint8]audioDecoder{}}
+	// Static G.711 always decodes, even if the answer didn't list it.
+	// Decoders are made up front so the maps are read-only afterwards (clockRate is called from the
+	// RTP reader while another goroutine decodes).
+	for _, c := range append([]audioCodec{codecPCMU, codecPCMA}, codecs...) {
+		if dec := newAudioDecoder(c); dec != nil {
+			d.codecs[c.pt] = c
+			d.dec[c.pt] = dec
+		}
+	}
+	return d
+}
+
+// decode returns the packet's audio and its sample rate; nil for payload types we can't decode.
+func (d *rtpDecoder) decode(p *rtp.Packet) ([]int16, int) {
+	c, ok := d.codecs[p.PayloadType]
+	if !ok || len(p.Payload) == 0 {
+		return nil, 0
+	}
+	dec := d.dec[p.PayloadType]
+	lost := 0
+	if d.haveSeq {
+		lost = int(int16(p.SequenceNumber-d.seq)) - 1
+	}
+	if lost >= 0 {
+		d.seq, d.haveSeq = p.SequenceNumber, true
+	}
+	var pcm []int16
+	if ld, ok := dec.(lossDecoder); ok && lost > 0 && lost <= maxConcealedPackets {
+		// Rebuild the gap before decoding this packet (the decoder state runs in order); assume 20 ms packets.
+		pcm = ld.decodeLost(p.Payload, lost, c.frameSamples())
+	}
+	return append(pcm, dec.decode(p.Payload)...), c.sampleRate
+}
+
+// clockRate is the RTP clock of pt, 0 for payload types we can't decode.
+func (d *rtpDecoder) clockRate(pt uint8) int {
+	return d.codecs[pt].clockRate
+}
+
+// concealsLoss reports whether pt's decoder rebuilds lost packets itself (Opus).
+func (d *rtpDecoder) concealsLoss(pt uint8) bool {
+	_, ok := d.dec[pt].(lossDecoder)
+	return ok
+}
+
+// decode8k returns the packet's audio at 8 kHz (for the silence guard and in-band DTMF detection).
+func (d *rtpDecoder) decode8k(p *rtp.Packet) []int16 {
+	pcm, rate := d.decode(p)
+	if pcm == nil {
+		return nil
+	}
+	if d.to8k == nil {
+		d.to8k = resample.NewConverter(8000)
+	}
+	return d.to8k.Process(pcm, rate)
+}
+
+// sendCodec is the codec our RTP goes out in.
+func (cs *callSession) sendCodec() audioCodec {
+	if len(cs.codecs) == 0 {
+		return codecPCMU
+	}
+	return cs.codecs[0]
+}
+
+// audioEncoder encodes one frame of PCM16 at the codec's sample rate; nil means nothing to send
+// (Opus DTX).
+type audioEncoder interface {
+	encode(pcm []int16) []byte
+}
+
+type g711Encoder uint8
+
+func (e g711Encoder) encode(pcm []int16) []byte {
+	payload := make([]byte, len(pcm))
+	for i, s := range pcm {
+		if e == 8 {
+			payload[i] = linearToALaw(s)
+		} else {
+			payload[i] = linearToMuLaw(s)
+		}
+	}
+	return payload
+}
+
+type l16Encoder struct{}
+
+func (l16Encoder) encode(pcm []int16) []byte { return encodeL16(pcm) }
+
+// rtpEncoder is the downlink side of the negotiated codec: payload type, frame size and timestamp
+// increment all follow the SDP answer. Each RTP stream needs its own (G.722/Opus keep state).
+type rtpEncoder struct {
+	audioEncoder
+	codec audioCodec
+
+	from8k *resample.Resampler
+}
+
+func newAudioEncoder(c audioCodec, o callOptions) (audioEncoder, error) {
+	switch strings.ToUpper(c.name) {
+	case "PCMU":
+		return g711Encoder(0), nil
+	case "PCMA":
+		return g711Encoder(8), nil
+	case "G722":
+		return newG722Encoder(), nil
+	case "L16":
+		if max(c.channels, 1) == 1 {
+			return l16Encoder{}, nil
+		}
+	case "OPUS":
+		return newOpusEncoder(c.sampleRate, o.opusFec, o.opusDtx)
+	}
+	return nil, fmt.Errorf("no encoder for %s/%d", c.name, c.clockRate)
+}
+
+// newEncoder returns an encoder for the call's send codec, falling back to PCMU (which every SIP peer
+// takes) if it can't be built.
+func (cs *callSession) newEncoder(logger *log.Logger) *rtpEncoder {
+	c := cs.sendCodec()
+	enc, err := newAudioEncoder(c, cs.opts)
+	if err != nil {
+		logger.Printf("rtp: %v, sending PCMU (call-id=%s)", err, cs.callID)
+		return &rtpEncoder{audioEncoder: g711Encoder(0), codec: codecPCMU}
+	}
+	return &rtpEncoder{audioEncoder: enc, codec: c}
+}
+
+func (e *rtpEncoder) pt() uint8         { return e.codec.pt }
+func (e *rtpEncoder) sampleRate() int   { return e.codec.sampleRate }
+func (e *rtpEncoder) frameSamples() int { return e.codec.frameSamples() }
+func (e *rtpEncoder) frameTicks() int   { return e.codec.frameTicks() }
+
+// encode8k encodes a frame of 8 kHz audio (tones, prompts), resampled to the codec's rate.
+func (e *rtpEncoder) encode8k(pcm8k []int16) []byte {
+	if e.codec.sampleRate == 8000 {
+		return e.encode(pcm8k)
+	}
+	if e.from8k == nil {
+		e.from8k = resample.New(8000, e.codec.sampleRate)
+	}
+	return e.encode(e.from8k.Process(pcm8k))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sipDialog is the UAS side of an INVITE dialog: everything we need to send our own
+// in-dialog requests (BYE, session refreshes) back to the peer that called us.
+type sipDialog struct {
+	mu sync.Mutex
+
+	conn net.PacketConn
+	// Where in-dialog requests go. We always send to the SIP source of the INVITE
+	// (FreeSWITCH in this setup) rather than resolving Contact/Record-Route hosts.
+	peer net.Addr
+
+	callID string
+	// local/remote are header values as seen from our side of the dialog.
+	localURI     string // our To header from the INVITE (with tag) -> From in our requests
+	remoteURI    string // their From header (with tag) -> To in our requests
+	remoteTarget string // Contact URI from the INVITE -> Request-URI
+	routeSet     []string
+	localContact string
+	viaHost      string
+	viaPort      string
+
+	cseq int
+}
+
+func newSipDialog(conn net.PacketConn, peer net.Addr, req sipMsg, toWithTag, contact, contactHost, sipListenPort string) *sipDialog {
+	target := extractURI(req.header("contact"))
+	if target == "" {
+		// No Contact (broken peer): fall back to the From URI, which at least routes back to the PBX.
+		target = extractURI(req.header("from"))
+	}
+	return &sipDialog{
+		conn:         conn,
+		peer:         peer,
+		callID:       req.header("call-id"),
+		localURI:     toWithTag,
+		remoteURI:    req.header("from"),
+		remoteTarget: target,
+		// UAS keeps Record-Route order as received.
+		routeSet:     append([]string(nil), req.headers("record-route")...),
+		localContact: contact,
+		viaHost:      contactHost,
+		viaPort:      sipListenPort,
+		cseq:         1,
+	}
+}
+
+func extractURI(hdr string) string {
+	// "Name" <sip:1001@1.2.3.4:5060;transport=udp>;tag=x -> sip:1001@1.2.3.4:5060;transport=udp
+	s := strings.TrimSpace(hdr)
+	if i := strings.IndexByte(s, '<'); i >= 0 {
+		if j := strings.IndexByte(s[i:], '>'); j > 0 {
+			return strings.TrimSpace(s[i+1 : i+j])
+		}
+	}
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func viaBranch(via string) string {
+	for _, p := range strings.Split(via, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "branch") {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// buildRequest renders an in-dialog request and returns it along with its Via branch and CSeq number.
+func (d *sipDialog) buildRequest(method string, extra map[string][]string, body []byte) (string, string, int) {
+	d.mu.Lock()
+	d.cseq++
+	cseq := d.cseq
+	d.mu.Unlock()
+
+	branch := "z9hG4bK" + randHex(12)
+	return d.render(method, cseq, branch, extra, body), branch, cseq
+}
+
+func (d *sipDialog) render(method string, cseq int, branch string, extra map[string][]string, body []byte) string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("%s %s SIP/2.0\r\n", method, d.remoteTarget))
+	b.WriteString(fmt.Sprintf("Via: SIP/2.0/UDP %s;branch=%s;rport\r\n", net.JoinHostPort(d.viaHost, d.viaPort), branch))
+	b.WriteString("Max-Forwards: 70\r\n")
+	for _, r := range d.routeSet {
+		b.WriteString("Route: " + r + "\r\n")
+	}
+	b.WriteString("From: " + d.localURI + "\r\n")
+	b.WriteString("To: " + d.remoteURI + "\r\n")
+	b.WriteString("Call-ID: " + d.callID + "\r\n")
+	b.WriteString(fmt.Sprintf("CSeq: %d %s\r\n", cseq, method))
+	if d.localContact != "" {
+		b.WriteString("Contact: " + d.localContact + "\r\n")
+	}
+	b.WriteString("User-Agent: sip-rtp-go\r\n")
+	for k, vals := range extra {
+		for _, v := range vals {
+			b.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	b.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)))
+	if len(body) > 0 {
+		b.Write(body)
+	}
+	return b.String()
+}
+
+// sendRequest sends a non-INVITE in-dialog request and waits for its final response,
+// retransmitting like RFC 3261 timer E (500ms doubling, capped at 4s) until timer F (32s).
+func (d *sipDialog) sendRequest(st *runtimeState, method string, extra map[string][]string, body []byte) (sipMsg, error) {
+	raw, branch, _ := d.buildRequest(method, extra, body)
+	respCh := st.startClientTx(branch)
+	defer st.endClientTx(branch)
+
+	deadline := time.NewTimer(32 * time.Second)
+	defer deadline.Stop()
+	interval := 500 * time.Millisecond
+	for {
+		if _, err := d.conn.WriteTo([]byte(raw), d.peer); err != nil {
+			return sipMsg{}, err
+		}
+		retrans := time.NewTimer(interval)
+		select {
+		case resp := <-respCh:
+			retrans.Stop()
+			if resp.status < 200 {
+				// Provisional: stop retransmitting, keep waiting for the final response.
+				for resp.status < 200 {
+					select {
+					case resp = <-respCh:
+					case <-deadline.C:
+						return sipMsg{}, fmt.Errorf("%s timed out after provisional", method)
+					}
+				}
+			}
+			return resp, nil
+		case <-deadline.C:
+			retrans.Stop()
+			return sipMsg{}, fmt.Errorf("%s timed out", method)
+		case <-retrans.C:
+		}
+		interval *= 2
+		if interval > 4*time.Second {
+			interval = 4 * time.Second
+		}
+	}
+}
+
+// sendInvite sends an in-dialog re-INVITE and ACKs its final response. Retransmits follow
+// RFC 3261 timer A (500ms doubling) until a response arrives, giving up after timer B (32s).
+func (d *sipDialog) sendInvite(st *runtimeState, extra map[string][]string, body []byte) (sipMsg, error) {
+	raw, branch, cseq := d.buildRequest("INVITE", extra, body)
+	respCh := st.startClientTx(branch)
+	defer st.endClientTx(branch)
+
+	deadline := time.NewTimer(32 * time.Second)
+	defer deadline.Stop()
+	interval := 500 * time.Millisecond
+	retransmit := true
+	for {
+		var retrans <-chan time.Time
+		if retransmit {
+			if _, err := d.conn.WriteTo([]byte(raw), d.peer); err != nil {
+				return sipMsg{}, err
+			}
+			retrans = time.After(interval)
+			interval *= 2
+		}
+		select {
+		case resp := <-respCh:
+			if resp.status < 200 {
+				retransmit = false
+				continue
+			}
+			if resp.status < 300 {
+				// ACK for 2xx is its own transaction (new branch, same CSeq number).
+				ack := d.render("ACK", cseq, "z9hG4bK"+randHex(12), nil, nil)
+				_, _ = d.conn.WriteTo([]byte(ack), d.peer)
+			} else {
+				// ACK for non-2xx belongs to the INVITE transaction (same branch).
+				ack := d.render("ACK", cseq, branch, nil, nil)
+				_, _ = d.conn.WriteTo([]byte(ack), d.peer)
+			}
+			return resp, nil
+		case <-deadline.C:
+			return sipMsg{}, errors.New("INVITE timed out")
+		case <-retrans:
+		}
+	}
+}
+
+// sendRequestAuth is sendRequest plus one digest retry when the server challenges with 401/407
+// (out-of-dialog requests like MESSAGE are authenticated by FreeSWITCH like REGISTER).
+func (d *sipDialog) sendRequestAuth(st *runtimeState, method string, extra map[string][]string, body []byte, user, pass string) (sipMsg, error) {
+	resp, err := d.sendRequest(st, method, extra, body)
+	if err != nil || (resp.status != 401 && resp.status != 407) {
+		return resp, err
+	}
+	chHdr, authHdr := "www-authenticate", "Authorization"
+	if resp.status == 407 {
+		chHdr, authHdr = "proxy-authenticate", "Proxy-Authorization"
+	}
+	ch, err := parseDigestChallenge(resp.header(chHdr))
+	if err != nil {
+		return resp, nil
+	}
+	withAuth := map[string][]string{}
+	for k, v := range extra {
+		withAuth[k] = v
+	}
+	withAuth[authHdr] = []string{buildAuthorization(method, d.remoteTarget, user, pass, ch, 1)}
+	return d.sendRequest(st, method, withAuth, body)
+}
+
+// sendBye tears the dialog down from our side. reason is a full Reason header value (RFC 3326).
+func (d *sipDialog) sendBye(st *runtimeState, reason string) (sipMsg, error) {
+	var extra map[string][]string
+	if reason != "" {
+		extra = map[string][]string{"Reason": {reason}}
+	}
+	return d.sendRequest(st, "BYE", extra, nil)
+}
+
+func q850Reason(cause int, text string) string {
+	return "Q.850;cause=" + strconv.Itoa(cause) + ";text=\"" + strings.ReplaceAll(text, `"`, `'`) + "\""
+}
+
+func (st *runtimeState) startClientTx(branch string) chan sipMsg {
+	ch := make(chan sipMsg, 4)
+	st.mu.Lock()
+	st.clientTx[branch] = ch
+	st.mu.Unlock()
+	return ch
+}
+
+func (st *runtimeState) endClientTx(branch string) {
+	st.mu.Lock()
+	delete(st.clientTx, branch)
+	st.mu.Unlock()
+}
+
+// deliverSIPResponse hands a response received on the UAS socket to the client transaction that sent the request.
+func deliverSIPResponse(st *runtimeState, m sipMsg) {
+	branch := viaBranch(m.header("via"))
+	if branch == "" {
+		return
+	}
+	st.mu.RLock()
+	ch := st.clientTx[branch]
+	st.mu.RUnlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- m:
+	default:
+	}
+}
+
+// waitForAck retransmits our 2xx until the ACK arrives (RFC 3261 §13.3.1.4; T1 doubling capped at T2,
+// 64*T1 total). For a delayed offer (INVITE without SDP) the ACK carries the SDP answer, which sets the
+// RTP peer and codec. On success cs.acked is closed; otherwise the call is hung up.
+func waitForAck(logger *log.Logger, st *runtimeState, cs *callSession, resend func()) {
+	deadline := time.NewTimer(32 * time.Second)
+	defer deadline.Stop()
+	interval := 500 * time.Millisecond
+	for {
+		retrans := time.NewTimer(interval)
+		select {
+		case <-cs.stopCh:
+			retrans.Stop()
+			return
+		case ack := <-cs.ackCh:
+			retrans.Stop()
+			if cs.delayedOffer && !applySDPAnswer(logger, cs, ack) {
+				hangupCall(logger, st, cs, q850IncompatibleDestination, "no usable SDP answer in ACK")
+				return
+			}
+			close(cs.acked)
+			return
+		case <-deadline.C:
+			retrans.Stop()
+			logger.Printf("sip: no ACK for 200 OK (call-id=%s)", cs.callID)
+			hangupCall(logger, st, cs, q850RecoveryOnTimeout, "no ACK")
+			return
+		case <-retrans.C:
+			resend()
+		}
+		interval *= 2
+		if interval > 4*time.Second {
+			interval = 4 * time.Second
+		}
+	}
+}
+
+// applySDPAnswer takes the RTP peer and codec from the SDP answer in an ACK (delayed offer).
+func applySDPAnswer(logger *log.Logger, cs *callSession, ack sipMsg) bool {
+	peer := parseSDPRtpAddr(ack.body, cs.dlg.peer)
+	// Our 200 OK offered cs.codecs; the answer picks from them.
+	codecs := negotiateCodecs(parseSDPAudioCodecs(ack.body), cs.codecs)
+	if peer == nil || len(codecs) == 0 {
+		logger.Printf("sip: ACK without usable SDP answer (call-id=%s body=%dB)", cs.callID, len(ack.body))
+		return false
+	}
+	cs.remoteRtp = peer
+	cs.codecs = codecs
+	// telephone-event as answered; without it, the clock still follows the answered codec (in-band
+	// tones and the DTMF frame size are timed on it).
+	dpt, clock, ok := parseSDPTelephoneEvent(ack.body, codecs[0].clockRate)
+	if !ok {
+		dpt, clock = cs.dtmfPT, codecs[0].clockRate
+	}
+	cs.mu.Lock()
+	cs.dtmfPT = dpt
+	cs.dtmfClock = clock
+	cs.dtmfRx.clock = clock
+	cs.dtmfNegotiated = ok
+	cs.mu.Unlock()
+	if cs.cn.name != "" {
+		// We offered CN/8000; it stays only if the answer kept it and the audio runs on an 8 kHz clock.
+		cs.cn, _ = parseSDPComfortNoise(ack.body, codecs[0].clockRate)
+	}
+	logger.Printf("rtp peer from ACK sdp: call-id=%s peer=%s codec=%s", cs.callID, peer.String(), codecs[0].name)
+	return true
+}
+
+// deliverAck hands an ACK to the call waiting for it; duplicates are dropped.
+func (cs *callSession) deliverAck(m sipMsg) {
+	select {
+	case cs.ackCh <- m:
+	default:
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"math"
+	"math/cmplx"
+	"strings"
+)
+
+// Audio clean-up per direction (caller audio before the backend, AI audio before the caller), in
+// this order: DC/high-pass filter, spectral noise suppression, automatic gain control and a peak
+// limiter. Agents pick a preset per direction.
+const (
+	dspOff      = "off"
+	dspLight    = "light"    // high-pass and limiter
+	dspStandard = "standard" // plus moderate noise suppression and AGC
+	dspNoisy    = "noisy"    // steeper high-pass, strong noise suppression, AGC
+	dspLevel    = "level"    // DC blocker, AGC and limiter: for audio that is clean but at the wrong level
+
+	// AGC: speech is brought to this RMS level. Blocks below the gate, or less than agcSpeechDB above
+	// the tracked noise floor, are not speech and keep the current gain, so noise isn't pumped up.
+	// The gain moves at most upDBs/downDBs per second.
+	agcTargetDBFS = -20.0
+	agcGateDBFS   = -55.0
+	agcSpeechDB   = 10.0
+	agcMaxGainDB  = 20.0
+	agcMinGainDB  = -12.0
+	agcUpDBs      = 6.0
+	agcDownDBs    = 30.0
+
+	limiterCeilingDBFS = -1.0
+	limiterReleaseMs   = 50.0
+
+	// Noise suppression: decision-directed a priori SNR smoothing, smoothing of the power spectrum
+	// the noise is estimated from, and how fast the noise estimate follows a louder spectrum (dB/s);
+	// it follows a quieter one at once.
+	nsDDAlpha     = 0.98
+	nsSmoothAlpha = 0.7
+	nsRiseDBs     = 3.0
+	nsWindowMs    = 32
+)
+
+type dspConfig struct {
+	highPassHz float64 // 0: off
+	nsDB       float64 // maximum noise attenuation, 0: off
+	agc        bool
+	limiter    bool
+}
+
+var dspPresets = map[string]dspConfig{
+	dspLight:    {highPassHz: 80, limiter: true},
+	dspStandard: {highPassHz: 80, nsDB: 12, agc: true, limiter: true},
+	dspNoisy:    {highPassHz: 120, nsDB: 20, agc: true, limiter: true},
+	dspLevel:    {highPassHz: 20, agc: true, limiter: true},
+}
+
+func parseDspPreset(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if _, ok := dspPresets[s]; ok {
+		return s
+	}
+	return dspOff
+}
+
+// dspChain processes one continuous stream at a fixed rate. With noise suppression the output lags
+// the input by half an analysis window; every call still returns as many samples as it was given.
+type dspChain struct {
+	rate int
+	hp   *biquad
+	ns   *noiseSuppressor
+	agc  *agcState
+	lim  *limiter
+}
+
+// newDSPChain returns nil for the "off" preset.
+func newDSPChain(preset string, rate int) *dspChain {
+	cfg, ok := dspPresets[preset]
+	if !ok || rate <= 0 {
+		return nil
+	}
+	c := &dspChain{rate: rate}
+	if cfg.highPassHz > 0 {
+		c.hp = newHighPass(cfg.highPassHz, rate)
+	}
+	if cfg.nsDB > 0 {
+		c.ns = newNoiseSuppressor(rate, cfg.nsDB)
+	}
+	if cfg.agc {
+		c.agc = &agcState{rate: rate}
+	}
+	if cfg.limiter {
+		c.lim = newLimiter(rate)
+	}
+	return c
+}
+
+func (c *dspChain) process(pcm []int16) []int16 {
+	x := make([]float64, len(pcm))
+	for i, s := range pcm {
+		x[i] = float64(s)
+	}
+	if c.hp != nil {
+		c.hp.process(x)
+	}
+	if c.ns != nil {
+		x = c.ns.process(x)
+	}
+	if c.agc != nil {
+		c.agc.process(x)
+	}
+	if c.lim != nil {
+		c.lim.process(x)
+	}
+	out := make([]int16, len(x))
+	for i, v := range x {
+		out[i] = sat16f(v)
+	}
+	return out
+}
+
+// biquad is a second-order IIR section (RBJ cookbook coefficients, direct form I).
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// newHighPass is a Butterworth (Q = 1/sqrt 2) high-pass at hz.
+func newHighPass(hz float64, rate int) *biquad {
+	w := 2 * math.Pi * hz / float64(rate)
+	alpha := math.Sin(w) / math.Sqrt2 // sin(w) / 2Q
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	return &biquad{
+		b0: (1 + cos) / 2 / a0,
+		b1: -(1 + cos) / a0,
+		b2: (1 + cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+func (f *biquad) process(x []float64) {
+	for i, v := range x {
+		y := f.b0*v + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+		f.x2, f.x1 = f.x1, v
+		f.y2, f.y1 = f.y1, y
+		x[i] = y
+	}
+}
+
+// noiseSuppressor is a short-time spectral Wiener filter: 50% overlapping sqrt-Hann windows of about
+// 32 ms, a per-bin noise estimate that tracks the spectral floor, and gains from a decision-directed
+// a priori SNR, never below the maximum attenuation.
+type noiseSuppressor struct {
+	n, hop int
+	window []float64
+	floor  float64 // minimum gain
+	rise   float64 // per-frame noise estimate growth factor
+
+	in     []float64 // input not yet analysed (the last hop of the previous frame first)
+	out    []float64 // finished output, waiting to be returned
+	ola    []float64 // overlap-add tail of the previous frame
+	smooth []float64 // power spectrum smoothed over frames
+	noise  []float64
+	prev   []float64 // previous frame's clean power, for the a priori SNR
+	frames int
+}
+
+func newNoiseSuppressor(rate int, maxAttenDB float64) *noiseSuppressor {
+	n := 1
+	for n < rate*nsWindowMs/1000 {
+		n <<= 1
+	}
+	hop := n / 2
+	s := &noiseSuppressor{
+		n:      n,
+		hop:    hop,
+		window: make([]float64, n),
+		floor:  math.Pow(10, -maxAttenDB/20),
+		rise:   math.Pow(10, nsRiseDBs*float64(hop)/float64(rate)/10),
+		in:     make([]float64, hop),
+		// One hop of latency, so every call has output for all of its input.
+		out:    make([]float64, hop),
+		ola:    make([]float64, hop),
+		smooth: make([]float64, n/2+1),
+		noise:  make([]float64, n/2+1),
+		prev:   make([]float64, n/2+1),
+	}
+	for i := range s.window {
+		s.window[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n)))
+	}
+	return s
+}
+
+func (s *noiseSuppressor) process(x []float64) []float64 {
+	s.in = append(s.in, x...)
+	for len(s.in) >= s.n {
+		s.frame(s.in[:s.n])
+		s.in = s.in[s.hop:]
+	}
+	y := s.out[:len(x)]
+	s.out = append([]float64(nil), s.out[len(x):]...)
+	return y
+}
+
+func (s *noiseSuppressor) frame(x []float64) {
+	buf := make([]complex128, s.n)
+	for i, v := range x {
+		buf[i] = complex(v*s.window[i], 0)
+	}
+	fft(buf, false)
+
+	s.frames++
+	for k := 0; k <= s.n/2; k++ {
+		p := real(buf[k])*real(buf[k]) + imag(buf[k])*imag(buf[k])
+		switch {
+		case s.frames <= 4:
+			// Start from the first frames' average (usually before anyone speaks).
+			s.smooth[k] += (p - s.smooth[k]) / float64(s.frames)
+			s.noise[k] = s.smooth[k]
+		default:
+			s.smooth[k] = nsSmoothAlpha*s.smooth[k] + (1-nsSmoothAlpha)*p
+			s.noise[k] = math.Min(s.smooth[k], s.noise[k]*s.rise)
+		}
+		noise := math.Max(s.noise[k], 1e-3)
+		post := p / noise
+		prio := nsDDAlpha*s.prev[k]/noise + (1-nsDDAlpha)*math.Max(post-1, 0)
+		g := math.Max(prio/(1+prio), s.floor)
+		s.prev[k] = g * g * p
+		buf[k] *= complex(g, 0)
+		if k > 0 && k < s.n/2 {
+			buf[s.n-k] = cmplx.Conj(buf[k])
+		}
+	}
+
+	fft(buf, true)
+	for i := 0; i < s.hop; i++ {
+		s.out = append(s.out, s.ola[i]+real(buf[i])*s.window[i])
+		s.ola[i] = real(buf[s.hop+i]) * s.window[s.hop+i]
+	}
+}
+
+// fft is an in-place radix-2 FFT; len(a) must be a power of two. The inverse is scaled by 1/n.
+func fft(a []complex128, inverse bool) {
+	n := len(a)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, sign*2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := a[start+k], a[start+k+size/2]*w
+				a[start+k], a[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+	if inverse {
+		for i := range a {
+			a[i] /= complex(float64(n), 0)
+		}
+	}
+}
+
+// agcState adjusts the gain every 10 ms from the block's level, ramping within the block. The noise
+// floor is tracked like the VAD's (vad.go).
+type agcState struct {
+	rate   int
+	gainDB float64
+	floor  float64
+	primed bool
+}
+
+func (a *agcState) process(x []float64) {
+	block := a.rate / 100
+	for start := 0; start < len(x); start += block {
+		b := x[start:min(start+block, len(x))]
+		var sumSq float64
+		for _, v := range b {
+			sumSq += v * v
+		}
+		dur := float64(len(b)) / float64(a.rate)
+		level := -100.0
+		if rms := math.Sqrt(sumSq / float64(len(b))); rms > 1e-5*32768 {
+			level = 20 * math.Log10(rms/32768)
+		}
+		if !a.primed {
+			if level <= -100 {
+				continue // digital silence (e.g. before the stream starts) says nothing about the noise
+			}
+			a.floor, a.primed = level, true
+		}
+		target := a.gainDB
+		if level > agcGateDBFS && level-a.floor >= agcSpeechDB {
+			target = math.Max(agcMinGainDB, math.Min(agcMaxGainDB, agcTargetDBFS-level))
+		}
+		if level < a.floor {
+			a.floor += (level - a.floor) * math.Min(1, dur/vadFloorFall.Seconds())
+		} else {
+			a.floor += math.Min(level-a.floor, vadFloorRiseDBs*dur)
+		}
+		from := a.gainDB
+		if target > from {
+			a.gainDB = math.Min(target, from+agcUpDBs*dur)
+		} else {
+			a.gainDB = math.Max(target, from-agcDownDBs*dur)
+		}
+		g0, g1 := math.Pow(10, from/20), math.Pow(10, a.gainDB/20)
+		for i := range b {
+			b[i] *= g0 + (g1-g0)*float64(i+1)/float64(len(b))
+		}
+	}
+}
+
+// limiter keeps peaks under the ceiling: the gain drops at once to fit a peak and recovers with the
+// release time constant.
+type limiter struct {
+	ceiling, release float64
+	env              float64
+}
+
+func newLimiter(rate int) *limiter {
+	return &limiter{
+		ceiling: 32768 * math.Pow(10, limiterCeilingDBFS/20),
+		release: math.Exp(-1000 / (limiterReleaseMs * float64(rate))),
+	}
+}
+
+func (l *limiter) process(x []float64) {
+	for i, v := range x {
+		if a := math.Abs(v); a > l.env {
+			l.env = a
+		} else {
+			l.env = l.env*l.release + a*(1-l.release)
+		}
+		if l.env > l.ceiling {
+			x[i] = v * l.ceiling / l.env
+		}
+	}
+}
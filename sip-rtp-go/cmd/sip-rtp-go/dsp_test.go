@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// dspSine is amp*sin at hz, n samples at rate.
+func dspSine(hz, amp float64, rate, n int) []float64 {
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = amp * math.Sin(2*math.Pi*hz*float64(i)/float64(rate))
+	}
+	return x
+}
+
+// dspDBFS is the RMS of x in dBFS.
+func dspDBFS(x []float64) float64 {
+	var sumSq float64
+	for _, v := range x {
+		sumSq += v * v
+	}
+	return 20 * math.Log10(math.Sqrt(sumSq/float64(len(x)))/32768)
+}
+
+func TestHighPassResponse(t *testing.T) {
+	const rate = 8000
+	for _, tc := range []struct {
+		hz, wantDB, tolDB float64
+	}{
+		{20, -24, 1}, // two octaves below: 12 dB/octave
+		{40, -12.3, 1},
+		{80, -3, 0.5}, // the corner
+		{300, 0, 0.2},
+		{1000, 0, 0.1},
+		{3400, 0, 0.1},
+	} {
+		t.Run(fmt.Sprintf("%.0fHz", tc.hz), func(t *testing.T) {
+			x := dspSine(tc.hz, 10000, rate, rate)
+			in := dspDBFS(x[rate/2:])
+			newHighPass(80, rate).process(x)
+			// Settled after half a second.
+			if got := dspDBFS(x[rate/2:]) - in; math.Abs(got-tc.wantDB) > tc.tolDB {
+				t.Errorf("gain %.2f dB, want %.1f±%.1f dB", got, tc.wantDB, tc.tolDB)
+			}
+		})
+	}
+
+	t.Run("DC", func(t *testing.T) {
+		x := make([]float64, rate)
+		for i := range x {
+			x[i] = 5000
+		}
+		newHighPass(20, rate).process(x)
+		if v := math.Abs(x[len(x)-1]); v > 1 {
+			t.Errorf("DC offset %.1f left after a second", v)
+		}
+	})
+}
+
+// Stationary noise is attenuated by close to the maximum; a tone well above it, switching on and off
+// like speech, comes through.
+func TestNoiseSuppression(t *testing.T) {
+	const rate, secs = 8000, 4
+	for _, maxDB := range []float64{12, 20} {
+		t.Run(fmt.Sprintf("%.0fdB", maxDB), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			noise := make([]float64, secs*rate)
+			for i := range noise {
+				noise[i] = 300 * rng.NormFloat64()
+			}
+			tone := dspSine(1000, 3000, rate, secs*rate)
+			// Bursts of 200 ms every 400 ms, from the second second on.
+			on := func(i int) bool { return i >= rate && i%(rate*2/5) < rate/5 }
+			in := make([]float64, len(noise))
+			for i := range in {
+				in[i] = noise[i]
+				if on(i) {
+					in[i] += tone[i]
+				}
+			}
+
+			ns := newNoiseSuppressor(rate, maxDB)
+			var out []float64
+			for i := 0; i < len(in); i += 160 {
+				y := ns.process(append([]float64(nil), in[i:i+160]...))
+				if len(y) != 160 {
+					t.Fatalf("%d samples in, %d out", 160, len(y))
+				}
+				out = append(out, y...)
+			}
+
+			// Noise only, once the estimate settled (output lags by a hop). Residual musical noise keeps
+			// it somewhat short of the maximum.
+			lag := ns.hop
+			if got := dspDBFS(noise[rate/2:rate]) - dspDBFS(out[rate/2+lag:rate+lag]); got < 0.75*maxDB {
+				t.Errorf("noise attenuated by %.1f dB, want at least %.0f dB", got, 0.75*maxDB)
+			}
+			// The bursts of the last second (skipping their edges).
+			var burstIn, burstOut []float64
+			for i := (secs - 1) * rate; i+lag < len(out); i++ {
+				if on(i) && on(i-rate/50) && on(i+rate/50) {
+					burstIn, burstOut = append(burstIn, in[i]), append(burstOut, out[i+lag])
+				}
+			}
+			if d := dspDBFS(burstOut) - dspDBFS(burstIn); math.Abs(d) > 1.5 {
+				t.Errorf("tone bursts changed by %.1f dB, want within 1.5 dB", d)
+			}
+		})
+	}
+}
+
+// The AGC brings speech to the target level from either side, within its gain range and slew rates.
+func TestAGCConvergence(t *testing.T) {
+	const rate = 8000
+	for _, tc := range []struct {
+		levelDB, wantDB float64
+		settle          float64 // seconds
+	}{
+		{-30, agcTargetDBFS, 10 / agcUpDBs},
+		{-10, agcTargetDBFS, 10 / agcDownDBs},
+		{-50, -50 + agcMaxGainDB, agcMaxGainDB / agcUpDBs}, // capped gain
+		{-3, -3 + agcMinGainDB, 9 / agcDownDBs},            // capped attenuation
+	} {
+		t.Run(fmt.Sprintf("%.0fdBFS", tc.levelDB), func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			a := &agcState{rate: rate}
+			// A second of quiet background sets the noise floor.
+			bg := make([]float64, rate)
+			for i := range bg {
+				bg[i] = 32768 * math.Pow(10, (tc.levelDB-30)/20) * rng.NormFloat64()
+			}
+			a.process(bg)
+
+			amp := 32768 * math.Sqrt2 * math.Pow(10, tc.levelDB/20)
+			n := int((tc.settle + 1) * rate)
+			x := dspSine(440, amp, rate, n)
+			for i := 0; i < n; i += rate / 50 {
+				a.process(x[i:min(i+rate/50, n)])
+			}
+			if got := dspDBFS(x[n-rate/2:]); math.Abs(got-tc.wantDB) > 0.5 {
+				t.Errorf("level %.1f dBFS after %.1fs, want %.1f dBFS", got, tc.settle+1, tc.wantDB)
+			}
+		})
+	}
+}
+
+func TestLimiterCeiling(t *testing.T) {
+	const rate = 8000
+	ceiling := 32768 * math.Pow(10, limiterCeilingDBFS/20)
+	for _, amp := range []float64{20000, 32767, 60000, 200000} {
+		t.Run(fmt.Sprintf("%.0f", amp), func(t *testing.T) {
+			x := dspSine(300, amp, rate, rate)
+			// A transient on top.
+			x[rate/2] = 4 * amp
+			orig := append([]float64(nil), x...)
+			newLimiter(rate).process(x)
+			var peak float64
+			for _, v := range x {
+				peak = math.Max(peak, math.Abs(v))
+			}
+			if peak > ceiling+1e-6 {
+				t.Errorf("peak %.0f above the ceiling %.0f", peak, ceiling)
+			}
+			if 4*amp <= ceiling {
+				for i := range x {
+					if x[i] != orig[i] {
+						t.Fatalf("sample %d changed below the ceiling: %.1f -> %.1f", i, orig[i], x[i])
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// Payload type we offer for telephone-event when the caller didn't pick one.
+	defaultDtmfPT = 101
+	// An RFC 4733 event without an end packet is reported once no update arrived for this long.
+	dtmfEventTimeout = 500 * time.Millisecond
+	// Digits shorter than this (RFC 4733 duration or INFO Duration) are treated as noise.
+	dtmfMinDuration = 20 * time.Millisecond
+)
+
+// RFC 4733 event codes 0-15 as digits.
+const dtmfDigits = "0123456789*#ABCD"
+
+// dtmfEvent is one digit pressed by the caller.
+type dtmfEvent struct {
+	digit    string
+	duration time.Duration
+	source   string // "rfc4733" | "info"
+}
+
+// telephoneEvent is telephone-event on payload type pt at clock, as it goes into our SDP.
+func telephoneEvent(pt uint8, clock int) audioCodec {
+	return audioCodec{name: "telephone-event", pt: pt, clockRate: clock, channels: 1, fmtp: "0-16"}
+}
+
+// offerTelephoneEvents lists telephone-event for our own offer (delayed offer): at 8000, and at each
+// other clock among codecs, so whichever codec the caller answers with has events on its clock.
+func offerTelephoneEvents(codecs []audioCodec) []audioCodec {
+	used := map[uint8]bool{}
+	for _, c := range codecs {
+		used[c.pt] = true
+	}
+	pt := uint8(defaultDtmfPT)
+	next := func() uint8 {
+		for used[pt] {
+			pt++
+		}
+		used[pt] = true
+		return pt
+	}
+	out := []audioCodec{telephoneEvent(next(), 8000)}
+	clocks := map[int]bool{8000: true}
+	for _, c := range codecs {
+		if !clocks[c.clockRate] {
+			clocks[c.clockRate] = true
+			out = append(out, telephoneEvent(next(), c.clockRate))
+		}
+	}
+	return out
+}
+
+// parseSDPTelephoneEvent returns the payload type and clock rate of telephone-event in an SDP body,
+// preferring the one at clock (the audio codec's rate, RFC 4733 §2.1) over telephone-event/8000.
+func parseSDPTelephoneEvent(body []byte, clock int) (uint8, int, bool) {
+	var (
+		pt    uint8
+		rate  int
+		found bool
+	)
+	for _, ln := range strings.Split(string(body), "\n") {
+		ln = strings.TrimSpace(strings.TrimRight(ln, "\r"))
+		rest, ok := strings.CutPrefix(strings.ToLower(ln), "a=rtpmap:")
+		if !ok {
+			continue
+		}
+		f := strings.Fields(rest)
+		if len(f) < 2 {
+			continue
+		}
+		enc := strings.Split(f[1], "/")
+		if enc[0] != "telephone-event" || len(enc) < 2 {
+			continue
+		}
+		r, _ := strconv.Atoi(enc[1])
+		n, err := strconv.Atoi(f[0])
+		if err != nil || n < 96 || n > 127 || (r != clock && r != 8000) {
+			continue
+		}
+		if !found || r == clock {
+			pt, rate, found = uint8(n), r, true
+		}
+	}
+	return pt, rate, found
+}
+
+// rfc4733Receiver turns telephone-event packets into digits. All packets of one event share an RTP
+// timestamp; the end packet is sent three times, and a lost end is covered by the timeout. An event
+// longer than the duration field holds (0xFFFF ticks: 8.2 s at 8 kHz, 1.37 s at 48 kHz) goes on in
+// new segments, each timestamped where the previous one reached the maximum, with no end in between
+// (RFC 4733 §2.5.1.3).
+type rfc4733Receiver struct {
+	active   bool
+	ts       uint32 // of the current segment
+	event    uint8
+	duration uint16 // of the current segment
+	earlier  uint32 // ticks in the event's earlier segments
+	lastSeen time.Time
+	clock    int // event clock rate (durations are in its ticks)
+
+	// Timestamp of the last reported event, so retransmitted end packets are dropped.
+	reported   bool
+	reportedTS uint32
+}
+
+// handle processes one telephone-event payload and returns the digits it finished.
+func (r *rfc4733Receiver) handle(p *rtp.Packet, now time.Time) []dtmfEvent {
+	if len(p.Payload) < 4 {
+		return nil
+	}
+	event := p.Payload[0]
+	end := p.Payload[1]&0x80 != 0
+	duration := binary.BigEndian.Uint16(p.Payload[2:4])
+	if int(event) >= len(dtmfDigits) {
+		return nil
+	}
+	if r.reported && p.Timestamp == r.reportedTS {
+		// Retransmitted end packet of a digit we already reported.
+		return nil
+	}
+
+	var out []dtmfEvent
+	if r.active && p.Timestamp != r.ts {
+		if event == r.event && r.nextSegment(p.Timestamp) {
+			r.earlier += p.Timestamp - r.ts
+			r.ts = p.Timestamp
+			r.duration = 0
+		} else if ev, ok := r.finish(); ok {
+			// New event before the previous one ended: report the previous one now.
+			out = append(out, ev)
+		}
+	}
+	if !r.active {
+		r.active = true
+		r.ts = p.Timestamp
+		r.event = event
+	}
+	if duration > r.duration {
+		r.duration = duration
+	}
+	r.lastSeen = now
+	if end {
+		if ev, ok := r.finish(); ok {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// nextSegment reports whether ts starts the next segment of the current event: it is where the
+// current segment reached the maximum duration, give or take a packet.
+func (r *rfc4733Receiver) nextSegment(ts uint32) bool {
+	d := int64(ts - r.ts)
+	slack := int64(max(r.clock, 8000) / 50)
+	return d >= 0xFFFF-slack && d <= 0xFFFF+slack
+}
+
+// expire reports an event whose end packets were all lost.
+func (r *rfc4733Receiver) expire(now time.Time) (dtmfEvent, bool) {
+	if !r.active || now.Sub(r.lastSeen) < dtmfEventTimeout {
+		return dtmfEvent{}, false
+	}
+	return r.finish()
+}
+
+func (r *rfc4733Receiver) finish() (dtmfEvent, bool) {
+	ev := dtmfEvent{
+		digit:    string(dtmfDigits[r.event]),
+		duration: time.Duration(int64(r.earlier)+int64(r.duration)) * time.Second / time.Duration(max(r.clock, 8000)),
+		source:   "rfc4733",
+	}
+	r.reported = true
+	r.reportedTS = r.ts
+	r.active = false
+	r.duration = 0
+	r.earlier = 0
+	return ev, ev.duration >= dtmfMinDuration
+}
+
+// parseInfoDtmf reads a digit from an INFO body: application/dtmf-relay ("Signal=5\r\nDuration=160")
+// or application/dtmf ("5").
+func parseInfoDtmf(contentType string, body []byte) (dtmfEvent, bool) {
+	ct := strings.ToLower(strings.TrimSpace(contentType))
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = strings.TrimSpace(ct[:i])
+	}
+	ev := dtmfEvent{source: "info"}
+	switch ct {
+	case "application/dtmf-relay":
+		for _, ln := range strings.Split(string(body), "\n") {
+			k, v, ok := strings.Cut(strings.TrimSpace(strings.TrimRight(ln, "\r")), "=")
+			if !ok {
+				continue
+			}
+			v = strings.TrimSpace(v)
+			switch strings.ToLower(strings.TrimSpace(k)) {
+			case "signal":
+				ev.digit = normalizeDtmfDigit(v)
+			case "duration":
+				if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+					ev.duration = time.Duration(ms) * time.Millisecond
+				}
+			}
+		}
+	case "application/dtmf":
+		ev.digit = normalizeDtmfDigit(strings.TrimSpace(string(body)))
+	default:
+		return dtmfEvent{}, false
+	}
+	if ev.digit == "" {
+		return dtmfEvent{}, false
+	}
+	if ev.duration == 0 {
+		ev.duration = 250 * time.Millisecond
+	}
+	return ev, ev.duration >= dtmfMinDuration
+}
+
+// normalizeDtmfDigit accepts a digit character or an RFC 4733 event number ("10" = "*", "11" = "#").
+func normalizeDtmfDigit(s string) string {
+	if len(s) == 1 {
+		if c := strings.ToUpper(s); strings.Contains(dtmfDigits, c) {
+			return c
+		}
+		return ""
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n < len(dtmfDigits) {
+		return string(dtmfDigits[n])
+	}
+	return ""
+}
+
+// handleInfo answers an in-dialog INFO and picks up DTMF bodies. INFO retransmissions (same CSeq)
+// are answered again but the digit is reported once.
+func handleInfo(logger *log.Logger, conn net.PacketConn, addr net.Addr, m sipMsg, st *runtimeState) {
+	sendSIPResponse(conn, addr, m, "", "", 200, "OK", map[string][]string{
+		"Allow": {sipAllow},
+	}, nil)
+	ev, ok := parseInfoDtmf(m.header("content-type"), m.body)
+	if !ok {
+		return
+	}
+	st.mu.RLock()
+	cs := st.calls[m.header("call-id")]
+	st.mu.RUnlock()
+	if cs == nil {
+		return
+	}
+	cseq := cseqNumber(m)
+	cs.mu.Lock()
+	dup := cseq != 0 && cseq == cs.lastInfoCSeq
+	cs.lastInfoCSeq = cseq
+	cs.mu.Unlock()
+	if dup {
+		return
+	}
+	cs.deliverDtmf(logger, ev)
+}
+
+// handleTelephoneEvent feeds an inbound RTP packet to the RFC 4733 receiver. It returns false for
+// packets that are not telephone-events (i.e. audio).
+func (cs *callSession) handleTelephoneEvent(logger *log.Logger, p *rtp.Packet) bool {
+	if p.PayloadType != cs.dtmfPT {
+		return false
+	}
+	cs.mu.Lock()
+	evs := cs.dtmfRx.handle(p, time.Now())
+	cs.mu.Unlock()
+	for _, ev := range evs {
+		cs.deliverDtmf(logger, ev)
+	}
+	return true
+}
+
+// deliverDtmf queues a digit for the media runner; digits are dropped if nobody reads them.
+func (cs *callSession) deliverDtmf(logger *log.Logger, ev dtmfEvent) {
+	logger.Printf("dtmf: call-id=%s ext=%s digit=%s duration=%s source=%s", cs.callID, cs.extID, ev.digit, ev.duration, ev.source)
+	select {
+	case cs.dtmf <- ev:
+	default:
+	}
+}
+
+// watchDtmf reports RFC 4733 events whose end packets were lost and hands every digit to fn
+// until the call ends or stop (nil: never) fires.
+func (cs *callSession) watchDtmf(logger *log.Logger, stop <-chan struct{}, fn func(dtmfEvent)) {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case <-stop:
+			return
+		case ev := <-cs.dtmf:
+			if fn != nil {
+				fn(ev)
+			}
+		case now := <-t.C:
+			cs.mu.Lock()
+			ev, ok := cs.dtmfRx.expire(now)
+			cs.mu.Unlock()
+			if ok {
+				cs.deliverDtmf(logger, ev)
+			}
+		}
+	}
+}
+
+// dtmfMsg is the JSON event a digit becomes on the WS backend.
+func dtmfMsg(cs *callSession, ev dtmfEvent) map[string]any {
+	return map[string]any{
+		"type":       "dtmf",
+		"callId":     cs.callID,
+		"digit":      ev.digit,
+		"durationMs": ev.duration.Milliseconds(),
+		"source":     ev.source,
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Our own offer lists telephone-event at 8000 and at each other clock, on payload types no codec uses.
+func TestOfferTelephoneEvents(t *testing.T) {
+	codecs := []audioCodec{codecL16_16k, codecPCMU, codecOpus, codecG722}
+	var got []string
+	for _, c := range offerTelephoneEvents(codecs) {
+		got = append(got, c.rtpmap())
+	}
+	want := []string{
+		"a=rtpmap:101 telephone-event/8000",
+		"a=rtpmap:102 telephone-event/16000",
+		"a=rtpmap:103 telephone-event/48000",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("offered %q, want %q", got, want)
+	}
+
+	sdp := buildSDP("192.0.2.1", 4000, "sendrecv", codecs, offerTelephoneEvents(codecs), codecCN)
+	if !strings.Contains(sdp, "m=audio 4000 RTP/AVP 97 0 111 9 13 101 102 103\r\n") {
+		t.Errorf("m= line wrong in\n%s", sdp)
+	}
+	for _, ln := range append(want, "a=fmtp:101 0-16", "a=fmtp:103 0-16") {
+		if !strings.Contains(sdp, ln+"\r\n") {
+			t.Errorf("%q missing from\n%s", ln, sdp)
+		}
+	}
+}
+
+// The answer to a delayed offer sets the DTMF clock: the telephone-event the caller kept, or the
+// answered codec's clock when it kept none.
+func TestApplySDPAnswerDtmfClock(t *testing.T) {
+	codecs := []audioCodec{codecL16_16k, codecPCMU}
+	for _, tc := range []struct {
+		name       string
+		answer     string
+		pt         uint8
+		clock      int
+		negotiated bool
+	}{
+		{"L16 with its event", "m=audio 5000 RTP/AVP 97 102\r\na=rtpmap:97 L16/16000\r\na=rtpmap:102 telephone-event/16000\r\n", 102, 16000, true},
+		{"L16 with event/8000", "m=audio 5000 RTP/AVP 97 101\r\na=rtpmap:97 L16/16000\r\na=rtpmap:101 telephone-event/8000\r\n", 101, 8000, true},
+		{"PCMU with its event", "m=audio 5000 RTP/AVP 0 101\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:101 telephone-event/8000\r\n", 101, 8000, true},
+		{"L16 without events", "m=audio 5000 RTP/AVP 97\r\na=rtpmap:97 L16/16000\r\n", 101, 16000, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := &callSession{
+				dlg:       &sipDialog{peer: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 5060}},
+				codecs:    codecs,
+				dtmfPT:    defaultDtmfPT,
+				dtmfClock: 8000,
+			}
+			ack := sipMsg{body: []byte("v=0\r\nc=IN IP4 192.0.2.9\r\n" + tc.answer)}
+			if !applySDPAnswer(log.New(io.Discard, "", 0), cs, ack) {
+				t.Fatal("answer rejected")
+			}
+			if cs.dtmfPT != tc.pt || cs.dtmfClock != tc.clock || cs.dtmfRx.clock != tc.clock || cs.dtmfNegotiated != tc.negotiated {
+				t.Errorf("pt=%d clock=%d rx clock=%d negotiated=%v, want pt=%d clock=%d negotiated=%v",
+					cs.dtmfPT, cs.dtmfClock, cs.dtmfRx.clock, cs.dtmfNegotiated, tc.pt, tc.clock, tc.negotiated)
+			}
+		})
+	}
+}
+
+// teEvent is what a sender following RFC 4733 sends for one key press of length dur, one packet per
+// 20 ms: segments of at most 0xFFFF ticks for long presses, then the end packet three times, unless
+// ends is false (all lost).
+func teEvent(ts uint32, event uint8, clock int, dur time.Duration, ends bool) []*rtp.Packet {
+	pkt := func(ts uint32, end bool, d uint32) *rtp.Packet {
+		b := []byte{event, 10, 0, 0}
+		if end {
+			b[1] |= 0x80
+		}
+		binary.BigEndian.PutUint16(b[2:], uint16(d))
+		return &rtp.Packet{Header: rtp.Header{Timestamp: ts}, Payload: b}
+	}
+	total := uint32(dur.Seconds() * float64(clock))
+	step := uint32(clock / 50)
+	var out []*rtp.Packet
+	seg := ts
+	for el := step; ; el += step {
+		el = min(el, total)
+		if el-(seg-ts) > 0xFFFF {
+			// This segment is full: report the maximum, then go on in a new one.
+			out = append(out, pkt(seg, false, 0xFFFF))
+			seg += 0xFFFF
+		}
+		if el == total {
+			if ends {
+				for i := 0; i < 3; i++ {
+					out = append(out, pkt(seg, true, el-(seg-ts)))
+				}
+			}
+			return out
+		}
+		out = append(out, pkt(seg, false, el-(seg-ts)))
+	}
+}
+
+func TestRFC4733Receiver(t *testing.T) {
+	type press struct {
+		ts    uint32
+		event uint8
+		dur   time.Duration
+		ends  bool
+	}
+	for _, tc := range []struct {
+		name    string
+		clock   int
+		presses []press
+		want    []dtmfEvent
+	}{
+		{"short", 8000, []press{{1000, 5, 120 * time.Millisecond, true}},
+			[]dtmfEvent{{"5", 120 * time.Millisecond, "rfc4733"}}},
+		{"same digit twice", 8000, []press{{1000, 1, 100 * time.Millisecond, true}, {3000, 1, 100 * time.Millisecond, true}},
+			[]dtmfEvent{{"1", 100 * time.Millisecond, "rfc4733"}, {"1", 100 * time.Millisecond, "rfc4733"}}},
+		{"same digit twice, first end lost", 8000, []press{{1000, 1, 100 * time.Millisecond, false}, {3000, 1, 100 * time.Millisecond, true}},
+			[]dtmfEvent{{"1", 80 * time.Millisecond, "rfc4733"}, {"1", 100 * time.Millisecond, "rfc4733"}}},
+		{"too short", 8000, []press{{1000, 2, 10 * time.Millisecond, true}}, nil},
+		// 0xFFFF ticks at 48 kHz is 1.37 s: three segments.
+		{"long at 48 kHz", 48000, []press{{1000, 11, 3 * time.Second, true}},
+			[]dtmfEvent{{"#", 3 * time.Second, "rfc4733"}}},
+		{"long across timestamp wrap", 48000, []press{{0xFFFFFFFF - 70000, 0, 2 * time.Second, true}},
+			[]dtmfEvent{{"0", 2 * time.Second, "rfc4733"}}},
+		{"long at 8 kHz", 8000, []press{{1000, 9, 10 * time.Second, true}},
+			[]dtmfEvent{{"9", 10 * time.Second, "rfc4733"}}},
+		{"long, then another digit", 48000, []press{{1000, 4, 2 * time.Second, false}, {1000 + 2*48000 + 4800, 7, 100 * time.Millisecond, true}},
+			[]dtmfEvent{{"4", 2*time.Second - 20*time.Millisecond, "rfc4733"}, {"7", 100 * time.Millisecond, "rfc4733"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := rfc4733Receiver{clock: tc.clock}
+			now := time.Now()
+			var got []dtmfEvent
+			for _, p := range tc.presses {
+				for _, pkt := range teEvent(p.ts, p.event, tc.clock, p.dur, p.ends) {
+					now = now.Add(20 * time.Millisecond)
+					got = append(got, r.handle(pkt, now)...)
+				}
+			}
+			if ev, ok := r.expire(now.Add(time.Second)); ok {
+				got = append(got, ev)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
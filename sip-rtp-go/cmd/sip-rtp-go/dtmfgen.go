@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// Digits the backend asks us to send ({"type":"sendDtmf","digits":"12#"}) go out as RFC 4733 events when
+// the caller negotiated telephone-event, else as SIP INFO (application/dtmf-relay) when the peer allows
+// INFO, else as in-band tones. Per-agent dtmfSendMode forces one of them.
+const (
+	dtmfSendAuto    = "auto"
+	dtmfSendRFC4733 = "rfc4733"
+	dtmfSendInfo    = "info"
+	dtmfSendInband  = "inband"
+
+	defaultDtmfToneMs = 100
+	dtmfGapMs         = 100
+	// RFC 4733 event volume (-dBm0).
+	dtmfEventVolume = 10
+)
+
+func parseDtmfSendMode(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "rfc4733", "rfc2833":
+		return dtmfSendRFC4733
+	case "info":
+		return dtmfSendInfo
+	case "inband":
+		return dtmfSendInband
+	default:
+		return dtmfSendAuto
+	}
+}
+
+// dtmfSendMethod picks how digits are sent on this call.
+func (cs *callSession) dtmfSendMethod() string {
+	switch cs.opts.dtmfSendMode {
+	case dtmfSendRFC4733, dtmfSendInfo, dtmfSendInband:
+		return cs.opts.dtmfSendMode
+	}
+	cs.mu.Lock()
+	negotiated := cs.dtmfNegotiated
+	cs.mu.Unlock()
+	switch {
+	case negotiated:
+		return dtmfSendRFC4733
+	case cs.peerAllowsInfo:
+		return dtmfSendInfo
+	default:
+		return dtmfSendInband
+	}
+}
+
+// cleanDtmfDigits keeps the valid keypad characters of s.
+func cleanDtmfDigits(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if strings.ContainsRune(dtmfDigits, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// dtmfFrame is what the playback worker sends on one 20 ms tick while a digit is playing:
+// either a telephone-event payload (with its own RTP timestamp and marker) or tone audio.
+type dtmfFrame struct {
+	event  []byte
+	ts     uint32
+	marker bool
+	pcm    []int16
+}
+
+// dtmfDigit counts in event clock ticks for RFC 4733 and in 8 kHz samples for tones.
+type dtmfDigit struct {
+	code     int
+	samples  int
+	rfc4733  bool
+	startTS  uint32
+	started  bool
+	elapsed  int // samples played
+	endsSent int
+	gapLeft  int // silence after the digit, in samples
+}
+
+// dtmfGenerator turns queued digits into 20 ms frames for the downlink. The playback worker owns it;
+// digits arrive on queue from the WS reader.
+type dtmfGenerator struct {
+	queue chan dtmfDigit
+	cur   *dtmfDigit
+}
+
+func newDtmfGenerator() *dtmfGenerator {
+	return &dtmfGenerator{queue: make(chan dtmfDigit, 64)}
+}
+
+// enqueue queues digits for RFC 4733 (events at clock Hz) or in-band playback; it returns how many
+// were queued.
+func (g *dtmfGenerator) enqueue(digits string, dur time.Duration, rfc4733 bool, clock int) int {
+	n := 0
+	if !rfc4733 {
+		clock = 8000
+	}
+	samples := int(dur * time.Duration(clock) / time.Second)
+	for _, r := range digits {
+		d := dtmfDigit{
+			code:    strings.IndexRune(dtmfDigits, r),
+			samples: samples,
+			rfc4733: rfc4733,
+			gapLeft: dtmfGapMs * clock / 1000,
+		}
+		select {
+		case g.queue <- d:
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+// next returns the frame for this tick, or false when no digit is playing (normal audio goes out).
+// ts is the RTP timestamp the tick would have used for audio, frameTicks the event clock ticks of
+// one 20 ms frame. Tone frames are 20 ms of 8 kHz audio.
+func (g *dtmfGenerator) next(ts uint32, frameTicks int) (dtmfFrame, bool) {
+	if g.cur == nil {
+		select {
+		case d := <-g.queue:
+			g.cur = &d
+		default:
+			return dtmfFrame{}, false
+		}
+	}
+	d := g.cur
+	if !d.started {
+		d.started = true
+		d.startTS = ts
+	}
+	frameSamples := frameTicks
+	if !d.rfc4733 {
+		frameSamples = 160
+	}
+
+	if d.elapsed < d.samples {
+		d.elapsed = min(d.elapsed+frameSamples, d.samples)
+		if d.rfc4733 {
+			return dtmfFrame{event: rfc4733Payload(d.code, d.elapsed, false), ts: d.startTS, marker: d.elapsed <= frameSamples}, true
+		}
+		return dtmfFrame{pcm: dtmfTonePcm(d.code, d.elapsed-frameSamples, frameSamples)}, true
+	}
+	if d.rfc4733 && d.endsSent < 3 {
+		// RFC 4733 §2.5.1.4: the end packet goes out three times with the same timestamp and duration.
+		d.endsSent++
+		return dtmfFrame{event: rfc4733Payload(d.code, d.samples, true), ts: d.startTS}, true
+	}
+	if d.gapLeft > 0 {
+		d.gapLeft -= frameSamples
+		return dtmfFrame{pcm: make([]int16, 160)}, true
+	}
+	g.cur = nil
+	return g.next(ts, frameTicks)
+}
+
+func rfc4733Payload(code, duration int, end bool) []byte {
+	b := make([]byte, 4)
+	b[0] = byte(code)
+	b[1] = dtmfEventVolume
+	if end {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(min(duration, 0xFFFF)))
+	return b
+}
+
+// dtmfTonePcm renders n samples of the keypad tone for code, starting at sample pos.
+func dtmfTonePcm(code, pos, n int) []int16 {
+	key := dtmfDigits[code]
+	var row, col int
+	for r := range dtmfKeypad {
+		for c := range dtmfKeypad[r] {
+			if dtmfKeypad[r][c] == key {
+				row, col = r, c
+			}
+		}
+	}
+	out := make([]int16, n)
+	for i := range out {
+		t := float64(pos+i) / 8000
+		// Low group ~2 dB under the high group, both around -7 dBm0.
+		v := 5500*math.Sin(2*math.Pi*dtmfRowFreqs[row]*t) + 7000*math.Sin(2*math.Pi*dtmfColFreqs[col]*t)
+		out[i] = int16(v)
+	}
+	return out
+}
+
+// sendDtmfInfo sends each digit as an in-dialog INFO (application/dtmf-relay), one after the other.
+func sendDtmfInfo(logger *log.Logger, st *runtimeState, cs *callSession, digits string, dur time.Duration) {
+	if cs.dlg == nil {
+		return
+	}
+	for _, r := range digits {
+		select {
+		case <-cs.stopCh:
+			return
+		default:
+		}
+		body := fmt.Sprintf("Signal=%c\r\nDuration=%d\r\n", r, dur.Milliseconds())
+		resp, err := cs.dlg.sendRequest(st, "INFO", map[string][]string{
+			"Content-Type": {"application/dtmf-relay"},
+		}, []byte(body))
+		if err != nil {
+			logger.Printf("dtmf send: INFO failed (call-id=%s digit=%c): %v", cs.callID, r, err)
+			return
+		}
+		if resp.status >= 300 {
+			logger.Printf("dtmf send: INFO got %d %s (call-id=%s digit=%c)", resp.status, resp.reason, cs.callID, r)
+			return
+		}
+		time.Sleep(dtmfGapMs * time.Millisecond)
+	}
+}
+
+// sendDtmf handles a backend sendDtmf command.
+func sendDtmf(logger *log.Logger, st *runtimeState, cs *callSession, gen *dtmfGenerator, digits string, durMs int) {
+	clean := cleanDtmfDigits(digits)
+	if clean == "" {
+		logger.Printf("dtmf send: no valid digits in %q (call-id=%s)", digits, cs.callID)
+		return
+	}
+	if durMs <= 0 {
+		durMs = defaultDtmfToneMs
+	}
+	dur := time.Duration(min(max(durMs, 40), 2000)) * time.Millisecond
+	method := cs.dtmfSendMethod()
+	logger.Printf("dtmf send: call-id=%s digits=%s method=%s duration=%s", cs.callID, clean, method, dur)
+	switch method {
+	case dtmfSendInfo:
+		go sendDtmfInfo(logger, st, cs, clean, dur)
+	default:
+		cs.mu.Lock()
+		clock := cs.dtmfClock
+		cs.mu.Unlock()
+		if n := gen.enqueue(clean, dur, method == dtmfSendRFC4733, clock); n < len(clean) {
+			logger.Printf("dtmf send: queue full, dropped %d digits (call-id=%s)", len(clean)-n, cs.callID)
+		}
+	}
+}
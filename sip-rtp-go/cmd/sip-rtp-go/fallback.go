@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What an AI call turns into when its backend can't be reached at setup, or is gone mid-call after
+// the reconnect budget: the agent's fallback policy. All but echo start with the agent's
+// fallbackPrompt, if any.
+const (
+	fallbackHold     = "hold"     // beep loop (the default: the line never goes silent), hung up after fallbackHoldMax if set
+	fallbackHangup   = "hangup"   // hang up (Q.850 41)
+	fallbackTransfer = "transfer" // blind transfer (REFER) to fallbackTransferTo
+	fallbackEcho     = "echo"     // echo the caller's audio until they hang up
+
+	// How long a transfer may take (REFER accepted, NOTIFY with the final status) before we give up
+	// and hang up.
+	fallbackTransferWait = 30 * time.Second
+)
+
+func parseFallbackPolicy(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "transfer", "refer":
+		return fallbackTransfer
+	case "echo":
+		return fallbackEcho
+	case "hangup":
+		return fallbackHangup
+	default:
+		return fallbackHold
+	}
+}
+
+// runFallback runs the agent's fallback policy on a call whose AI session failed (why), until the
+// call ends. The policy and its outcome are logged.
+func runFallback(logger *log.Logger, st *runtimeState, cs *callSession, why string) {
+	o := cs.opts
+	policy := o.fallback
+	switch {
+	case policy == fallbackTransfer && o.fallbackTransferTo == "":
+		logger.Printf("fallback: no fallbackTransferTo, hanging up instead (call-id=%s)", cs.callID)
+		policy = fallbackHangup
+	case policy == fallbackTransfer && (!cs.isAnswered() || cs.dlg == nil):
+		// REFER needs a confirmed dialog; early media has none.
+		logger.Printf("fallback: call not answered, hanging up instead of transferring (call-id=%s)", cs.callID)
+		policy = fallbackHangup
+	}
+	logger.Printf("fallback: call-id=%s ext=%s policy=%s reason=%q", cs.callID, cs.extID, policy, why)
+
+	var outcome string
+	switch policy {
+	case fallbackEcho:
+		runRTPEchoCall(logger, cs)
+		outcome = "echo until call end"
+	case fallbackHold:
+		playFallbackPrompt(logger, cs)
+		holdMax := o.fallbackHoldMax
+		timedOut := make(chan struct{})
+		if holdMax > 0 {
+			go func() {
+				select {
+				case <-cs.stopCh:
+				case <-time.After(holdMax):
+					close(timedOut)
+					hangupCall(logger, st, cs, q850TemporaryFailure, why)
+				}
+			}()
+		}
+		runRTPFallbackToneCall(logger, cs)
+		select {
+		case <-timedOut:
+			outcome = "hung up after " + holdMax.String() + " on hold"
+		default:
+			outcome = "call ended on hold: " + cs.hangupReason()
+		}
+	case fallbackTransfer:
+		playFallbackPrompt(logger, cs)
+		outcome = fallbackRefer(logger, st, cs, why)
+	case fallbackHangup:
+		playFallbackPrompt(logger, cs)
+		hangupCall(logger, st, cs, q850TemporaryFailure, why)
+		outcome = "hung up"
+	}
+	logger.Printf("fallback: call-id=%s ext=%s policy=%s outcome=%q", cs.callID, cs.extID, policy, outcome)
+}
+
+// playFallbackPrompt plays the agent's fallbackPrompt once, if it has one.
+func playFallbackPrompt(logger *log.Logger, cs *callSession) {
+	path := cs.opts.fallbackPrompt
+	if path == "" {
+		return
+	}
+	pcm, err := loadPromptPcm8k(path)
+	if err != nil {
+		logger.Printf("fallback: prompt %q: %v", path, err)
+		return
+	}
+	sender := newPromptSender(logger, cs)
+	stop := make(chan struct{})
+	defer close(stop)
+	go sender.drainRtp(stop)
+	sender.playPcm(pcm, nil)
+}
+
+// fallbackRefer blind-transfers the call to fallbackTransferTo and follows the transfer's NOTIFYs. A
+// completed transfer is hung up on our side (unless the PBX already did); a failed one is hung up
+// like the hangup policy.
+func fallbackRefer(logger *log.Logger, st *runtimeState, cs *callSession, why string) string {
+	target := cs.opts.fallbackTransferTo
+	if !strings.Contains(target, ":") {
+		st.mu.RLock()
+		agent := st.agentByUser[cs.extID]
+		st.mu.RUnlock()
+		target = "sip:" + target + "@" + agent.sipDomain
+	}
+	cs.mu.Lock()
+	cs.referCh = make(chan int, 4)
+	notify := cs.referCh
+	cs.mu.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go newPromptSender(logger, cs).drainRtp(stop)
+
+	resp, err := cs.dlg.sendRequest(st, "REFER", map[string][]string{
+		"Refer-To":    {"<" + target + ">"},
+		"Referred-By": {"<" + extractURI(cs.dlg.localURI) + ">"},
+	}, nil)
+	switch {
+	case err != nil:
+		hangupCall(logger, st, cs, q850TemporaryFailure, why)
+		return "REFER to " + target + " failed: " + err.Error()
+	case resp.status >= 300:
+		hangupCall(logger, st, cs, q850TemporaryFailure, why)
+		return "REFER to " + target + " rejected: " + strconv.Itoa(resp.status) + " " + resp.reason
+	}
+
+	wait := time.NewTimer(fallbackTransferWait)
+	defer wait.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return "call ended during transfer to " + target + ": " + cs.hangupReason()
+		case <-wait.C:
+			hangupCall(logger, st, cs, q850NormalClearing, "transfer timeout")
+			return "transfer to " + target + " not confirmed within " + fallbackTransferWait.String()
+		case status := <-notify:
+			if status < 200 {
+				continue
+			}
+			if status >= 300 {
+				hangupCall(logger, st, cs, q850TemporaryFailure, why)
+				return "transfer to " + target + " failed: " + strconv.Itoa(status)
+			}
+			hangupCall(logger, st, cs, q850NormalClearing, "transferred")
+			return "transferred to " + target
+		}
+	}
+}
+
+// deliverReferNotify passes the status line of a REFER NOTIFY (message/sipfrag body, e.g.
+// "SIP/2.0 200 OK") to a transfer in progress.
+func (cs *callSession) deliverReferNotify(body []byte) {
+	line, _, _ := strings.Cut(string(body), "\n")
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return
+	}
+	status, err := strconv.Atoi(f[1])
+	if err != nil {
+		return
+	}
+	cs.mu.Lock()
+	ch := cs.referCh
+	cs.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- status:
+	default:
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+// G.722 (ITU-T G.722, 64 kbit/s mode): 16 kHz audio split by a QMF into two sub-bands, coded with
+// 6-bit (low band) and 2-bit (high band) ADPCM. One byte per pair of input samples.
+// Fixed-point arithmetic follows the ITU reference so we interoperate bit-exactly with other stacks;
+// the I/O is 16-bit linear PCM (the reference uses 14-bit).
+
+var (
+	g722QmfCoeffs = [12]int{3, -11, 12, 32, -210, 951, 3876, -805, 362, -156, 53, -11}
+
+	g722Q6   = [32]int{0, 35, 72, 110, 150, 190, 233, 276, 323, 370, 422, 473, 530, 587, 650, 714, 786, 858, 940, 1023, 1121, 1219, 1339, 1458, 1612, 1765, 1980, 2195, 2557, 2919, 0, 0}
+	g722Iln  = [32]int{0, 63, 62, 31, 30, 29, 28, 27, 26, 25, 24, 23, 22, 21, 20, 19, 18, 17, 16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 0}
+	g722Ilp  = [32]int{0, 61, 60, 59, 58, 57, 56, 55, 54, 53, 52, 51, 50, 49, 48, 47, 46, 45, 44, 43, 42, 41, 40, 39, 38, 37, 36, 35, 34, 33, 32, 0}
+	g722Wl   = [8]int{-60, -30, 58, 172, 334, 538, 1198, 3042}
+	g722Rl42 = [16]int{0, 7, 6, 5, 4, 3, 2, 1, 7, 6, 5, 4, 3, 2, 1, 0}
+	g722Ilb  = [32]int{2048, 2093, 2139, 2186, 2233, 2282, 2332, 2383, 2435, 2489, 2543, 2599, 2656, 2714, 2774, 2834, 2896, 2960, 3025, 3091, 3158, 3228, 3298, 3371, 3444, 3520, 3597, 3676, 3756, 3838, 3922, 4008}
+	g722Qm4  = [16]int{0, -20456, -12896, -8968, -6288, -4240, -2584, -1200, 20456, 12896, 8968, 6288, 4240, 2584, 1200, 0}
+	g722Qm6  = [64]int{
+		-136, -136, -136, -136, -24808, -21904, -19008, -16704,
+		-14984, -13512, -12280, -11192, -10232, -9360, -8576, -7856,
+		-7192, -6576, -6000, -5456, -4944, -4464, -4008, -3576,
+		-3168, -2776, -2400, -2032, -1688, -1360, -1040, -728,
+		24808, 21904, 19008, 16704, 14984, 13512, 12280, 11192,
+		10232, 9360, 8576, 7856, 7192, 6576, 6000, 5456,
+		4944, 4464, 4008, 3576, 3168, 2776, 2400, 2032,
+		1688, 1360, 1040, 728, 432, 136, -432, -136,
+	}
+	g722Qm2 = [4]int{-7408, -1616, 7408, 1616}
+	g722Ihn = [3]int{0, 1, 0}
+	g722Ihp = [3]int{0, 3, 2}
+	g722Wh  = [3]int{0, -214, 798}
+	g722Rh2 = [4]int{2, 1, 2, 1}
+)
+
+func sat16(v int) int {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return v
+}
+
+// g722Band is the ADPCM predictor state of one sub-band.
+type g722Band struct {
+	s, sp, sz int
+	r         [3]int
+	a, ap     [3]int
+	p         [3]int
+	d         [7]int
+	b, bp     [7]int
+	sg        [7]int
+	nb, det   int
+}
+
+// update runs blocks 4 (RECONS .. PREDIC) of the reference: adapts the pole/zero predictor to dx.
+func (s *g722Band) update(dx int) {
+	// RECONS, PARREC
+	s.d[0] = dx
+	s.r[0] = sat16(s.s + dx)
+	s.p[0] = sat16(s.sz + dx)
+
+	// UPPOL2
+	for i := 0; i < 3; i++ {
+		s.sg[i] = s.p[i] >> 15
+	}
+	wd1 := sat16(s.a[1] << 2)
+	wd2 := wd1
+	if s.sg[0] == s.sg[1] {
+		wd2 = -wd1
+	}
+	if wd2 > 32767 {
+		wd2 = 32767
+	}
+	wd3 := -128
+	if s.sg[0] == s.sg[2] {
+		wd3 = 128
+	}
+	wd3 += wd2 >> 7
+	wd3 += (s.a[2] * 32512) >> 15
+	wd3 = min(max(wd3, -12288), 12288)
+	s.ap[2] = wd3
+
+	// UPPOL1
+	s.sg[0] = s.p[0] >> 15
+	s.sg[1] = s.p[1] >> 15
+	wd1 = -192
+	if s.sg[0] == s.sg[1] {
+		wd1 = 192
+	}
+	wd2 = (s.a[1] * 32640) >> 15
+	s.ap[1] = sat16(wd1 + wd2)
+	wd3 = sat16(15360 - s.ap[2])
+	s.ap[1] = min(max(s.ap[1], -wd3), wd3)
+
+	// UPZERO
+	wd1 = 128
+	if dx == 0 {
+		wd1 = 0
+	}
+	s.sg[0] = dx >> 15
+	for i := 1; i < 7; i++ {
+		s.sg[i] = s.d[i] >> 15
+		wd2 = -wd1
+		if s.sg[i] == s.sg[0] {
+			wd2 = wd1
+		}
+		wd3 = (s.b[i] * 32640) >> 15
+		s.bp[i] = sat16(wd2 + wd3)
+	}
+
+	// DELAYA
+	for i := 6; i > 0; i-- {
+		s.d[i] = s.d[i-1]
+		s.b[i] = s.bp[i]
+	}
+	for i := 2; i > 0; i-- {
+		s.r[i] = s.r[i-1]
+		s.p[i] = s.p[i-1]
+		s.a[i] = s.ap[i]
+	}
+
+	// FILTEP
+	wd1 = sat16(s.r[1] + s.r[1])
+	wd1 = (s.a[1] * wd1) >> 15
+	wd2 = sat16(s.r[2] + s.r[2])
+	wd2 = (s.a[2] * wd2) >> 15
+	s.sp = sat16(wd1 + wd2)
+
+	// FILTEZ
+	s.sz = 0
+	for i := 6; i > 0; i-- {
+		wd1 = sat16(s.d[i] + s.d[i])
+		s.sz += (s.b[i] * wd1) >> 15
+	}
+	s.sz = sat16(s.sz)
+
+	// PREDIC
+	s.s = sat16(s.sp + s.sz)
+}
+
+// scaleLow runs LOGSCL/SCALEL for the low band with the 4-bit quantizer index ril.
+func (s *g722Band) scaleLow(ril int) {
+	nb := (s.nb*127)>>7 + g722Wl[g722Rl42[ril]]
+	s.nb = min(max(nb, 0), 18432)
+	s.det = g722ScaleFactor(s.nb, 8)
+}
+
+// scaleHigh runs LOGSCH/SCALEH for the high band.
+func (s *g722Band) scaleHigh(ihigh int) {
+	nb := (s.nb*127)>>7 + g722Wh[g722Rh2[ihigh]]
+	s.nb = min(max(nb, 0), 22528)
+	s.det = g722ScaleFactor(s.nb, 10)
+}
+
+func g722ScaleFactor(nb, shift int) int {
+	wd1 := (nb >> 6) & 31
+	wd2 := shift - (nb >> 11)
+	var wd3 int
+	if wd2 < 0 {
+		wd3 = g722Ilb[wd1] << -wd2
+	} else {
+		wd3 = g722Ilb[wd1] >> wd2
+	}
+	return wd3 << 2
+}
+
+// g722Encoder encodes 16 kHz PCM16 to G.722 (64 kbit/s); state carries across frames.
+type g722Encoder struct {
+	x    [24]int
+	band [2]g722Band
+}
+
+func newG722Encoder() *g722Encoder {
+	e := &g722Encoder{}
+	e.band[0].det = 32
+	e.band[1].det = 8
+	return e
+}
+
+// encode codes pcm (an even number of 16 kHz samples) into len(pcm)/2 bytes.
+func (e *g722Encoder) encode(pcm []int16) []byte {
+	out := make([]byte, 0, len(pcm)/2)
+	for j := 0; j+1 < len(pcm); j += 2 {
+		// Transmit QMF: keep every other output of the two half-band filters.
+		copy(e.x[:22], e.x[2:])
+		e.x[22] = int(pcm[j])
+		e.x[23] = int(pcm[j+1])
+		var sumEven, sumOdd int
+		for i := 0; i < 12; i++ {
+			sumOdd += e.x[2*i] * g722QmfCoeffs[i]
+			sumEven += e.x[2*i+1] * g722QmfCoeffs[11-i]
+		}
+		xlow := (sumEven + sumOdd) >> 14
+		xhigh := (sumEven - sumOdd) >> 14
+
+		// Low band: SUBTRA, QUANTL (6 bits), INVQAL, LOGSCL, SCALEL.
+		lo := &e.band[0]
+		el := sat16(xlow - lo.s)
+		wd := el
+		if el < 0 {
+			wd = -(el + 1)
+		}
+		i := 1
+		for ; i < 30; i++ {
+			if wd < (g722Q6[i]*lo.det)>>12 {
+				break
+			}
+		}
+		ilow := g722Ilp[i]
+		if el < 0 {
+			ilow = g722Iln[i]
+		}
+		ril := ilow >> 2
+		dlow := (lo.det * g722Qm4[ril]) >> 15
+		lo.scaleLow(ril)
+		lo.update(dlow)
+
+		// High band: SUBTRA, QUANTH (2 bits), INVQAH, LOGSCH, SCALEH.
+		hi := &e.band[1]
+		eh := sat16(xhigh - hi.s)
+		wd = eh
+		if eh < 0 {
+			wd = -(eh + 1)
+		}
+		mih := 1
+		if wd >= (564*hi.det)>>12 {
+			mih = 2
+		}
+		ihigh := g722Ihp[mih]
+		if eh < 0 {
+			ihigh = g722Ihn[mih]
+		}
+		dhigh := (hi.det * g722Qm2[ihigh]) >> 15
+		hi.scaleHigh(ihigh)
+		hi.update(dhigh)
+
+		out = append(out, byte(ihigh<<6|ilow))
+	}
+	return out
+}
+
+// g722Decoder decodes G.722 (64 kbit/s) to 16 kHz PCM16; state carries across packets.
+type g722Decoder struct {
+	x    [24]int
+	band [2]g722Band
+}
+
+func newG722Decoder() *g722Decoder {
+	d := &g722Decoder{}
+	d.band[0].det = 32
+	d.band[1].det = 8
+	return d
+}
+
+// decode returns two 16 kHz samples per input byte.
+func (d *g722Decoder) decode(payload []byte) []int16 {
+	out := make([]int16, 0, len(payload)*2)
+	for _, code := range payload {
+		ilow := int(code) & 0x3F
+		ihigh := (int(code) >> 6) & 0x03
+
+		// Low band: INVQBL (6-bit reconstruction), RECONS, LIMIT; predictor adapts on the 4-bit value.
+		lo := &d.band[0]
+		rlow := lo.s + (lo.det*g722Qm6[ilow])>>15
+		rlow = min(max(rlow, -16384), 16383)
+		ril := ilow >> 2
+		dlow := (lo.det * g722Qm4[ril]) >> 15
+		lo.scaleLow(ril)
+		lo.update(dlow)
+
+		// High band: INVQAH, RECONS, LIMIT.
+		hi := &d.band[1]
+		dhigh := (hi.det * g722Qm2[ihigh]) >> 15
+		rhigh := min(max(dhigh+hi.s, -16384), 16383)
+		hi.scaleHigh(ihigh)
+		hi.update(dhigh)
+
+		// Receive QMF.
+		copy(d.x[:22], d.x[2:])
+		d.x[22] = rlow + rhigh
+		d.x[23] = rlow - rhigh
+		var xout1, xout2 int
+		for i := 0; i < 12; i++ {
+			xout2 += d.x[2*i] * g722QmfCoeffs[i]
+			xout1 += d.x[2*i+1] * g722QmfCoeffs[11-i]
+		}
+		out = append(out, int16(sat16(xout1>>11)), int16(sat16(xout2>>11)))
+	}
+	return out
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// g722Triangle is a ±12000 triangle wave with a 32-sample period.
+func g722Triangle(n int) []int16 {
+	out := make([]int16, n)
+	for i := range out {
+		k := i % 32
+		if k < 16 {
+			out[i] = int16(-12000 + 1500*k)
+		} else {
+			out[i] = int16(12000 - 1500*(k-16))
+		}
+	}
+	return out
+}
+
+// g722Noise is full-band noise from the C library's LCG, at a quarter of full scale.
+func g722Noise(n int) []int16 {
+	out := make([]int16, n)
+	x := uint32(1)
+	for i := range out {
+		x = (x*1103515245 + 12345) & 0x7fffffff
+		out[i] = int16((int(x>>16&0xffff) - 32768) >> 2)
+	}
+	return out
+}
+
+// Expected codes and samples come from a line-by-line transliteration of spandsp's g722.c (64 kbit/s,
+// 16-bit linear I/O, no packing), each run from a fresh state.
+func TestG722BitExact(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pcm  []int16
+		want string
+	}{
+		{"triangle", g722Triangle(160), "" +
+			"2c8420842084049016beb52eaa286af0f7fe5893108dd0565cfcf570ac296ef6fbde5a96118ed4db" +
+			"fefbf872ae2b73fbffdf5d97128fd95e7ffdf872ae2b777dfcfd5d97118edafeddfff973ad2a77fd"},
+		{"noise", g722Noise(160), "" +
+			"37922389a084040907110f921c1e1d1e14959d16f93c1bd5929b1ed2b81b390e9cd59b54f8125a58" +
+			"7c59cf5f9d1c57d539167f7818f75298ccf14d3f5d9f9c58efd5cd99f2d25e17d9b2dc5e5596d61d"},
+		{"silence", make([]int16, 16), "fafafafafafafafa"},
+	} {
+		t.Run("encode-"+tc.name, func(t *testing.T) {
+			want, _ := hex.DecodeString(tc.want)
+			// Two frames, so state carried across calls is covered too.
+			e := newG722Encoder()
+			half := len(tc.pcm) / 2
+			got := append(e.encode(tc.pcm[:half]), e.encode(tc.pcm[half:])...)
+			if len(got) != len(want) {
+				t.Fatalf("%d codes, want %d", len(got), len(want))
+			}
+			if i := firstDiff(got, want); i >= 0 {
+				t.Errorf("code %d: got %#02x, want %#02x", i, got[i], want[i])
+			}
+		})
+	}
+
+	t.Run("decode", func(t *testing.T) {
+		codes := make([]byte, 32)
+		for i := range codes {
+			codes[i] = byte(i*37 + 11)
+		}
+		want := []int16{
+			-1, 0, 0, -1, -1, 1, -1, -3, 0, 6, -6, -28, -13, 4, 14, -13,
+			-18, -17, 14, 7, -33, -105, -40, 76, 61, -103, -92, -3, 73, 2, -86, -169,
+			118, 452, 19, -784, -394, 813, 684, -674, -865, 116, 612, 71, -569, -676, 604, 2113,
+			684, -2352, -1866, 1585, 1877, -1286, -2079, 44, 1345, 418, -887, -1287, 670, 3290, 1445, -2936,
+		}
+		d := newG722Decoder()
+		got := append(d.decode(codes[:16]), d.decode(codes[16:])...)
+		if len(got) != len(want) {
+			t.Fatalf("%d samples, want %d", len(got), len(want))
+		}
+		if i := firstDiff(got, want); i >= 0 {
+			t.Errorf("sample %d: got %d, want %d", i, got[i], want[i])
+		}
+	})
+}
+
+// firstDiff returns the first index where got and want differ, -1 if they are equal. Slices of
+// different lengths differ at the end of the shorter one.
+func firstDiff[T comparable](got, want []T) int {
+	for i := 0; i < len(got) && i < len(want); i++ {
+		if got[i] != want[i] {
+			return i
+		}
+	}
+	if len(got) != len(want) {
+		return min(len(got), len(want))
+	}
+	return -1
+}
+
+func TestG722RoundTripSNR(t *testing.T) {
+	const rate, amp = 16000, 10000
+	// The low band (6-bit ADPCM) is far cleaner than the high band (2-bit, above 4 kHz).
+	for _, tc := range []struct{ freq, minSNR float64 }{
+		{300, 50}, {1000, 40}, {3000, 35}, {5000, 18}, {7000, 18},
+	} {
+		freq := tc.freq
+		t.Run(fmt.Sprintf("%.0fHz", freq), func(t *testing.T) {
+			in := make([]int16, rate)
+			for i := range in {
+				in[i] = int16(amp * math.Sin(2*math.Pi*freq*float64(i)/rate))
+			}
+			out := newG722Decoder().decode(newG722Encoder().encode(in))
+
+			// The QMF pair delays the signal; compare at the best lag, after the ADPCM has settled.
+			skip := rate / 10
+			best := math.Inf(-1)
+			for lag := 0; lag < 64; lag++ {
+				var sig, noise float64
+				for i := skip; i < len(in)-lag; i++ {
+					e := float64(out[i+lag]) - float64(in[i])
+					sig += float64(in[i]) * float64(in[i])
+					noise += e * e
+				}
+				best = math.Max(best, 10*math.Log10(sig/noise))
+			}
+			if best < tc.minSNR {
+				t.Errorf("SNR %.1f dB, want at least %.0f dB", best, tc.minSNR)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	// Default RTP receive timeout when an agent doesn't configure one.
+	defaultRtpTimeout = 60 * time.Second
+	// Caller audio below this RMS counts as silence for the maxSilence guard.
+	silenceRMSThreshold = 400
+
+	q850NormalClearing          = 16
+	q850TemporaryFailure        = 41
+	q850IncompatibleDestination = 88
+	q850RecoveryOnTimeout       = 102
+)
+
+// runCallGuards hangs the call up when one of the per-agent guard timers fires:
+// no RTP received, on hold for too long, maximum call duration, or caller silent for too long.
+func runCallGuards(logger *log.Logger, st *runtimeState, cs *callSession) {
+	o := cs.opts
+	if o.rtpTimeout <= 0 && o.holdTimeout <= 0 && o.maxDuration <= 0 && o.maxSilence <= 0 {
+		return
+	}
+
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case now := <-t.C:
+			cs.mu.Lock()
+			lastRtp := cs.lastRtpAt
+			lastVoice := cs.lastVoiceAt
+			holdSince := cs.holdSince
+			answered := cs.answered
+			cs.mu.Unlock()
+			onHold := !holdSince.IsZero()
+
+			switch {
+			case o.maxDuration > 0 && now.Sub(cs.startedAt) >= o.maxDuration:
+				hangupCall(logger, st, cs, q850NormalClearing, "max call duration")
+				return
+			case onHold && o.holdTimeout > 0 && now.Sub(holdSince) >= o.holdTimeout:
+				hangupCall(logger, st, cs, q850RecoveryOnTimeout, "hold timeout")
+				return
+			case !answered:
+				// Early media: caller RTP/speech isn't expected yet.
+			case !onHold && o.rtpTimeout > 0 && now.Sub(lastRtp) >= o.rtpTimeout:
+				hangupCall(logger, st, cs, q850RecoveryOnTimeout, "rtp timeout")
+				return
+			case !onHold && o.maxSilence > 0 && now.Sub(lastVoice) >= o.maxSilence:
+				hangupCall(logger, st, cs, q850NormalClearing, "caller silence")
+				return
+			}
+		}
+	}
+}
+
+// hangupCall ends a call from our side: BYE (with a Reason header) to the peer, then local teardown.
+func hangupCall(logger *log.Logger, st *runtimeState, cs *callSession, cause int, text string) {
+	st.mu.RLock()
+	active := st.calls[cs.callID] == cs
+	st.mu.RUnlock()
+	if !active {
+		return
+	}
+	logger.Printf("call hangup: call-id=%s ext=%s reason=%q", cs.callID, cs.extID, text)
+	if !cs.isAnswered() {
+		// Still in early media: there is no confirmed dialog to BYE, reject the INVITE instead.
+		if inv := cs.inv; inv != nil && st.finishPendingInvite(cs.callID, inv) {
+			sendSIPResponse(inv.conn, inv.addr, inv.req, inv.toWithTag, "", 480, "Temporarily Unavailable", map[string][]string{
+				"Reason": {q850Reason(cause, text)},
+			}, nil)
+		}
+	} else if cs.dlg != nil {
+		go func() {
+			resp, err := cs.dlg.sendBye(st, q850Reason(cause, text))
+			if err != nil {
+				logger.Printf("call hangup: BYE failed (call-id=%s): %v", cs.callID, err)
+				return
+			}
+			logger.Printf("call hangup: BYE answered %d %s (call-id=%s)", resp.status, resp.reason, cs.callID)
+		}()
+	}
+	endCall(logger, cs.callID, st, text)
+}
+
+func (cs *callSession) markRtp() {
+	cs.mu.Lock()
+	cs.lastRtpAt = time.Now()
+	cs.mu.Unlock()
+}
+
+// noteCallerAudio feeds decoded caller audio to the silence guard.
+func (cs *callSession) noteCallerAudio(pcm []int16) {
+	if cs.opts.maxSilence <= 0 || len(pcm) == 0 {
+		return
+	}
+	var sumSq float64
+	for _, s := range pcm {
+		v := float64(s)
+		sumSq += v * v
+	}
+	if math.Sqrt(sumSq/float64(len(pcm))) < silenceRMSThreshold {
+		return
+	}
+	cs.mu.Lock()
+	cs.lastVoiceAt = time.Now()
+	cs.mu.Unlock()
+}
+
+// setHold tracks hold state from re-INVITE SDP. Leaving hold restarts the RTP and silence clocks.
+func (cs *callSession) setHold(on bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if on {
+		if cs.holdSince.IsZero() {
+			cs.holdSince = time.Now()
+		}
+		return
+	}
+	if !cs.holdSince.IsZero() {
+		now := time.Now()
+		cs.holdSince = time.Time{}
+		cs.lastRtpAt = now
+		cs.lastVoiceAt = now
+	}
+}
+
+func (cs *callSession) isAnswered() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.answered
+}
+
+// markAnswered records the 200 OK; RTP and silence clocks start from here.
+func (cs *callSession) markAnswered() {
+	cs.mu.Lock()
+	now := time.Now()
+	cs.answered = true
+	cs.lastRtpAt = now
+	cs.lastVoiceAt = now
+	cs.mu.Unlock()
+}
+
+func (cs *callSession) hangupReason() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.endReason
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// In-band DTMF detection (Goertzel) on decoded 8 kHz caller audio, for gateways that only send
+// digits as tones. Blocks of 205 samples put every DTMF frequency close to a DFT bin.
+const (
+	goertzelBlock = 205
+
+	// Each tone must be at least ~-30 dBm0 (amplitude ~400) to count.
+	dtmfMinToneAmp = 400
+	// Twist limits (dB): row (low group) louder than column is "normal" twist.
+	dtmfMaxNormalTwist  = 8
+	dtmfMaxReverseTwist = 4
+	// The strongest tone in each group must beat the others in that group by this much (dB).
+	dtmfGroupMarginDB = 8
+	// Share of block energy that must be in the two tones; speech spreads its energy wider.
+	dtmfMinToneRatio = 0.6
+	// Consecutive blocks (25.6 ms each) to accept a digit / to end it.
+	dtmfOnBlocks  = 2
+	dtmfOffBlocks = 2
+)
+
+var (
+	dtmfRowFreqs = [4]float64{697, 770, 852, 941}
+	dtmfColFreqs = [4]float64{1209, 1336, 1477, 1633}
+	dtmfKeypad   = [4][4]byte{
+		{'1', '2', '3', 'A'},
+		{'4', '5', '6', 'B'},
+		{'7', '8', '9', 'C'},
+		{'*', '0', '#', 'D'},
+	}
+	dtmfRowCoeffs, dtmfColCoeffs = goertzelCoeffs(dtmfRowFreqs), goertzelCoeffs(dtmfColFreqs)
+)
+
+func goertzelCoeffs(freqs [4]float64) [4]float64 {
+	var out [4]float64
+	for i, f := range freqs {
+		out[i] = 2 * math.Cos(2*math.Pi*f/8000)
+	}
+	return out
+}
+
+// goertzelPower is |X(f)|^2 of block at the frequency given by coeff = 2cos(2πf/fs).
+func goertzelPower(block []float64, coeff float64) float64 {
+	var s1, s2 float64
+	for _, x := range block {
+		s0 := x + coeff*s1 - s2
+		s2 = s1
+		s1 = s0
+	}
+	return s1*s1 + s2*s2 - coeff*s1*s2
+}
+
+// inbandDtmfDetector finds DTMF digits in a stream of 8 kHz PCM frames.
+type inbandDtmfDetector struct {
+	block []float64
+
+	// Digit seen in the last block (0 = none) and how many blocks in a row.
+	last    byte
+	lastRun int
+
+	// Digit currently reported as pressed, and blocks without it since.
+	digit   byte
+	digitAt int // block count when it started
+	offRun  int
+	blocks  int
+}
+
+func newInbandDtmfDetector() *inbandDtmfDetector {
+	return &inbandDtmfDetector{block: make([]float64, 0, goertzelBlock)}
+}
+
+// toneActive reports whether the last block held a DTMF tone (used to mute it from the uplink).
+func (d *inbandDtmfDetector) toneActive() bool {
+	return d.last != 0 || d.digit != 0
+}
+
+// process feeds one frame and returns the digits that ended in it.
+func (d *inbandDtmfDetector) process(pcm []int16) []dtmfEvent {
+	var out []dtmfEvent
+	for _, s := range pcm {
+		d.block = append(d.block, float64(s))
+		if len(d.block) < goertzelBlock {
+			continue
+		}
+		if ev, ok := d.step(detectDtmfBlock(d.block)); ok {
+			out = append(out, ev)
+		}
+		d.block = d.block[:0]
+	}
+	return out
+}
+
+// step runs the duration state machine for one block's result.
+func (d *inbandDtmfDetector) step(hit byte) (dtmfEvent, bool) {
+	d.blocks++
+	if hit == d.last {
+		d.lastRun++
+	} else {
+		d.last = hit
+		d.lastRun = 1
+	}
+
+	if d.digit == 0 {
+		if hit != 0 && d.lastRun >= dtmfOnBlocks {
+			d.digit = hit
+			d.digitAt = d.blocks - d.lastRun
+			d.offRun = 0
+		}
+		return dtmfEvent{}, false
+	}
+	if hit == d.digit {
+		d.offRun = 0
+		return dtmfEvent{}, false
+	}
+	d.offRun++
+	if d.offRun < dtmfOffBlocks && hit == 0 {
+		// Short dropout inside one key press.
+		return dtmfEvent{}, false
+	}
+	blocks := d.blocks - d.offRun - d.digitAt
+	ev := dtmfEvent{
+		digit:    string(d.digit),
+		duration: time.Duration(blocks*goertzelBlock) * time.Second / 8000,
+		source:   "inband",
+	}
+	d.digit = 0
+	if hit != 0 && d.lastRun >= dtmfOnBlocks {
+		// Straight into another digit.
+		d.digit = hit
+		d.digitAt = d.blocks - d.lastRun
+		d.offRun = 0
+	}
+	return ev, true
+}
+
+// detectDtmfBlock returns the keypad digit in one block, or 0. It applies the energy, group
+// margin, twist and tone-to-total checks that keep speech and music from triggering it.
+func detectDtmfBlock(block []float64) byte {
+	var total float64
+	for _, x := range block {
+		total += x * x
+	}
+	n := float64(len(block))
+	// A sine of amplitude A gives Goertzel power (A*N/2)^2.
+	minPower := math.Pow(dtmfMinToneAmp*n/2, 2)
+	if total < n*dtmfMinToneAmp*dtmfMinToneAmp/2 {
+		return 0
+	}
+
+	best := func(coeffs [4]float64) (int, float64, bool) {
+		var p [4]float64
+		bi := 0
+		for i, c := range coeffs {
+			p[i] = goertzelPower(block, c)
+			if p[i] > p[bi] {
+				bi = i
+			}
+		}
+		margin := math.Pow(10, dtmfGroupMarginDB/10.0)
+		for i := range p {
+			if i != bi && p[i]*margin > p[bi] {
+				return 0, 0, false
+			}
+		}
+		return bi, p[bi], p[bi] >= minPower
+	}
+	row, rowP, ok := best(dtmfRowCoeffs)
+	if !ok {
+		return 0
+	}
+	col, colP, ok := best(dtmfColCoeffs)
+	if !ok {
+		return 0
+	}
+
+	if rowP > colP {
+		if rowP > colP*math.Pow(10, dtmfMaxNormalTwist/10.0) {
+			return 0
+		}
+	} else if colP > rowP*math.Pow(10, dtmfMaxReverseTwist/10.0) {
+		return 0
+	}
+	// Goertzel power*2/N is the tone's share of the block energy.
+	if (rowP+colP)*2/n < dtmfMinToneRatio*total {
+		return 0
+	}
+	return dtmfKeypad[row][col]
+}
+
+// detectInbandDtmf runs the in-band detector on one uplink frame and reports finished digits.
+// It returns true when the frame holds tone audio that should be muted from the AI.
+func (cs *callSession) detectInbandDtmf(logger *log.Logger, d *inbandDtmfDetector, pcm []int16) bool {
+	evs := d.process(pcm)
+	cs.mu.Lock()
+	// The gateway also signals digits out of band: don't report them twice.
+	signalled := time.Since(cs.dtmfRx.lastSeen) < 2*time.Second
+	cs.mu.Unlock()
+	for _, ev := range evs {
+		if !signalled && ev.duration >= dtmfMinDuration {
+			cs.deliverDtmf(logger, ev)
+		}
+	}
+	return cs.opts.inbandDtmfSuppress && d.toneActive()
+}
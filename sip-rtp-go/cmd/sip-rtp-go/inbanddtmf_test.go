@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// dtmfSignal is a row+column tone pair at 8 kHz with the given amplitudes.
+func dtmfSignal(row, col, rowAmp, colAmp float64, dur time.Duration) []float64 {
+	x := make([]float64, int(dur.Seconds()*8000))
+	for i := range x {
+		t := float64(i) / 8000
+		x[i] = rowAmp*math.Sin(2*math.Pi*row*t) + colAmp*math.Sin(2*math.Pi*col*t)
+	}
+	return x
+}
+
+// inbandDigits runs x, framed in 20 ms, and 200 ms of silence after it through a fresh detector.
+func inbandDigits(x []float64) []dtmfEvent {
+	pcm := make([]int16, len(x)+1600)
+	for i, v := range x {
+		pcm[i] = sat16f(v)
+	}
+	d := newInbandDtmfDetector()
+	var out []dtmfEvent
+	for i := 0; i < len(pcm); i += 160 {
+		out = append(out, d.process(pcm[i:min(i+160, len(pcm))])...)
+	}
+	return out
+}
+
+func inbandDigitString(evs []dtmfEvent) string {
+	var s string
+	for _, ev := range evs {
+		s += ev.digit
+	}
+	return s
+}
+
+func TestInbandDtmfDigits(t *testing.T) {
+	for r, row := range dtmfRowFreqs {
+		for c, col := range dtmfColFreqs {
+			digit := string(dtmfKeypad[r][c])
+			t.Run(digit, func(t *testing.T) {
+				evs := inbandDigits(dtmfSignal(row, col, 4000, 4000, 100*time.Millisecond))
+				if len(evs) != 1 || evs[0].digit != digit {
+					t.Fatalf("got %q, want %q", inbandDigitString(evs), digit)
+				}
+				// Durations come in whole blocks of 25.6 ms.
+				if d := evs[0].duration - 100*time.Millisecond; d < -30*time.Millisecond || d > 30*time.Millisecond {
+					t.Errorf("duration %s, want about 100ms", evs[0].duration)
+				}
+			})
+		}
+	}
+
+	t.Run("sequence", func(t *testing.T) {
+		var x []float64
+		for _, k := range []struct{ r, c int }{{0, 0}, {1, 1}, {1, 1}, {3, 2}} {
+			x = append(x, dtmfSignal(dtmfRowFreqs[k.r], dtmfColFreqs[k.c], 4000, 4000, 80*time.Millisecond)...)
+			x = append(x, make([]float64, 480)...) // 60 ms pause
+		}
+		if got := inbandDigitString(inbandDigits(x)); got != "155#" {
+			t.Errorf("got %q, want %q", got, "155#")
+		}
+	})
+}
+
+func TestInbandDtmfRejects(t *testing.T) {
+	db := func(v float64) float64 { return math.Pow(10, v/20) }
+	rng := rand.New(rand.NewSource(1))
+	noise := func(amp float64, dur time.Duration) []float64 {
+		x := make([]float64, int(dur.Seconds()*8000))
+		for i := range x {
+			x[i] = amp * rng.NormFloat64()
+		}
+		return x
+	}
+	// harmonics is a tone with n harmonics falling off 6 dB/octave, with vibrato, like a voiced
+	// vowel or an instrument note.
+	harmonics := func(f0, amp float64, n int, dur time.Duration) []float64 {
+		x := make([]float64, int(dur.Seconds()*8000))
+		for i := range x {
+			t := float64(i) / 8000
+			f := f0 * (1 + 0.01*math.Sin(2*math.Pi*5*t))
+			for h := 1; h <= n && float64(h)*f0 < 3800; h++ {
+				x[i] += amp / float64(h) * math.Sin(2*math.Pi*float64(h)*f*t)
+			}
+		}
+		return x
+	}
+	mix := func(xs ...[]float64) []float64 {
+		out := make([]float64, len(xs[0]))
+		for _, x := range xs {
+			for i := range out {
+				out[i] += x[i]
+			}
+		}
+		return out
+	}
+	const row, col = 770, 1336 // "5"
+	// twisted returns "5" with the row group louder than the column group by twist dB as the detector
+	// measures it (Goertzel bins sit a little off the tones, so that differs from the amplitude ratio).
+	twisted := func(twist float64) []float64 {
+		gain := func(f float64) float64 {
+			block := dtmfSignal(f, 0, 1, 0, 100*time.Millisecond)[:goertzelBlock]
+			return math.Sqrt(goertzelPower(block, 2*math.Cos(2*math.Pi*f/8000)))
+		}
+		rowAmp, colAmp := 4000*goertzelBlock/2/gain(row), 4000*goertzelBlock/2/gain(col)
+		if twist > 0 {
+			colAmp /= db(twist)
+		} else {
+			rowAmp /= db(-twist)
+		}
+		return dtmfSignal(row, col, rowAmp, colAmp, 100*time.Millisecond)
+	}
+	for _, tc := range []struct {
+		name string
+		x    []float64
+		want string
+	}{
+		// Twist: the row group may be up to 8 dB louder than the column group, the column group up to
+		// 4 dB louder than the row group.
+		{"normal twist 6dB", twisted(6), "5"},
+		{"normal twist at limit", twisted(dtmfMaxNormalTwist - 0.2), "5"},
+		{"normal twist beyond", twisted(dtmfMaxNormalTwist + 0.2), ""},
+		{"normal twist 12dB", twisted(12), ""},
+		{"reverse twist 2dB", twisted(-2), "5"},
+		{"reverse twist at limit", twisted(-dtmfMaxReverseTwist + 0.2), "5"},
+		{"reverse twist beyond", twisted(-dtmfMaxReverseTwist - 0.2), ""},
+		{"reverse twist 8dB", twisted(-8), ""},
+
+		// Two blocks of 25.6 ms must hold the tone.
+		{"30ms", dtmfSignal(row, col, 4000, 4000, 30*time.Millisecond), ""},
+		{"40ms", dtmfSignal(row, col, 4000, 4000, 40*time.Millisecond), ""},
+		{"70ms", dtmfSignal(row, col, 4000, 4000, 70*time.Millisecond), "5"},
+
+		{"too quiet", dtmfSignal(row, col, 250, 250, 100*time.Millisecond), ""},
+		{"in noise", mix(dtmfSignal(row, col, 4000, 4000, 100*time.Millisecond), noise(400, 100*time.Millisecond)), "5"},
+
+		// Talk-off: none of these may produce a digit.
+		{"single tone", dtmfSignal(row, col, 6000, 0, time.Second), ""},
+		{"noise", noise(6000, time.Second), ""},
+		{"vowel 120Hz", harmonics(120, 8000, 30, time.Second), ""},
+		{"vowel 210Hz", harmonics(210, 8000, 20, time.Second), ""},
+		{"vowel 350Hz", harmonics(350, 8000, 10, time.Second), ""},
+		{"chord", mix(harmonics(220, 3000, 10, time.Second), harmonics(277.2, 3000, 10, time.Second), harmonics(329.6, 3000, 10, time.Second)), ""},
+		{"interval on DTMF pitches", mix(harmonics(row, 4000, 4, time.Second), harmonics(col, 4000, 4, time.Second), noise(1500, time.Second)), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := inbandDigitString(inbandDigits(tc.x)); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// Speech-like: a vowel gliding through the range of voices, with a formant-like emphasis sweeping
+	// across the DTMF bands.
+	for _, f0 := range []float64{100, 140, 180, 240} {
+		t.Run(fmt.Sprintf("glide %.0fHz", f0), func(t *testing.T) {
+			x := make([]float64, 2*8000)
+			var phase float64
+			for i := range x {
+				tm := float64(i) / 8000
+				phase += 2 * math.Pi * f0 * (1 + 0.3*math.Sin(2*math.Pi*0.7*tm)) / 8000
+				formant := 600 + 900*(0.5+0.5*math.Sin(2*math.Pi*1.3*tm))
+				for h := 1; float64(h)*f0*1.3 < 3800; h++ {
+					f := float64(h) * f0
+					x[i] += 6000 / float64(h) * math.Exp(-math.Pow((f-formant)/300, 2)) * math.Sin(float64(h)*phase)
+				}
+			}
+			if evs := inbandDigits(x); len(evs) != 0 {
+				t.Errorf("got %q, want none", inbandDigitString(evs))
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Uplink jitter buffer: caller RTP is put back in sequence order and played out at a steady pace
+// behind an adaptive delay (3x the RFC 3550 interarrival jitter, within the agent's min/max).
+// Missing packets come out as losses for concealment (plc.go); late and duplicate packets are
+// dropped; an SSRC change or a large sequence jump starts over.
+const (
+	defaultJitterMin = 20 * time.Millisecond
+	defaultJitterMax = 200 * time.Millisecond
+	defaultFrameDur  = 20 * time.Millisecond
+	// Frames concealed on an empty buffer before playout stops and re-buffers (PLC is muted by then).
+	maxUnderrunFrames = 3
+	// A sequence jump this large is a new stream (e.g. the peer restarted), not a loss.
+	maxSeqJump = 100
+)
+
+type jbResult int
+
+const (
+	jbWait   jbResult = iota // buffering or nothing due yet
+	jbPacket                 // the next packet in order
+	jbLost                   // the next packet is missing: conceal one frame
+)
+
+type jitterStats struct {
+	received, lost, late, duplicate, discarded, concealed, underruns, resets uint64
+
+	jitter, depth, target time.Duration
+}
+
+func (s jitterStats) String() string {
+	loss := 0.0
+	if total := s.received + s.lost; total > 0 {
+		loss = 100 * float64(s.lost) / float64(total)
+	}
+	return fmt.Sprintf("received=%d lost=%d (%.1f%%) late=%d dup=%d discarded=%d concealed=%d underruns=%d resets=%d jitter=%s depth=%s target=%s",
+		s.received, s.lost, loss, s.late, s.duplicate, s.discarded, s.concealed, s.underruns, s.resets,
+		s.jitter.Round(100*time.Microsecond), s.depth, s.target)
+}
+
+type jitterBuffer struct {
+	mu       sync.Mutex
+	min, max time.Duration
+
+	pkts     map[uint32]*rtp.Packet // by extended sequence number
+	ssrc     uint32
+	started  bool
+	highest  uint32 // extended sequence number of the newest packet
+	next     uint32 // next extended sequence number to play
+	playing  bool
+	underrun int
+	frame    time.Duration // duration of one packet
+
+	// RFC 3550 §6.4.1 interarrival jitter, in seconds.
+	jitter      float64
+	lastArrival time.Time
+	lastTS      uint32
+
+	stats jitterStats
+}
+
+func newJitterBuffer(minDelay, maxDelay time.Duration) *jitterBuffer {
+	if minDelay <= 0 {
+		minDelay = defaultJitterMin
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultJitterMax
+	}
+	if maxDelay < minDelay {
+		maxDelay = minDelay
+	}
+	return &jitterBuffer{
+		min:   minDelay,
+		max:   maxDelay,
+		pkts:  map[uint32]*rtp.Packet{},
+		frame: defaultFrameDur,
+	}
+}
+
+// restart drops everything buffered; the next packet starts a new stream.
+func (jb *jitterBuffer) restart() {
+	clear(jb.pkts)
+	jb.started = false
+	jb.playing = false
+	jb.underrun = 0
+	jb.lastArrival = time.Time{}
+	jb.stats.resets++
+}
+
+// push adds a received packet; clock is its RTP clock rate.
+func (jb *jitterBuffer) push(p *rtp.Packet, clock int, now time.Time) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	jb.pushLocked(p, clock, now)
+}
+
+func (jb *jitterBuffer) pushLocked(p *rtp.Packet, clock int, now time.Time) {
+	if jb.started && p.SSRC != jb.ssrc {
+		jb.restart()
+	}
+	var ext uint32
+	if !jb.started {
+		// Start high so sequence numbers before the first packet don't underflow.
+		ext = 1<<16 | uint32(p.SequenceNumber)
+		jb.started = true
+		jb.ssrc = p.SSRC
+		jb.highest = ext
+		jb.next = ext
+	} else {
+		delta := int32(int16(p.SequenceNumber - uint16(jb.highest)))
+		if delta > maxSeqJump || delta < -maxSeqJump {
+			jb.restart()
+			jb.pushLocked(p, clock, now)
+			return
+		}
+		ext = uint32(int32(jb.highest) + delta)
+	}
+
+	switch {
+	case ext < jb.next && jb.playing:
+		jb.stats.late++
+		return
+	case jb.pkts[ext] != nil:
+		jb.stats.duplicate++
+		return
+	case ext < jb.next:
+		// Re-buffering after a pause: play from the oldest packet we have.
+		jb.next = ext
+	}
+
+	cp := *p
+	cp.Payload = append([]byte(nil), p.Payload...)
+	jb.pkts[ext] = &cp
+	jb.stats.received++
+
+	if ext > jb.highest {
+		if ext == jb.highest+1 && clock > 0 {
+			if prev := jb.pkts[jb.highest]; prev != nil {
+				if d := time.Duration(p.Timestamp-prev.Timestamp) * time.Second / time.Duration(clock); d >= 5*time.Millisecond && d <= 120*time.Millisecond {
+					jb.frame = d
+				}
+			}
+		}
+		jb.highest = ext
+	}
+
+	if clock > 0 {
+		if !jb.lastArrival.IsZero() {
+			// A timestamp jump (talkspurt after silence suppression gone wrong, a new source) says
+			// nothing about network jitter.
+			if d := now.Sub(jb.lastArrival).Seconds() - float64(int32(p.Timestamp-jb.lastTS))/float64(clock); math.Abs(d) < 1 {
+				jb.jitter += (math.Abs(d) - jb.jitter) / 16
+			}
+		}
+		jb.lastArrival, jb.lastTS = now, p.Timestamp
+	}
+}
+
+func (jb *jitterBuffer) targetLocked() time.Duration {
+	t := time.Duration(3 * jb.jitter * float64(time.Second))
+	if t < jb.min {
+		t = jb.min
+	}
+	if t < jb.frame {
+		t = jb.frame
+	}
+	if t > jb.max {
+		t = jb.max
+	}
+	return t
+}
+
+func (jb *jitterBuffer) depthLocked() time.Duration {
+	if !jb.started || jb.highest < jb.next {
+		return 0
+	}
+	return time.Duration(jb.highest-jb.next+1) * jb.frame
+}
+
+// pop returns what to play next.
+func (jb *jitterBuffer) pop() (*rtp.Packet, jbResult) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	if !jb.started {
+		return nil, jbWait
+	}
+	target := jb.targetLocked()
+	if !jb.playing {
+		if len(jb.pkts) == 0 {
+			return nil, jbWait
+		}
+		// Start from the oldest packet we have (after an underrun, next may point into the gap).
+		oldest := jb.highest
+		for ext := range jb.pkts {
+			oldest = min(oldest, ext)
+		}
+		jb.next = oldest
+		if jb.depthLocked() < target {
+			return nil, jbWait
+		}
+		jb.playing = true
+		jb.underrun = 0
+	}
+
+	// Too far behind (the jitter went down, or a burst arrived): drop a frame to catch up.
+	if jb.depthLocked() > target+2*jb.frame {
+		if jb.pkts[jb.next] != nil {
+			delete(jb.pkts, jb.next)
+			jb.stats.discarded++
+		}
+		jb.next++
+	}
+
+	if p := jb.pkts[jb.next]; p != nil {
+		delete(jb.pkts, jb.next)
+		jb.next++
+		jb.underrun = 0
+		return p, jbPacket
+	}
+	if jb.next <= jb.highest {
+		// Later packets are here, this one is not: lost (or later than we wait).
+		jb.next++
+		jb.stats.lost++
+		jb.stats.concealed++
+		return nil, jbLost
+	}
+
+	// Nothing buffered: conceal a little, then stop and re-buffer.
+	if jb.underrun == 0 {
+		jb.stats.underruns++
+	}
+	jb.underrun++
+	if jb.underrun > maxUnderrunFrames {
+		jb.playing = false
+		return nil, jbWait
+	}
+	jb.next++
+	jb.stats.concealed++
+	return nil, jbLost
+}
+
+// frameDur is the duration of one packet, as seen from the timestamps.
+func (jb *jitterBuffer) frameDur() time.Duration {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	return jb.frame
+}
+
+func (jb *jitterBuffer) snapshot() jitterStats {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	s := jb.stats
+	s.jitter = time.Duration(jb.jitter * float64(time.Second))
+	s.depth = jb.depthLocked()
+	s.target = jb.targetLocked()
+	return s
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// jbPkt is a 20 ms G.711 packet: the sequence number doubles as payload so the order can be checked.
+func jbPkt(seq uint16, ssrc uint32) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{PayloadType: codecPCMU.pt, SequenceNumber: seq, Timestamp: uint32(seq) * 160, SSRC: ssrc},
+		Payload: []byte{byte(seq >> 8), byte(seq)},
+	}
+}
+
+// jbPushAll pushes packets 20 ms apart, in the order given.
+func jbPushAll(jb *jitterBuffer, pkts ...*rtp.Packet) {
+	now := time.Now()
+	for i, p := range pkts {
+		jb.push(p, 8000, now.Add(time.Duration(i)*defaultFrameDur))
+	}
+}
+
+// jbPopSeqs pops n times; lost packets show up as -1, nothing due as -2.
+func jbPopSeqs(jb *jitterBuffer, n int) []int {
+	var out []int
+	for i := 0; i < n; i++ {
+		p, res := jb.pop()
+		switch res {
+		case jbPacket:
+			out = append(out, int(p.SequenceNumber))
+		case jbLost:
+			out = append(out, -1)
+		default:
+			out = append(out, -2)
+		}
+	}
+	return out
+}
+
+func TestJitterBufferReorder(t *testing.T) {
+	jb := newJitterBuffer(100*time.Millisecond, 200*time.Millisecond)
+	jbPushAll(jb, jbPkt(10, 1), jbPkt(12, 1), jbPkt(11, 1), jbPkt(14, 1), jbPkt(13, 1))
+	if got, want := jbPopSeqs(jb, 5), []int{10, 11, 12, 13, 14}; !slices.Equal(got, want) {
+		t.Errorf("played %v, want %v", got, want)
+	}
+	if s := jb.snapshot(); s.lost != 0 || s.late != 0 || s.received != 5 {
+		t.Errorf("stats %s, want 5 received, none lost or late", s)
+	}
+
+	// A packet for a slot already played is late, a repeated one a duplicate.
+	jbPushAll(jb, jbPkt(12, 1), jbPkt(15, 1), jbPkt(15, 1))
+	if s := jb.snapshot(); s.late != 1 || s.duplicate != 1 {
+		t.Errorf("stats %s, want 1 late and 1 duplicate", s)
+	}
+}
+
+func TestJitterBufferWraparound(t *testing.T) {
+	jb := newJitterBuffer(100*time.Millisecond, 200*time.Millisecond)
+	jbPushAll(jb, jbPkt(65533, 1), jbPkt(65534, 1), jbPkt(0, 1), jbPkt(65535, 1), jbPkt(1, 1))
+	if got, want := jbPopSeqs(jb, 5), []int{65533, 65534, 65535, 0, 1}; !slices.Equal(got, want) {
+		t.Errorf("played %v, want %v", got, want)
+	}
+	if s := jb.snapshot(); s.resets != 0 || s.lost != 0 {
+		t.Errorf("stats %s, want no reset and no loss across the wrap", s)
+	}
+}
+
+func TestJitterBufferSSRCReset(t *testing.T) {
+	jb := newJitterBuffer(40*time.Millisecond, 200*time.Millisecond)
+	jbPushAll(jb, jbPkt(100, 1), jbPkt(101, 1))
+	if got, want := jbPopSeqs(jb, 2), []int{100, 101}; !slices.Equal(got, want) {
+		t.Fatalf("played %v, want %v", got, want)
+	}
+
+	// The peer restarted: new SSRC, sequence numbers from somewhere else. Nothing of the old stream is
+	// waited for, and the new one buffers up from scratch.
+	jbPushAll(jb, jbPkt(102, 1), jbPkt(7000, 2), jbPkt(7001, 2))
+	if got, want := jbPopSeqs(jb, 2), []int{7000, 7001}; !slices.Equal(got, want) {
+		t.Errorf("played %v, want %v", got, want)
+	}
+	if s := jb.snapshot(); s.resets != 1 || s.lost != 0 {
+		t.Errorf("stats %s, want 1 reset and no loss", s)
+	}
+}
+
+// Lost packets come out as losses in their slot; PLC fills them with the last pitch period,
+// attenuated as the gap goes on and muted after 60 ms.
+func TestJitterBufferLossConcealment(t *testing.T) {
+	const rate, frame = 8000, 160
+	tone := func(seq uint16) []int16 {
+		pcm := make([]int16, frame)
+		for i := range pcm {
+			pcm[i] = int16(8000 * math.Sin(2*math.Pi*200*float64(int(seq)*frame+i)/rate))
+		}
+		return pcm
+	}
+
+	jb := newJitterBuffer(100*time.Millisecond, 200*time.Millisecond)
+	plc := newPLC(rate)
+	lost := map[uint16]bool{10: true, 11: true, 12: true, 13: true, 14: true}
+	now := time.Now()
+	var played []int
+	var levels []float64 // per concealed frame
+	for seq := uint16(0); seq < 30; seq++ {
+		if !lost[seq] {
+			jb.push(jbPkt(seq, 1), rate, now.Add(time.Duration(seq)*defaultFrameDur))
+		}
+		p, res := jb.pop()
+		switch res {
+		case jbPacket:
+			played = append(played, int(p.SequenceNumber))
+			plc.good(tone(p.SequenceNumber))
+		case jbLost:
+			played = append(played, -1)
+			levels = append(levels, levelDBFS(plc.conceal(frame)))
+		}
+	}
+
+	// After buffering, everything in order with the gap in place.
+	var want []int
+	for seq := 0; seq <= played[len(played)-1]; seq++ {
+		if lost[uint16(seq)] {
+			want = append(want, -1)
+		} else {
+			want = append(want, seq)
+		}
+	}
+	if !slices.Equal(played, want) {
+		t.Errorf("played %v, want %v", played, want)
+	}
+	// The end of the gap may be an underrun rather than a loss (nothing later buffered yet).
+	if s := jb.snapshot(); s.concealed != uint64(len(lost)) {
+		t.Errorf("stats %s, want %d concealed", s, len(lost))
+	}
+
+	toneDB := levelDBFS(tone(0))
+	if len(levels) != len(lost) {
+		t.Fatalf("%d frames concealed, want %d", len(levels), len(lost))
+	}
+	if d := toneDB - levels[0]; d > 3 {
+		t.Errorf("first concealed frame %.1f dB below the signal, want within 3 dB", d)
+	}
+	for i := 1; i < len(levels); i++ {
+		if levels[i] > levels[i-1]-0.5 && levels[i-1] > -90 {
+			t.Errorf("concealed frame %d at %.1f dBFS, not below frame %d (%.1f dBFS)", i, levels[i], i-1, levels[i-1])
+		}
+	}
+	if levels[len(levels)-1] > -90 {
+		t.Errorf("concealment after %d ms at %.1f dBFS, want muted", len(levels)*20, levels[len(levels)-1])
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetryAfter   = 10 * time.Second
+	defaultQueueMaxWait = 60 * time.Second
+	defaultQueueMaxSize = 10
+)
+
+// Played to queued callers when the agent has no queueHoldAudio configured.
+var defaultHoldTone = toneCadence{freqs: []float64{440}, pattern: []int{300, 3700}}
+
+// callLimiter counts calls holding a media session (one WS backend session each), per agent and globally,
+// and hands freed slots to queued callers in FIFO order.
+type callLimiter struct {
+	mu       sync.Mutex
+	global   int // 0 = unlimited
+	active   int
+	perAgent map[string]int
+	waiters  []*slotWaiter
+}
+
+type slotWaiter struct {
+	l     *callLimiter
+	agent string
+	limit int
+	slot  chan *callSlot
+}
+
+// callSlot is one acquired slot; release is idempotent.
+type callSlot struct {
+	l     *callLimiter
+	agent string
+	once  sync.Once
+}
+
+func newCallLimiter() *callLimiter {
+	return &callLimiter{perAgent: map[string]int{}}
+}
+
+func (l *callLimiter) setGlobal(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.global = max(0, n)
+	l.wakeLocked()
+}
+
+// blockedBy reports which limit (if any) blocks a new call for agent; caller holds l.mu.
+func (l *callLimiter) blockedBy(agent string, limit int) string {
+	if limit > 0 && l.perAgent[agent] >= limit {
+		return "agent"
+	}
+	if l.global > 0 && l.active >= l.global {
+		return "global"
+	}
+	return ""
+}
+
+func (l *callLimiter) take(agent string) *callSlot {
+	l.active++
+	l.perAgent[agent]++
+	return &callSlot{l: l, agent: agent}
+}
+
+// tryAcquire takes a slot, or returns nil and the limit that was hit ("agent" or "global").
+func (l *callLimiter) tryAcquire(agent string, limit int) (*callSlot, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if why := l.blockedBy(agent, limit); why != "" {
+		return nil, why
+	}
+	return l.take(agent), ""
+}
+
+// enqueue puts a call in the queue for a slot, or returns nil when the agent already has maxSize
+// calls waiting. A slot freed from here on is kept for it until wait or leave.
+func (l *callLimiter) enqueue(agent string, limit, maxSize int) *slotWaiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, w := range l.waiters {
+		if w.agent == agent {
+			n++
+		}
+	}
+	if n >= maxSize {
+		return nil
+	}
+	w := &slotWaiter{l: l, agent: agent, limit: limit, slot: make(chan *callSlot, 1)}
+	l.waiters = append(l.waiters, w)
+	l.wakeLocked()
+	return w
+}
+
+// wait waits for the queued call's slot until one frees up, cancel fires, or timeout passes; it
+// leaves the queue in the latter two cases.
+func (w *slotWaiter) wait(cancel <-chan struct{}, timeout time.Duration) *callSlot {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s := <-w.slot:
+		return s
+	case <-cancel:
+	case <-t.C:
+	}
+	w.leave()
+	return nil
+}
+
+// leave takes the call out of the queue, giving back a slot granted meanwhile; nil-safe and idempotent.
+func (w *slotWaiter) leave() {
+	if w == nil {
+		return
+	}
+	w.l.mu.Lock()
+	for i, x := range w.l.waiters {
+		if x == w {
+			w.l.waiters = append(w.l.waiters[:i], w.l.waiters[i+1:]...)
+			break
+		}
+	}
+	w.l.mu.Unlock()
+	// A slot may have been granted before the removal above.
+	select {
+	case s := <-w.slot:
+		s.release()
+	default:
+	}
+}
+
+// wakeLocked grants free slots to waiters, oldest first (a waiter blocked by its own agent limit doesn't
+// block others). Caller holds l.mu, so a new call can't take a freed slot before the queue sees it.
+func (l *callLimiter) wakeLocked() {
+	kept := l.waiters[:0]
+	for _, w := range l.waiters {
+		if l.blockedBy(w.agent, w.limit) == "" {
+			w.slot <- l.take(w.agent)
+			continue
+		}
+		kept = append(kept, w)
+	}
+	l.waiters = kept
+}
+
+func (s *callSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.l.mu.Lock()
+		s.l.active--
+		s.l.perAgent[s.agent]--
+		if s.l.perAgent[s.agent] <= 0 {
+			delete(s.l.perAgent, s.agent)
+		}
+		s.l.wakeLocked()
+		s.l.mu.Unlock()
+	})
+}
+
+func (cs *callSession) setSlot(s *callSlot) {
+	cs.mu.Lock()
+	cs.slot = s
+	cs.mu.Unlock()
+}
+
+func (cs *callSession) releaseSlot() {
+	cs.mu.Lock()
+	s, w := cs.slot, cs.waiter
+	cs.slot, cs.waiter = nil, nil
+	cs.mu.Unlock()
+	w.leave()
+	s.release()
+}
+
+// runQueuedCall keeps an answered caller on hold audio until a slot frees up, then starts the AI/echo session.
+// On timeout the call is hung up.
+func runQueuedCall(logger *log.Logger, st *runtimeState, cs *callSession, startMedia func()) {
+	o := cs.opts
+	maxWait := o.queueMaxWait
+	if maxWait <= 0 {
+		maxWait = defaultQueueMaxWait
+	}
+
+	var hold []int16
+	if o.queueHoldAudio != "" {
+		pcm, err := loadPromptPcm8k(o.queueHoldAudio)
+		if err != nil {
+			logger.Printf("queue: hold audio %q: %v", o.queueHoldAudio, err)
+		} else {
+			hold = pcm
+		}
+	}
+
+	stopHold := make(chan struct{})
+	var wg sync.WaitGroup
+	sender := newPromptSender(logger, cs)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sender.drainRtp(stopHold)
+	}()
+	go func() {
+		defer wg.Done()
+		if len(hold) == 0 {
+			sender.playTone(defaultHoldTone, stopHold)
+			return
+		}
+		for sender.playPcm(hold, stopHold) {
+		}
+	}()
+
+	logger.Printf("queue: call-id=%s ext=%s waiting for a slot (max %s)", cs.callID, cs.extID, maxWait)
+	start := time.Now()
+	cs.mu.Lock()
+	w := cs.waiter
+	cs.mu.Unlock()
+	slot := w.wait(cs.stopCh, maxWait)
+	close(stopHold)
+	wg.Wait()
+	if slot == nil {
+		select {
+		case <-cs.stopCh:
+			logger.Printf("queue: call-id=%s left the queue after %s", cs.callID, time.Since(start).Round(time.Second))
+		default:
+			hangupCall(logger, st, cs, q850NormalClearing, "queue timeout")
+		}
+		return
+	}
+	cs.setSlot(slot)
+	select {
+	case <-cs.stopCh:
+		// Hung up right as the slot arrived.
+		cs.releaseSlot()
+		return
+	default:
+	}
+	logger.Printf("queue: call-id=%s connected after %s", cs.callID, time.Since(start).Round(time.Second))
+	startMedia()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A freed slot goes to the oldest waiter before any new call can take it.
+func TestLimiterReleaseHandsOffToQueue(t *testing.T) {
+	l := newCallLimiter()
+	l.setGlobal(1)
+	held, _ := l.tryAcquire("100", 0)
+	if held == nil {
+		t.Fatal("first call got no slot")
+	}
+
+	w := l.enqueue("100", 0, 10)
+	if w == nil {
+		t.Fatal("queue refused the waiter")
+	}
+	got := make(chan *callSlot, 1)
+	go func() { got <- w.wait(nil, time.Second) }()
+
+	held.release()
+	if s, why := l.tryAcquire("100", 0); s != nil {
+		t.Fatal("a new call took the slot released to the queue")
+	} else if why != "global" {
+		t.Errorf("new call blocked by %q, want global", why)
+	}
+	if s := <-got; s == nil {
+		t.Fatal("waiter got no slot")
+	}
+}
+
+// The queue size is checked when the call is queued, so concurrent INVITEs can't overshoot it.
+func TestLimiterQueueMaxSize(t *testing.T) {
+	l := newCallLimiter()
+	l.setGlobal(1)
+	held, _ := l.tryAcquire("100", 0)
+
+	var ws []*slotWaiter
+	for i := 0; i < 3; i++ {
+		ws = append(ws, l.enqueue("100", 0, 2))
+	}
+	if ws[0] == nil || ws[1] == nil {
+		t.Fatal("queue refused a waiter below its size")
+	}
+	if ws[2] != nil {
+		t.Fatal("queue took a waiter beyond its size")
+	}
+	if l.enqueue("200", 0, 2) == nil {
+		t.Error("another agent's queue is full too")
+	}
+
+	ws[0].leave()
+	if l.enqueue("100", 0, 2) == nil {
+		t.Error("no place in the queue after a waiter left")
+	}
+	held.release()
+	if s := ws[1].wait(nil, time.Second); s == nil {
+		t.Error("oldest remaining waiter got no slot")
+	}
+}
@@ -22,6 +22,8 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/pion/rtp"
+
+	"sip-rtp-go/internal/resample"
 )
 
 type cfg struct {
@@ -93,6 +95,8 @@ type sipAiDefaultsV2 struct {
 	SipListenAddr   string `json:"sipListenAddr"`
 	SipPass         string `json:"sipPass"`
 	RegisterExpires int    `json:"registerExpires"`
+	// Global cap on concurrent calls across all agents (0 = unlimited); over it callers get 503.
+	MaxConcurrentCalls int `json:"maxConcurrentCalls"`
 }
 
 type sipAiAgentV2 struct {
@@ -105,6 +109,122 @@ type sipAiAgentV2 struct {
 	SipDomain       string `json:"sipDomain"`
 	GeminiSocketURL string `json:"geminiSocketUrl"`
 	Enabled         *bool  `json:"enabled"`
+
+	// Call guards (seconds). rtpTimeoutSec: 0 = default (60s), <0 = disabled.
+	// holdTimeoutSec / maxCallDurationSec / maxSilenceSec: 0 = disabled.
+	RtpTimeoutSec      int `json:"rtpTimeoutSec"`
+	HoldTimeoutSec     int `json:"holdTimeoutSec"`
+	MaxCallDurationSec int `json:"maxCallDurationSec"`
+	MaxSilenceSec      int `json:"maxSilenceSec"`
+
+	// Session timers (RFC 4028). sessionExpiresSec: interval we insert when the caller didn't ask
+	// for one (0 = only when asked). minSessionExpiresSec: our Min-SE (default/minimum 90).
+	// sessionRefresher: "uac" | "uas" when the caller leaves the choice to us (default "uac").
+	SessionExpiresSec    int    `json:"sessionExpiresSec"`
+	MinSessionExpiresSec int    `json:"minSessionExpiresSec"`
+	SessionRefresher     string `json:"sessionRefresher"`
+
+	// Reliable provisionals (RFC 3262): "auto" (default) uses 100rel when the caller supports it,
+	// "off" only when the caller requires it.
+	ReliableProvisionals string `json:"reliableProvisionals"`
+
+	// Answer mode: "immediate" (default) | "early" | "earlyOnly". answerDelayMs delays the 200 OK
+	// (with generated ringback: ringbackTone "us" (default) | "eu" | "uk" | "none").
+	// earlyMediaPrompt is a mono PCM16 WAV played in early media; earlyMediaMaxSec bounds earlyOnly calls.
+	AnswerMode       string `json:"answerMode"`
+	AnswerDelayMs    int    `json:"answerDelayMs"`
+	RingbackTone     string `json:"ringbackTone"`
+	EarlyMediaPrompt string `json:"earlyMediaPrompt"`
+	EarlyMediaMaxSec int    `json:"earlyMediaMaxSec"`
+
+	// Concurrency: maxConcurrentCalls (0 = unlimited) per agent; over it callers get 486 (503 for the
+	// global limit) with Retry-After: retryAfterSec. overflowMode "queue" answers and plays queueHoldAudio
+	// (or a hold tone) until a slot frees up, for at most queueMaxWaitSec, with up to queueMaxSize waiting.
+	MaxConcurrentCalls int    `json:"maxConcurrentCalls"`
+	RetryAfterSec      int    `json:"retryAfterSec"`
+	OverflowMode       string `json:"overflowMode"`
+	QueueMaxWaitSec    int    `json:"queueMaxWaitSec"`
+	QueueMaxSize       int    `json:"queueMaxSize"`
+	QueueHoldAudio     string `json:"queueHoldAudio"`
+
+	// In-band DTMF: detect digits sent as tones in the caller audio (AI mode); inbandDtmfSuppress
+	// mutes the tones from what the backend hears.
+	InbandDtmf         bool `json:"inbandDtmf"`
+	InbandDtmfSuppress bool `json:"inbandDtmfSuppress"`
+	// How backend sendDtmf digits go out: "auto" (default) | "rfc4733" | "info" | "inband".
+	DtmfSendMode string `json:"dtmfSendMode"`
+
+	// Codecs to prefer, best first (e.g. ["opus","G722"]); the others follow in the default order.
+	// opusFec/opusDtx turn on Opus in-band FEC and DTX, asked of the caller in our fmtp and used by our encoder.
+	PreferredCodecs []string `json:"preferredCodecs"`
+	OpusFec         bool     `json:"opusFec"`
+	OpusDtx         bool     `json:"opusDtx"`
+
+	// Uplink jitter buffer delay bounds (defaults 20 / 200 ms); it adapts between them to 3x the jitter.
+	JitterMinMs int `json:"jitterMinMs"`
+	JitterMaxMs int `json:"jitterMaxMs"`
+
+	// Barge-in: caller speech during AI playback flushes it and tells the backend. bargeInSensitivity
+	// "low" | "medium" (default) | "high"; bargeInHangoverMs: silence that ends the caller's turn (default 200).
+	BargeIn            bool   `json:"bargeIn"`
+	BargeInSensitivity string `json:"bargeInSensitivity"`
+	BargeInHangoverMs  int    `json:"bargeInHangoverMs"`
+
+	// Speech events for backends without endpointing: vadMode "off" (default) | "events" (speechStarted/
+	// speechEnded) | "gate" (events, and only speech plus vadPaddingMs (default 300) either side is
+	// streamed). vadSensitivity as for barge-in; vadHangoverMs: silence that ends speech (default 500).
+	VadMode        string `json:"vadMode"`
+	VadSensitivity string `json:"vadSensitivity"`
+	VadHangoverMs  int    `json:"vadHangoverMs"`
+	VadPaddingMs   int    `json:"vadPaddingMs"`
+
+	// Acoustic echo cancellation of the AI's own voice in the caller audio (speakerphones); echoTailMs
+	// must cover the round trip plus the echo (default 200, at most 500).
+	EchoCancel bool `json:"echoCancel"`
+	EchoTailMs int  `json:"echoTailMs"`
+
+	// Audio clean-up presets for caller audio (dspUplink) and AI audio (dspDownlink): "off" (default) |
+	// "light" | "standard" | "noisy" | "level".
+	DspUplink   string `json:"dspUplink"`
+	DspDownlink string `json:"dspDownlink"`
+
+	// Comfort noise while the AI is silent: "auto" (default: RFC 3389 SID packets when the caller
+	// accepted CN, else generated noise) | "generate" | "off" (digital silence, CN not offered).
+	ComfortNoise string `json:"comfortNoise"`
+
+	// Call recording (AI mode): record "off" (default) | "stereo" (caller left, AI right) | "mono" (two
+	// files) into recordDir (default "recordings") as recordFileName (default
+	// "{date}/{callId}_{ext}_{time}"); recordRetentionDays: delete older recordings (0 = keep).
+	Record              string `json:"record"`
+	RecordDir           string `json:"recordDir"`
+	RecordFileName      string `json:"recordFileName"`
+	RecordRetentionDays int    `json:"recordRetentionDays"`
+
+	// Transcripts (AI mode): transcript "off" (default) | "text" (final caller/AI transcript lines) |
+	// "all" (plus every other non-audio backend message) as JSONL in transcriptDir (default
+	// "transcripts"), named by recordFileName.
+	Transcript    string `json:"transcript"`
+	TranscriptDir string `json:"transcriptDir"`
+
+	// Backend WebSocket (AI mode): pinged every wsKeepaliveSec (default 5), dead after 3 intervals
+	// without a message or pong. A lost connection is redialed for up to wsReconnectSec (default 30,
+	// -1 = fall back at once) while the caller hears wsOutageAudio (WAV; default the hold tone).
+	WsKeepaliveSec int    `json:"wsKeepaliveSec"`
+	WsReconnectSec int    `json:"wsReconnectSec"`
+	WsOutageAudio  string `json:"wsOutageAudio"`
+
+	// AI backend failure (dial failed, or gone mid-call): fallback "hold" (default: beeps until the
+	// caller hangs up, or for up to fallbackHoldMaxSec) | "hangup" | "transfer" (REFER to
+	// fallbackTransferTo) | "echo". fallbackPrompt: WAV played first (not for echo).
+	Fallback           string `json:"fallback"`
+	FallbackPrompt     string `json:"fallbackPrompt"`
+	FallbackTransferTo string `json:"fallbackTransferTo"`
+	FallbackHoldMaxSec int    `json:"fallbackHoldMaxSec"`
+
+	// Pager mode (SIP MESSAGE): texts go to messageSocketUrl (default: geminiSocketUrl) as a text-only
+	// session per sender, closed after messageIdleTimeoutSec without traffic (default 300).
+	MessageSocketURL      string `json:"messageSocketUrl"`
+	MessageIdleTimeoutSec int    `json:"messageIdleTimeoutSec"`
 }
 
 type sipAiConfigV2 struct {
@@ -376,6 +496,18 @@ type runtimeState struct {
 
 	// per SIP user routing
 	agentByUser map[string]agentRuntime
+
+	// initial INVITEs not answered yet (PRACK/CANCEL matching), by Call-ID
+	pendingInvites map[string]*uasInvite
+
+	// per-agent / global concurrency slots and the caller queue
+	limiter *callLimiter
+
+	// our own outgoing in-dialog requests, by Via branch
+	clientTx map[string]chan sipMsg
+
+	// pager-mode (MESSAGE) conversations, by extension|sender URI
+	pagers map[string]*pagerSession
 }
 
 type agentRuntime struct {
@@ -389,6 +521,202 @@ type agentRuntime struct {
 	sipPass         string
 	registerExpires int
 	// shared defaults (global)
+
+	opts callOptions
+}
+
+// callOptions are the per-agent settings copied into every call answered for that agent.
+type callOptions struct {
+	rtpTimeout  time.Duration
+	holdTimeout time.Duration
+	maxDuration time.Duration
+	maxSilence  time.Duration
+
+	sessionExpires    int
+	minSessionExpires int
+	sessionRefresher  string
+
+	reliableProvisionals string
+
+	answerMode       string
+	answerDelay      time.Duration
+	ringbackTone     string
+	earlyMediaPrompt string
+	earlyMediaMax    time.Duration
+
+	maxConcurrent  int
+	retryAfter     time.Duration
+	queue          bool
+	queueMaxWait   time.Duration
+	queueMaxSize   int
+	queueHoldAudio string
+
+	inbandDtmf         bool
+	inbandDtmfSuppress bool
+	dtmfSendMode       string
+
+	preferredCodecs []string
+	opusFec         bool
+	opusDtx         bool
+
+	jitterMin time.Duration
+	jitterMax time.Duration
+
+	bargeIn            bool
+	bargeInSensitivity string
+	bargeInHangover    time.Duration
+
+	vadMode        string
+	vadSensitivity string
+	vadHangover    time.Duration
+	vadPadding     time.Duration
+
+	echoCancel bool
+	echoTail   time.Duration
+
+	dspUplink   string
+	dspDownlink string
+
+	comfortNoise string
+
+	record              string
+	recordDir           string
+	recordFileName      string
+	recordRetentionDays int
+
+	transcript    string
+	transcriptDir string
+
+	wsKeepalive       time.Duration
+	wsReconnectBudget time.Duration // < 0: no reconnect
+	wsOutageAudio     string
+
+	fallback           string
+	fallbackPrompt     string
+	fallbackTransferTo string
+	fallbackHoldMax    time.Duration
+
+	messageSocketURL   string
+	messageIdleTimeout time.Duration
+}
+
+func agentCallOptions(a sipAiAgentV2) callOptions {
+	sec := func(n int) time.Duration {
+		if n <= 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	o := callOptions{
+		rtpTimeout:  sec(a.RtpTimeoutSec),
+		holdTimeout: sec(a.HoldTimeoutSec),
+		maxDuration: sec(a.MaxCallDurationSec),
+		maxSilence:  sec(a.MaxSilenceSec),
+
+		sessionExpires:    max(0, a.SessionExpiresSec),
+		minSessionExpires: max(0, a.MinSessionExpiresSec),
+		sessionRefresher:  strings.ToLower(strings.TrimSpace(a.SessionRefresher)),
+
+		reliableProvisionals: strings.ToLower(strings.TrimSpace(a.ReliableProvisionals)),
+
+		answerMode:       parseAnswerMode(a.AnswerMode),
+		answerDelay:      time.Duration(max(0, a.AnswerDelayMs)) * time.Millisecond,
+		ringbackTone:     strings.ToLower(strings.TrimSpace(a.RingbackTone)),
+		earlyMediaPrompt: strings.TrimSpace(a.EarlyMediaPrompt),
+		earlyMediaMax:    sec(a.EarlyMediaMaxSec),
+
+		maxConcurrent:  max(0, a.MaxConcurrentCalls),
+		retryAfter:     sec(a.RetryAfterSec),
+		queue:          strings.EqualFold(strings.TrimSpace(a.OverflowMode), "queue"),
+		queueMaxWait:   sec(a.QueueMaxWaitSec),
+		queueMaxSize:   max(0, a.QueueMaxSize),
+		queueHoldAudio: strings.TrimSpace(a.QueueHoldAudio),
+
+		inbandDtmf:         a.InbandDtmf,
+		inbandDtmfSuppress: a.InbandDtmf && a.InbandDtmfSuppress,
+		dtmfSendMode:       parseDtmfSendMode(a.DtmfSendMode),
+
+		preferredCodecs: a.PreferredCodecs,
+		opusFec:         a.OpusFec,
+		opusDtx:         a.OpusDtx,
+
+		jitterMin: time.Duration(max(0, a.JitterMinMs)) * time.Millisecond,
+		jitterMax: time.Duration(max(0, a.JitterMaxMs)) * time.Millisecond,
+
+		bargeIn:            a.BargeIn,
+		bargeInSensitivity: parseVadSensitivity(a.BargeInSensitivity),
+		bargeInHangover:    time.Duration(max(0, a.BargeInHangoverMs)) * time.Millisecond,
+
+		vadMode:        parseVadMode(a.VadMode),
+		vadSensitivity: parseVadSensitivity(a.VadSensitivity),
+		vadHangover:    time.Duration(max(0, a.VadHangoverMs)) * time.Millisecond,
+		vadPadding:     time.Duration(max(0, a.VadPaddingMs)) * time.Millisecond,
+
+		echoCancel: a.EchoCancel,
+		echoTail:   time.Duration(max(0, a.EchoTailMs)) * time.Millisecond,
+
+		dspUplink:   parseDspPreset(a.DspUplink),
+		dspDownlink: parseDspPreset(a.DspDownlink),
+
+		comfortNoise: parseComfortNoiseMode(a.ComfortNoise),
+
+		record:              parseRecordMode(a.Record),
+		recordDir:           strings.TrimSpace(a.RecordDir),
+		recordFileName:      strings.TrimSpace(a.RecordFileName),
+		recordRetentionDays: max(0, a.RecordRetentionDays),
+
+		transcript:    parseTranscriptMode(a.Transcript),
+		transcriptDir: strings.TrimSpace(a.TranscriptDir),
+
+		wsKeepalive:       sec(a.WsKeepaliveSec),
+		wsReconnectBudget: time.Duration(a.WsReconnectSec) * time.Second,
+		wsOutageAudio:     strings.TrimSpace(a.WsOutageAudio),
+
+		fallback:           parseFallbackPolicy(a.Fallback),
+		fallbackPrompt:     strings.TrimSpace(a.FallbackPrompt),
+		fallbackTransferTo: strings.TrimSpace(a.FallbackTransferTo),
+		fallbackHoldMax:    sec(a.FallbackHoldMaxSec),
+
+		messageSocketURL:   strings.TrimSpace(a.MessageSocketURL),
+		messageIdleTimeout: sec(a.MessageIdleTimeoutSec),
+	}
+	if o.retryAfter <= 0 {
+		o.retryAfter = defaultRetryAfter
+	}
+	if o.queueMaxSize == 0 {
+		o.queueMaxSize = defaultQueueMaxSize
+	}
+	if o.ringbackTone == "" {
+		o.ringbackTone = "us"
+	}
+	if a.RtpTimeoutSec == 0 {
+		o.rtpTimeout = defaultRtpTimeout
+	}
+	if o.bargeInHangover == 0 {
+		o.bargeInHangover = defaultBargeInHangover
+	}
+	if o.vadHangover == 0 {
+		o.vadHangover = defaultVadHangover
+	}
+	if o.vadPadding == 0 {
+		o.vadPadding = defaultVadPadding
+	}
+	if o.recordDir == "" {
+		o.recordDir = defaultRecordDir
+	}
+	if o.recordFileName == "" {
+		o.recordFileName = defaultRecordFileName
+	}
+	if o.transcriptDir == "" {
+		o.transcriptDir = defaultTranscriptDir
+	}
+	if o.wsKeepalive == 0 {
+		o.wsKeepalive = defaultWsKeepalive
+	}
+	if o.wsReconnectBudget == 0 {
+		o.wsReconnectBudget = defaultWsReconnectBudget
+	}
+	return o
 }
 
 type regTarget struct {
@@ -409,6 +737,58 @@ type callSession struct {
 	echo   bool
 	// Best-effort remote RTP peer from SDP (so we can start sending immediately).
 	remoteRtp net.Addr
+
+	opts      callOptions
+	dlg       *sipDialog
+	startedAt time.Time
+
+	mu          sync.Mutex
+	lastRtpAt   time.Time
+	lastVoiceAt time.Time
+	holdSince   time.Time // zero when not on hold
+	endReason   string
+	// Transcript file of the call (AI mode, if enabled), for the call record.
+	transcriptPath string
+	// SDP we last sent (answer or re-INVITE answer); reused for our re-INVITE refreshes.
+	localSDP string
+
+	timer *sessionTimer
+	// INVITE transaction until the 200 OK (early media calls exist before they are answered).
+	inv      *uasInvite
+	answered bool
+	// Concurrency slot held while the AI/echo session runs (nil while queued), and the call's place in
+	// the queue while it waits for one.
+	slot   *callSlot
+	waiter *slotWaiter
+
+	// ACK for our 200 OK. With a delayed offer (INVITE without SDP) our 200 OK is the offer and the
+	// ACK carries the answer; acked closes once it has been applied.
+	ackCh        chan sipMsg
+	acked        chan struct{}
+	delayedOffer bool
+	// Negotiated audio codecs; the first is the one we send.
+	codecs []audioCodec
+
+	// DTMF: telephone-event payload type and clock rate, RFC 4733 receive state, and decoded digits
+	// (RFC 4733 or INFO) for the media runner.
+	dtmfPT       uint8
+	dtmfClock    int
+	dtmfRx       rfc4733Receiver
+	dtmf         chan dtmfEvent
+	lastInfoCSeq int
+	// Whether the caller's SDP had telephone-event, and whether its Allow lists INFO (for sending digits).
+	dtmfNegotiated bool
+	peerAllowsInfo bool
+	// Comfort noise (RFC 3389) if negotiated, on the audio clock; zero value otherwise.
+	cn audioCodec
+	// Status codes from NOTIFYs of our REFER, while a fallback transfer runs (guarded by mu).
+	referCh chan int
+}
+
+func (cs *callSession) currentLocalSDP() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.localSDP
 }
 
 func parseSDPRtpAddr(body []byte, sipSrc net.Addr) net.Addr {
@@ -471,6 +851,39 @@ func parseSDPRtpAddr(body []byte, sipSrc net.Addr) net.Addr {
 	return &net.UDPAddr{IP: net.ParseIP(remoteIP), Port: remotePort}
 }
 
+// parseSDPAudioPayloads returns the payload types of the first m=audio line, in preference order.
+func parseSDPAudioPayloads(body []byte) []uint8 {
+	for _, ln := range strings.Split(string(body), "\n") {
+		ln = strings.TrimSpace(strings.TrimRight(ln, "\r"))
+		if !strings.HasPrefix(strings.ToLower(ln), "m=audio ") {
+			continue
+		}
+		fields := strings.Fields(ln)
+		var out []uint8
+		for _, f := range fields[min(3, len(fields)):] {
+			if n, err := strconv.Atoi(f); err == nil && n >= 0 && n < 128 {
+				out = append(out, uint8(n))
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func parseSDPHold(body []byte) bool {
+	// Hold per RFC 3264 (a=sendonly / a=inactive) or the legacy RFC 2543 form (c=IN IP4 0.0.0.0).
+	for _, ln := range strings.Split(string(body), "\n") {
+		ln = strings.ToLower(strings.TrimSpace(strings.TrimRight(ln, "\r")))
+		switch {
+		case ln == "a=sendonly" || ln == "a=inactive":
+			return true
+		case strings.HasPrefix(ln, "c=in ip4 0.0.0.0"):
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
 	c := loadCfg()
@@ -490,10 +903,16 @@ func main() {
 		workers:     map[string]*regWorker{},
 		calls:       map[string]*callSession{},
 		agentByUser: map[string]agentRuntime{},
+		clientTx:    map[string]chan sipMsg{},
+
+		pendingInvites: map[string]*uasInvite{},
+		pagers:         map[string]*pagerSession{},
+		limiter:        newCallLimiter(),
 	}
 
 	// Watch SIP AI config file and keep registrations in sync.
 	go watchSipAiConfig(logger, c, st)
+	go runRecordingSweeper(logger, st)
 
 	buf := make([]byte, 64*1024)
 	for {
@@ -686,6 +1105,7 @@ func watchSipAiConfig(logger *log.Logger, c cfg, st *runtimeState) {
 					sipDomain:       resolveAutoHost(dom, autoIP),
 					sipPass:         pass,
 					registerExpires: registerExpires,
+					opts:            agentCallOptions(a),
 				}
 				continue
 			}
@@ -708,6 +1128,7 @@ func watchSipAiConfig(logger *log.Logger, c cfg, st *runtimeState) {
 				sipDomain:       domain,
 				sipPass:         pass,
 				registerExpires: registerExpires,
+				opts:            agentCallOptions(a),
 			}
 		}
 
@@ -721,6 +1142,7 @@ func watchSipAiConfig(logger *log.Logger, c cfg, st *runtimeState) {
 		st.sipContactHost = contactHost
 		st.sdpIP = sdpIP
 		st.mu.Unlock()
+		st.limiter.setGlobal(def.MaxConcurrentCalls)
 
 		if len(agentByUser) == 0 {
 			logger.Printf("sip-ai: no agents configured; not registering anything")
@@ -811,74 +1233,6 @@ func firstNonEmpty(a, b string) string {
 	return strings.TrimSpace(b)
 }
 
-func buildSessionTimerExtras(req sipMsg) map[string][]string {
-	// Some endpoints (and some FreeSWITCH configs) negotiate very short session timers (~30s).
-	// If we don't echo Session-Expires on refresh requests, the dialog can be torn down around ~32s.
-	//
-	// Strategy:
-	// - Only advertise/require timer when the peer asks for it (Session-Expires present or Require: timer).
-	// - Echo back Session-Expires / Min-SE headers verbatim when present.
-	se := strings.TrimSpace(req.header("session-expires"))
-	minSE := strings.TrimSpace(req.header("min-se"))
-	reqRequire := strings.ToLower(req.header("require"))
-
-	wantsTimer := false
-	if se != "" {
-		wantsTimer = true
-	}
-	if strings.Contains(reqRequire, "timer") {
-		wantsTimer = true
-	}
-
-	extra := map[string][]string{
-		// Always safe; timer is appended only when needed.
-		"Supported": {"replaces"},
-	}
-	if wantsTimer {
-		extra["Supported"] = []string{"replaces, timer"}
-		// If peer requires timer, echo it (safe even if not strictly required).
-		if strings.Contains(reqRequire, "timer") {
-			extra["Require"] = []string{"timer"}
-		}
-		if se != "" {
-			// If refresher=uas is negotiated, *we* would be responsible to send the refresh.
-			// sip-rtp-go doesn't initiate refreshes, so force refresher=uac to make FreeSWITCH refresh.
-			extra["Session-Expires"] = []string{forceSessionExpiresRefresherUAC(se)}
-		}
-		if minSE != "" {
-			extra["Min-SE"] = []string{minSE}
-		}
-	}
-	return extra
-}
-
-func forceSessionExpiresRefresherUAC(se string) string {
-	// Input examples:
-	// "30;refresher=uas"
-	// "30;refresher=uac"
-	// "1800"
-	// "30;refresher=uas;something=else"
-	s := strings.TrimSpace(se)
-	if s == "" {
-		return s
-	}
-	parts := strings.Split(s, ";")
-	out := make([]string, 0, len(parts)+1)
-	for _, p := range parts {
-		p = strings.TrimSpace(p)
-		if p == "" {
-			continue
-		}
-		// Drop any existing refresher=...
-		if strings.HasPrefix(strings.ToLower(p), "refresher=") {
-			continue
-		}
-		out = append(out, p)
-	}
-	out = append(out, "refresher=uac")
-	return strings.Join(out, ";")
-}
-
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -886,12 +1240,17 @@ func max(a, b int) int {
 	return b
 }
 
+// sipAllow is the Allow header we advertise everywhere: the methods handleSIPPacket accepts.
+const sipAllow = "INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, INFO, PRACK, NOTIFY, MESSAGE"
+
 func handleSIPPacket(logger *log.Logger, conn net.PacketConn, addr net.Addr, pkt []byte, c cfg, st *runtimeState) {
 	m, err := parseSIP(pkt)
 	if err != nil {
 		return
 	}
 	if m.method == "" {
+		// Response to one of our own in-dialog requests (e.g. BYE).
+		deliverSIPResponse(st, m)
 		return
 	}
 
@@ -900,50 +1259,80 @@ func handleSIPPacket(logger *log.Logger, conn net.PacketConn, addr net.Addr, pkt
 		handleInvite(logger, conn, addr, m, c, st)
 	case "ACK":
 		// ACK confirms the 200 OK for INVITE. Log it because missing ACK is a classic ~32s hangup cause.
-		logger.Printf("sip recv: ACK call-id=%s from=%s", m.header("call-id"), addr.String())
+		logger.Printf("sip recv: ACK call-id=%s from=%s sdp=%t", m.header("call-id"), addr.String(), len(m.body) > 0)
+		st.mu.RLock()
+		cs := st.calls[m.header("call-id")]
+		st.mu.RUnlock()
+		if cs != nil {
+			cs.deliverAck(m)
+		}
 	case "INFO":
-		// Some endpoints use INFO for keepalive/DTMF; acknowledge.
-		sendSIPResponse(conn, addr, m, "", "", 200, "OK", map[string][]string{
-			"Allow": {"INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, INFO, PRACK, NOTIFY"},
-		}, nil)
+		// Some endpoints use INFO for keepalive; DTMF bodies are picked up.
+		handleInfo(logger, conn, addr, m, st)
 	case "PRACK":
-		// Provisional response acknowledgment (100rel). We don't use 100rel, but ack it anyway.
-		sendSIPResponse(conn, addr, m, "", "", 200, "OK", map[string][]string{
-			"Allow": {"INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, INFO, PRACK, NOTIFY"},
-		}, nil)
+		// Provisional response acknowledgment (RFC 3262 100rel).
+		handlePrack(logger, conn, addr, m, st)
 	case "NOTIFY":
-		// Some stacks may send NOTIFY in-dialog; ack it.
+		// Some stacks may send NOTIFY in-dialog; ack it. Those for our REFER report the transfer.
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(m.header("event"))), "refer") {
+			st.mu.RLock()
+			cs := st.calls[m.header("call-id")]
+			st.mu.RUnlock()
+			if cs != nil {
+				cs.deliverReferNotify(m.body)
+			}
+		}
 		sendSIPResponse(conn, addr, m, "", "", 200, "OK", map[string][]string{
-			"Allow": {"INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, INFO, PRACK, NOTIFY"},
+			"Allow": {sipAllow},
 		}, nil)
 	case "UPDATE":
 		logger.Printf("sip recv: UPDATE call-id=%s se=%q min-se=%q require=%q from=%s", m.header("call-id"), m.header("session-expires"), m.header("min-se"), m.header("require"), addr.String())
-		// Session-timer refresh (RFC 3311). We don't change SDP; just acknowledge.
+		// Session-timer refresh (RFC 3311/4028). We don't change SDP; renegotiate the timer and acknowledge.
+		st.mu.RLock()
+		cs := st.calls[m.header("call-id")]
+		st.mu.RUnlock()
+		var opts callOptions
+		if cs != nil {
+			opts = cs.opts
+		}
+		ans := negotiateSessionTimer(m, opts)
+		if ans.reject {
+			sendSessionIntervalTooSmall(conn, addr, m, ans)
+			return
+		}
+		if cs != nil && cs.timer != nil {
+			cs.timer.apply(ans)
+		}
 		extra := map[string][]string{
-			"Allow": {"INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, INFO, PRACK, NOTIFY"},
+			"Allow": {sipAllow},
 		}
-		for k, v := range buildSessionTimerExtras(m) {
+		for k, v := range ans.extra {
 			extra[k] = v
 		}
 		sendSIPResponse(conn, addr, m, "", "", 200, "OK", extra, nil)
 	case "CANCEL":
 		sendSIPResponse(conn, addr, m, "", "", 200, "OK", nil, nil)
 		logger.Printf("sip recv: CANCEL call-id=%s from=%s", m.header("call-id"), addr.String())
-		endCall(logger, m.header("call-id"), st)
+		// Unanswered INVITE gets 487; an early-media call also has a session to tear down.
+		cancelPendingInvite(st, m.header("call-id"))
+		endCall(logger, m.header("call-id"), st, "caller cancelled")
 	case "BYE":
 		sendSIPResponse(conn, addr, m, "", "", 200, "OK", nil, nil)
 		logger.Printf("sip recv: BYE call-id=%s from=%s", m.header("call-id"), addr.String())
-		endCall(logger, m.header("call-id"), st)
+		endCall(logger, m.header("call-id"), st, "caller hangup")
 	case "OPTIONS":
 		sendSIPResponse(conn, addr, m, "", "", 200, "OK", map[string][]string{
-			"Allow": {"INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE, INFO, PRACK, NOTIFY"},
+			"Allow":     {sipAllow},
+			"Supported": {"replaces, timer, 100rel"},
 		}, nil)
+	case "MESSAGE":
+		handleMessage(logger, conn, addr, m, c, st)
 	default:
 		sendSIPResponse(conn, addr, m, "", "", 501, "Not Implemented", nil, nil)
 	}
 }
 
-func endCall(logger *log.Logger, callID string, st *runtimeState) {
+func endCall(logger *log.Logger, callID string, st *runtimeState, reason string) {
 	if callID == "" {
 		return
 	}
@@ -956,9 +1345,18 @@ func endCall(logger *log.Logger, callID string, st *runtimeState) {
 	if cs == nil {
 		return
 	}
+	cs.mu.Lock()
+	cs.endReason = reason
+	transcript := cs.transcriptPath
+	cs.mu.Unlock()
 	close(cs.stopCh)
 	_ = cs.rtp.Close()
-	logger.Printf("call ended (call-id=%s ext=%s)", cs.callID, cs.extID)
+	cs.releaseSlot()
+	if transcript != "" {
+		logger.Printf("call ended (call-id=%s ext=%s reason=%q transcript=%s)", cs.callID, cs.extID, reason, transcript)
+		return
+	}
+	logger.Printf("call ended (call-id=%s ext=%s reason=%q)", cs.callID, cs.extID, reason)
 }
 
 func parseToUser(req sipMsg) string {
@@ -1011,6 +1409,14 @@ func handleInvite(logger *log.Logger, conn net.PacketConn, addr net.Addr, req si
 		return
 	}
 
+	if bad := unsupportedRequire(req); len(bad) > 0 {
+		sendSIPResponse(conn, addr, req, "", "", 420, "Bad Extension", map[string][]string{
+			"Unsupported": {strings.Join(bad, ", ")},
+		}, nil)
+		logger.Printf("sip: rejected INVITE with 420 (call-id=%s unsupported=%v)", callID, bad)
+		return
+	}
+
 	// In-dialog re-INVITE (common around ~30s when session timers are enabled).
 	// Previously we returned 486 which makes FreeSWITCH tear down the call.
 	if existing != nil {
@@ -1025,7 +1431,31 @@ func handleInvite(logger *log.Logger, conn net.PacketConn, addr net.Addr, req si
 		if ua != nil {
 			rtpPort = ua.Port
 		}
-		sdp := buildSDP(sdpIP, rtpPort)
+		ans := negotiateSessionTimer(req, existing.opts)
+		if ans.reject {
+			sendSessionIntervalTooSmall(conn, addr, req, ans)
+			return
+		}
+		if existing.timer != nil {
+			existing.timer.apply(ans)
+		}
+
+		// Track hold/unhold for the hold timeout and answer with the matching direction.
+		dir := "sendrecv"
+		if len(req.body) > 0 {
+			hold := parseSDPHold(req.body)
+			existing.setHold(hold)
+			if hold {
+				dir = "recvonly"
+				if strings.Contains(strings.ToLower(string(req.body)), "a=inactive") {
+					dir = "inactive"
+				}
+			}
+		}
+		sdp := buildSDP(sdpIP, rtpPort, dir, existing.codecs, []audioCodec{telephoneEvent(existing.dtmfPT, existing.dtmfClock)}, existing.cn)
+		existing.mu.Lock()
+		existing.localSDP = sdp
+		existing.mu.Unlock()
 		_, sipListenPort, _ := net.SplitHostPort(c.sipListenAddr)
 		contact := ""
 		if sipListenPort != "" {
@@ -1033,16 +1463,72 @@ func handleInvite(logger *log.Logger, conn net.PacketConn, addr net.Addr, req si
 		}
 		extra := map[string][]string{
 			"Content-Type": {"application/sdp"},
-			"Allow":        {"INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE"},
+			"Allow":        {sipAllow},
 		}
-		for k, v := range buildSessionTimerExtras(req) {
+		for k, v := range ans.extra {
 			extra[k] = v
 		}
 		sendSIPResponse(conn, addr, req, "", contact, 200, "OK", extra, []byte(sdp))
-		logger.Printf("in-dialog re-INVITE handled (call-id=%s ext=%s)", callID, extID)
+		logger.Printf("in-dialog re-INVITE handled (call-id=%s ext=%s dir=%s)", callID, extID, dir)
 		return
 	}
 
+	timerAns := negotiateSessionTimer(req, agent.opts)
+	if timerAns.reject {
+		sendSessionIntervalTooSmall(conn, addr, req, timerAns)
+		logger.Printf("session timer: rejected INVITE with 422 (call-id=%s se=%q min-se=%d)", callID, sessionExpiresHeader(req), timerAns.minSE)
+		return
+	}
+
+	// INVITE retransmission while we are still answering (e.g. waiting for PRACK).
+	st.mu.RLock()
+	pending := st.pendingInvites[callID]
+	st.mu.RUnlock()
+	if pending != nil {
+		sendSIPResponse(conn, addr, req, pending.toWithTag, "", 100, "Trying", nil, nil)
+		return
+	}
+
+	// Delayed offer (no SDP): our 200 OK offers everything we support.
+	codecs := agentCodecs(agent.opts)
+	if len(strings.TrimSpace(string(req.body))) > 0 {
+		codecs = negotiateCodecs(parseSDPAudioCodecs(req.body), codecs)
+		if len(codecs) == 0 {
+			sendSIPResponse(conn, addr, req, "", "", 488, "Not Acceptable Here", nil, nil)
+			logger.Printf("sip: rejected INVITE with 488, no common codec (call-id=%s)", callID)
+			return
+		}
+	}
+
+	// Concurrency limits: each media session is one WS backend session.
+	o := agent.opts
+	slot, blocked := st.limiter.tryAcquire(extID, o.maxConcurrent)
+	var waiter *slotWaiter
+	if slot == nil {
+		if o.queue {
+			waiter = st.limiter.enqueue(extID, o.maxConcurrent, o.queueMaxSize)
+		}
+		if waiter == nil {
+			status, reason := 486, "Busy Here"
+			if blocked == "global" {
+				status, reason = 503, "Service Unavailable"
+			}
+			sendSIPResponse(conn, addr, req, "", "", status, reason, map[string][]string{
+				"Retry-After": {strconv.Itoa(int(o.retryAfter / time.Second))},
+			}, nil)
+			logger.Printf("sip: rejected INVITE with %d (call-id=%s ext=%s limit=%s)", status, callID, extID, blocked)
+			return
+		}
+	}
+	queued := waiter != nil
+	registered := false
+	defer func() {
+		if !registered {
+			waiter.leave()
+			slot.release()
+		}
+	}()
+
 	// allocate per-call RTP socket
 	rtpConn, err := net.ListenPacket("udp", "0.0.0.0:0")
 	if err != nil {
@@ -1055,30 +1541,53 @@ func handleInvite(logger *log.Logger, conn net.PacketConn, addr net.Addr, req si
 		rtpPort = ua.Port
 	}
 
-	toWithTag := ensureToHasTag(req.header("to"))
-	sendSIPResponse(conn, addr, req, toWithTag, "", 100, "Trying", nil, nil)
-	sendSIPResponse(conn, addr, req, toWithTag, "", 180, "Ringing", nil, nil)
-
 	if strings.TrimSpace(sdpIP) == "" {
 		sdpIP = detectLocalIPv4()
 	}
 	if strings.TrimSpace(contactHost) == "" {
 		contactHost = detectLocalIPv4()
 	}
-	sdp := buildSDP(sdpIP, rtpPort)
 	_, sipListenPort, _ := net.SplitHostPort(c.sipListenAddr)
 	contact := ""
 	if sipListenPort != "" {
 		contact = fmt.Sprintf("<sip:%s@%s:%s;transport=udp>", extID, contactHost, sipListenPort)
 	}
+
+	toWithTag := ensureToHasTag(req.header("to"))
+	inv := newUASInvite(conn, addr, req, toWithTag, contact, agent.opts)
+	st.addPendingInvite(callID, inv)
+	_, _ = inv.sendProvisional(100, "Trying", nil, nil)
+
+	// Delayed offer: our 200 OK carries the full offer and the answer comes back in the ACK.
+	delayedOffer := len(strings.TrimSpace(string(req.body))) == 0
+	// telephone-event runs on the audio clock where the caller offers it (Opus: 48000). Our own offer
+	// lists it at every clock we offer; the answer settles which (applySDPAnswer).
+	dtmfPT, dtmfClock, dtmfNegotiated := parseSDPTelephoneEvent(req.body, codecs[0].clockRate)
+	if !dtmfNegotiated {
+		dtmfPT, dtmfClock = defaultDtmfPT, codecs[0].clockRate
+	}
+	dtmfOffer := []audioCodec{telephoneEvent(dtmfPT, dtmfClock)}
+	if delayedOffer {
+		dtmfOffer = offerTelephoneEvents(codecs)
+		dtmfPT, dtmfClock = dtmfOffer[0].pt, dtmfOffer[0].clockRate
+	}
+	// CN on the audio clock when the caller offers it; our own offer (no SDP in the INVITE) has CN/8000.
+	var cn audioCodec
+	if agent.opts.comfortNoise != comfortNoiseOff {
+		if c, ok := parseSDPComfortNoise(req.body, codecs[0].clockRate); ok {
+			cn = c
+		} else if delayedOffer {
+			cn = codecCN
+		}
+	}
+	sdp := buildSDP(sdpIP, rtpPort, "sendrecv", codecs, dtmfOffer, cn)
 	extra := map[string][]string{
 		"Content-Type": {"application/sdp"},
-		"Allow":        {"INVITE, ACK, BYE, CANCEL, OPTIONS, UPDATE"},
+		"Allow":        {sipAllow},
 	}
-	for k, v := range buildSessionTimerExtras(req) {
+	for k, v := range timerAns.extra {
 		extra[k] = v
 	}
-	sendSIPResponse(conn, addr, req, toWithTag, contact, 200, "OK", extra, []byte(sdp))
 
 	// Echo ONLY when this agent's Gemini socket URL is not set.
 	echo := strings.TrimSpace(agent.geminiSocketURL) == ""
@@ -1086,38 +1595,159 @@ func handleInvite(logger *log.Logger, conn net.PacketConn, addr net.Addr, req si
 	if remoteRtp != nil {
 		logger.Printf("rtp peer from sdp: call-id=%s ext=%s peer=%s", callID, extID, remoteRtp.String())
 	}
-	cs := &callSession{callID: callID, extID: extID, rtp: rtpConn, stopCh: make(chan struct{}), echo: echo, remoteRtp: remoteRtp}
+	now := time.Now()
+	cs := &callSession{
+		callID:      callID,
+		extID:       extID,
+		rtp:         rtpConn,
+		stopCh:      make(chan struct{}),
+		echo:        echo,
+		remoteRtp:   remoteRtp,
+		opts:        agent.opts,
+		dlg:         newSipDialog(conn, addr, req, toWithTag, contact, contactHost, sipListenPort),
+		startedAt:   now,
+		lastRtpAt:   now,
+		lastVoiceAt: now,
+		localSDP:    sdp,
+		timer: &sessionTimer{
+			peerUpdate: hasOptionTag(req, "allow", "UPDATE"),
+			peerTimer:  hasOptionTag(req, "supported", "timer") || hasOptionTag(req, "require", "timer"),
+		},
+		inv:    inv,
+		slot:   slot,
+		waiter: waiter,
+
+		ackCh:        make(chan sipMsg, 1),
+		acked:        make(chan struct{}),
+		delayedOffer: delayedOffer,
+		codecs:       codecs,
+		dtmfPT:       dtmfPT,
+		dtmfClock:    dtmfClock,
+		dtmfRx:       rfc4733Receiver{clock: dtmfClock},
+		dtmf:         make(chan dtmfEvent, 32),
+
+		dtmfNegotiated: dtmfNegotiated,
+		cn:             cn,
+		peerAllowsInfo: hasOptionTag(req, "allow", "INFO"),
+	}
+	cs.timer.apply(timerAns)
+
+	answer := func() bool {
+		if !st.finishPendingInvite(callID, inv) {
+			return false
+		}
+		sendSIPResponse(conn, addr, req, toWithTag, contact, 200, "OK", extra, []byte(sdp))
+		cs.markAnswered()
+		go waitForAck(logger, st, cs, func() {
+			sendSIPResponse(conn, addr, req, toWithTag, contact, 200, "OK", extra, []byte(sdp))
+		})
+		logger.Printf("call answered (call-id=%s ext=%s delayed-offer=%t)", callID, extID, delayedOffer)
+		go runSessionTimer(logger, st, cs)
+		if timerAns.interval > 0 {
+			logger.Printf("session timer: call-id=%s se=%ds refresher=%s", callID, timerAns.interval, timerAns.refresher)
+		}
+		return true
+	}
+	startMedia := func() {
+		if echo {
+			go runRTPEchoCall(logger, cs)
+			logger.Printf("call media started (ext=%s mode=echo rtp=%s:%d)", extID, sdpIP, rtpPort)
+		} else {
+			wsURL := strings.TrimSpace(agent.geminiSocketURL)
+			go runRTPWsStreamCall(logger, st, cs, wsURL)
+			logger.Printf("call media started (ext=%s mode=ai-ws rtp=%s:%d ws=%s)", extID, sdpIP, rtpPort, wsURL)
+		}
+	}
+
+	// Early media needs the caller's RTP address up front (we can't learn it from inbound RTP yet).
+	// Queued callers are answered right away and wait on hold audio instead.
+	useEarly := !queued && remoteRtp != nil &&
+		(o.answerMode != answerImmediate || (o.answerDelay > 0 && o.ringbackTone != "none"))
+	if useEarly {
+		st.mu.Lock()
+		st.calls[callID] = cs
+		st.mu.Unlock()
+		registered = true
+		go runCallGuards(logger, st, cs)
+		answerWithEarlyMedia(logger, st, cs, sdp, answer, startMedia)
+		return
+	}
+
+	if _, err := inv.sendProvisional(180, "Ringing", nil, nil); err != nil {
+		_ = rtpConn.Close()
+		if errors.Is(err, errInviteCanceled) {
+			logger.Printf("sip: INVITE canceled while ringing (call-id=%s)", callID)
+			return
+		}
+		if st.finishPendingInvite(callID, inv) {
+			sendSIPResponse(conn, addr, req, toWithTag, "", 500, "Server Internal Error", nil, nil)
+		}
+		logger.Printf("sip: INVITE failed (call-id=%s): %v", callID, err)
+		return
+	}
+	if o.answerDelay > 0 && !queued {
+		select {
+		case <-inv.canceled:
+			_ = rtpConn.Close()
+			logger.Printf("sip: INVITE canceled while ringing (call-id=%s)", callID)
+			return
+		case <-time.After(o.answerDelay):
+		}
+	}
+	// Register before the 200 OK so a fast ACK finds the call.
 	st.mu.Lock()
 	st.calls[callID] = cs
 	st.mu.Unlock()
-
-	if echo {
-		go runRTPEchoCall(logger, cs)
-		logger.Printf("call answered (ext=%s mode=echo rtp=%s:%d)", extID, sdpIP, rtpPort)
-	} else {
-		wsURL := strings.TrimSpace(agent.geminiSocketURL)
-		go runRTPWsStreamCall(logger, cs, wsURL)
-		logger.Printf("call answered (ext=%s mode=ai-ws rtp=%s:%d ws=%s)", extID, sdpIP, rtpPort, wsURL)
+	registered = true
+	if !answer() {
+		endCall(logger, callID, st, "caller cancelled")
+		return
+	}
+	go runCallGuards(logger, st, cs)
+	if delayedOffer {
+		// No RTP peer/codec until the ACK brings the SDP answer.
+		select {
+		case <-cs.acked:
+		case <-cs.stopCh:
+			return
+		}
+	}
+	if queued {
+		go runQueuedCall(logger, st, cs, startMedia)
+		return
 	}
+	startMedia()
 }
 
-func buildSDP(ip string, port int) string {
-	// Keep it very small: PCMU/PCMA + DTMF
-	return strings.Join([]string{
+func buildSDP(ip string, port int, dir string, codecs []audioCodec, dtmf []audioCodec, cn audioCodec) string {
+	// Keep it very small: the negotiated codecs + CN if any + DTMF (telephone-event on the caller's payload type)
+	pts := make([]string, 0, len(codecs)+len(dtmf)+1)
+	var attrs []string
+	if cn.name != "" {
+		codecs = append(codecs[:len(codecs):len(codecs)], cn)
+	}
+	codecs = append(codecs[:len(codecs):len(codecs)], dtmf...)
+	for _, c := range codecs {
+		pts = append(pts, strconv.Itoa(int(c.pt)))
+		attrs = append(attrs, c.rtpmap())
+		if c.fmtp != "" {
+			attrs = append(attrs, fmt.Sprintf("a=fmtp:%d %s", c.pt, c.fmtp))
+		}
+	}
+	lines := []string{
 		"v=0",
 		"o=- 0 0 IN IP4 " + ip,
 		"s=sip-rtp-go",
 		"c=IN IP4 " + ip,
 		"t=0 0",
-		fmt.Sprintf("m=audio %d RTP/AVP 0 8 101", port),
-		"a=rtpmap:0 PCMU/8000",
-		"a=rtpmap:8 PCMA/8000",
-		"a=rtpmap:101 telephone-event/8000",
-		"a=fmtp:101 0-16",
+		fmt.Sprintf("m=audio %d RTP/AVP %s", port, strings.Join(pts, " ")),
+	}
+	lines = append(lines, attrs...)
+	return strings.Join(append(lines,
 		"a=ptime:20",
-		"a=sendrecv",
+		"a="+dir,
 		"",
-	}, "\r\n")
+	), "\r\n")
 }
 
 func ensureToHasTag(to string) string {
@@ -1156,7 +1786,8 @@ func sendSIPResponse(conn net.PacketConn, addr net.Addr, req sipMsg, toOverride
 	}
 
 	// Correct Contact is important so in-dialog requests (BYE) reach us.
-	if status >= 200 && status < 300 && strings.ToUpper(req.method) == "INVITE" && contactOverride != "" {
+	// 18x responses establish an early dialog, so they carry it too.
+	if status > 100 && status < 300 && strings.ToUpper(req.method) == "INVITE" && contactOverride != "" {
 		b.WriteString("Contact: " + contactOverride + "\r\n")
 	}
 
@@ -1180,7 +1811,8 @@ func sendSIPResponse(conn net.PacketConn, addr net.Addr, req sipMsg, toOverride
 func runRTPEchoCall(logger *log.Logger, cs *callSession) {
 	// rewrite SSRC to avoid collisions
 	ssrc := rand.Uint32()
-	buf := make([]byte, 2048)
+	// Room for a 20 ms L16 packet at 48 kHz and then some.
+	buf := make([]byte, 4096)
 	var p rtp.Packet
 
 	var (
@@ -1194,6 +1826,11 @@ func runRTPEchoCall(logger *log.Logger, cs *callSession) {
 	t := time.NewTicker(1 * time.Second)
 	defer t.Stop()
 
+	// Digits are only logged in echo mode.
+	go cs.watchDtmf(logger, nil, nil)
+	// Decoded only for the silence guard.
+	dec := newRtpDecoder(cs.codecs)
+
 	go func() {
 		for range t.C {
 			mu.Lock()
@@ -1232,6 +1869,11 @@ func runRTPEchoCall(logger *log.Logger, cs *callSession) {
 		lastPT = p.PayloadType
 		rx++
 		mu.Unlock()
+		cs.markRtp()
+		// Telephone-events are decoded and still echoed, so the caller hears their own digits.
+		if !cs.handleTelephoneEvent(logger, &p) {
+			cs.noteCallerAudio(dec.decode8k(&p))
+		}
 
 		out := rtp.Packet{
 			Header: rtp.Header{
@@ -1257,35 +1899,63 @@ func runRTPEchoCall(logger *log.Logger, cs *callSession) {
 	}
 }
 
-func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
+func runRTPWsStreamCall(logger *log.Logger, st *runtimeState, cs *callSession, wsURL string) {
 	// AI mode: stream caller audio to a mod_audio_stream-compatible WebSocket server (e.g. whizio on :9094).
-	// Upstream: RTP -> PCM16@16k -> WS binary frames
-	// Downstream: WS streamAudio (wav/8k) -> PCM16 -> PCMU RTP (pt=0) -> caller
+	// Upstream: RTP -> PCM16@16k (L16: native rate) -> WS binary frames
+	// Downstream: WS streamAudio (wav or pcm16le, any rate) -> PCM16 -> RTP in the negotiated codec -> caller
 	wsURL = strings.TrimSpace(wsURL)
 	if wsURL == "" {
 		// Never go silent: callers often hang up after ~30s if they think there's "no media".
-		runRTPFallbackToneCall(logger, cs)
+		runFallback(logger, st, cs, "no ai backend")
 		return
 	}
 	if !strings.HasPrefix(strings.ToLower(wsURL), "ws://") && !strings.HasPrefix(strings.ToLower(wsURL), "wss://") {
-		logger.Printf("ws stream: invalid url %q (expected ws:// or wss://); using fallback tone", wsURL)
-		runRTPFallbackToneCall(logger, cs)
+		logger.Printf("ws stream: invalid url %q (expected ws:// or wss://)", wsURL)
+		runFallback(logger, st, cs, "ai backend misconfigured")
 		return
 	}
 	u, err := url.Parse(wsURL)
 	if err != nil {
-		logger.Printf("ws stream: bad url %q: %v; using fallback tone", wsURL, err)
-		runRTPFallbackToneCall(logger, cs)
+		logger.Printf("ws stream: bad url %q: %v", wsURL, err)
+		runFallback(logger, st, cs, "ai backend misconfigured")
 		return
 	}
 
 	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
 	if err != nil {
-		logger.Printf("ws stream: dial failed url=%q: %v; using fallback tone", wsURL, err)
-		runRTPFallbackToneCall(logger, cs)
+		logger.Printf("ws stream: dial failed url=%q: %v", wsURL, err)
+		runFallback(logger, st, cs, "ai backend unavailable")
 		return
 	}
-	defer ws.Close()
+
+	// done ends this session's goroutines: the call ended, or the backend is gone for good and the
+	// fallback policy takes the call over once the session is torn down (the first defer runs last).
+	done := make(chan struct{})
+	var (
+		endOnce       sync.Once
+		backendFailed bool
+	)
+	endSession := func(failed bool) {
+		endOnce.Do(func() {
+			backendFailed = failed
+			close(done)
+		})
+	}
+	go func() {
+		<-cs.stopCh
+		endSession(false)
+	}()
+	defer func() {
+		endSession(false)
+		if backendFailed {
+			runFallback(logger, st, cs, "ai backend unavailable")
+		}
+	}()
+
+	armWs(ws, cs.opts.wsKeepalive)
+	wsw := &wsWriter{ws: ws}
+	defer closeWsSession(wsw, cs)
+	go wsw.runPings(cs.opts.wsKeepalive, done)
 	logger.Printf("ws stream: connected url=%q (ext=%s call-id=%s)", wsURL, cs.extID, cs.callID)
 
 	// Single playback worker: stable SSRC/seq/ts and one RTP sender.
@@ -1294,30 +1964,125 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 	playSSRC := rand.Uint32()
 	playSeq := uint16(rand.Uint32())
 	playTS := uint32(rand.Uint32())
+	// Digits from the backend's sendDtmf, played by the worker (RFC 4733 events or in-band tones).
+	dtmfOut := newDtmfGenerator()
+
+	// Downlink codec from the SDP answer: AI audio is played at its sample rate (L16 at its own rate,
+	// Opus 24 kHz, G.722 16 kHz, G.711 8 kHz). encode returns nil for frames not sent (Opus DTX).
+	enc := cs.newEncoder(logger)
+	playPT, playRate, playTicks := enc.pt(), enc.sampleRate(), enc.frameTicks()
+	encode := enc.encode
+	cs.mu.Lock()
+	dtmfTicks := cs.dtmfClock / 50
+	cs.mu.Unlock()
+
+	// Uplink rate: 16 kHz, or the native rate of an L16 call so lossless audio reaches the AI as is.
+	upRate := 16000
+	if c := cs.sendCodec(); strings.EqualFold(c.name, "L16") {
+		upRate = c.sampleRate
+	}
 
 	// optional metadata (whizio logs it if JSON)
 	meta := map[string]any{
 		"source":     "sip-rtp-go",
 		"callId":     cs.callID,
 		"extension":  cs.extID,
-		"mimeType":   "audio/pcm;rate=16000",
-		"sampleRate": 16000,
-	}
-	if b, err := json.Marshal(meta); err == nil {
-		_ = ws.WriteMessage(websocket.TextMessage, b)
+		"mimeType":   fmt.Sprintf("audio/pcm;rate=%d", upRate),
+		"sampleRate": upRate,
 	}
+	_ = wsw.writeJSON(meta)
+
+	// Caller digits (RFC 4733 or INFO) go to the backend as JSON events.
+	go cs.watchDtmf(logger, done, func(ev dtmfEvent) {
+		_ = wsw.writeJSON(dtmfMsg(cs, ev))
+	})
 
 	var (
 		mu       sync.Mutex
 		lastAddr net.Addr
 		rx       uint64
+		// aiPlaying: the worker is playing queued audio. bargedIn: the caller interrupted it and is
+		// still talking; AI audio arriving meanwhile is dropped. aiRestart: playback was flushed, so
+		// the AI stream's resampler and DSP start over (nothing held back from before the flush).
+		aiPlaying bool
+		bargedIn  bool
+		aiRestart bool
 	)
 	// If we parsed a remote RTP address from SDP, use it immediately (don't wait to learn from inbound).
 	if cs.remoteRtp != nil {
 		lastAddr = cs.remoteRtp
 	}
 
-	// Playback worker (continuous 20ms pacing; sends silence when queue is empty).
+	// flushPlayback drops all AI audio not played yet: the queued chunks, the worker's buffer and
+	// what the downlink resampler and DSP hold back.
+	flushPlayback := func() {
+		mu.Lock()
+		aiRestart = true
+		mu.Unlock()
+		for drained := false; !drained; {
+			select {
+			case <-playQ:
+			default:
+				drained = true
+			}
+		}
+		select {
+		case playQ <- nil:
+		case <-done:
+		}
+	}
+
+	// Recording: caller and AI audio at the playback rate.
+	var rec *callRecorder
+	if cs.opts.record != recordOff {
+		if rec, err = startRecording(logger, cs, playRate); err != nil {
+			logger.Printf("recording: cannot start (call-id=%s): %v", cs.callID, err)
+			rec = nil
+		} else {
+			defer func() {
+				paths, err := rec.close()
+				if err != nil {
+					logger.Printf("recording: failed (call-id=%s): %v", cs.callID, err)
+				}
+				if len(paths) > 0 {
+					logger.Printf("recording: saved (call-id=%s ext=%s) %s", cs.callID, cs.extID, strings.Join(paths, " "))
+				}
+			}()
+		}
+	}
+
+	var tr *callTranscript
+	if cs.opts.transcript != transcriptOff {
+		if tr, err = startTranscript(logger, cs); err != nil {
+			logger.Printf("transcript: cannot start (call-id=%s): %v", cs.callID, err)
+			tr = nil
+		} else {
+			defer func() { tr.close(cs.hangupReason()) }()
+		}
+	}
+
+	// Echo canceller: caller audio minus the echo of what the worker plays, at the lower of the
+	// playback and uplink rates (at most 16 kHz).
+	var aec *echoCanceller
+	refConv := resample.NewConverter(min(playRate, upRate, maxEchoRate))
+	if cs.opts.echoCancel {
+		aec = newEchoCanceller(refConv.OutRate, cs.opts.echoTail)
+		defer func() {
+			logger.Printf("ws stream: echo canceller (call-id=%s) %s", cs.callID, aec.snapshot())
+		}()
+	}
+
+	// Comfort noise in playback gaps. Opus with DTX makes its own (the decoder fills DTX gaps).
+	var cng *comfortNoise
+	if cs.opts.comfortNoise != comfortNoiseOff && !(enc.codec.sameFormat(codecOpus) && cs.opts.opusDtx) {
+		cng = newComfortNoise(playRate)
+	}
+	sidPT := uint8(0)
+	if cs.opts.comfortNoise == comfortNoiseAuto && cs.cn.name != "" {
+		sidPT = cs.cn.pt
+	}
+
+	// Playback worker (continuous 20ms pacing; sends comfort noise or silence when queue is empty).
 	go func() {
 		t := time.NewTicker(20 * time.Millisecond)
 		defer t.Stop()
@@ -1325,11 +2090,13 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 		var (
 			buf         []int16
 			markerFirst = true
+			gapFrames   int
+			recConv     = resample.NewConverter(playRate)
 		)
 
 		for {
 			select {
-			case <-cs.stopCh:
+			case <-done:
 				return
 			case pcm := <-playQ:
 				// nil pcm means "clear buffer immediately" (used when switching from hold->AI).
@@ -1342,7 +2109,7 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 					continue
 				}
 				// Cap buffer to avoid runaway latency (keep last ~2 seconds max).
-				const maxSamples = 8000 * 2
+				maxSamples := playRate * 2
 				if len(buf)+len(pcm) > maxSamples {
 					// drop oldest samples, keep most recent audio
 					excess := (len(buf) + len(pcm)) - maxSamples
@@ -1362,63 +2129,182 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 					continue
 				}
 
-				// Build one 20ms PCMU frame (160 samples)
-				const frameSamples = 160
-				payload := make([]byte, frameSamples)
-				if len(buf) >= frameSamples {
-					for i := 0; i < frameSamples; i++ {
-						payload[i] = linearToMuLaw(buf[i])
+				// Build one 20ms frame. The RTP clock is 8 kHz for G.711 and G.722 alike, 48 kHz for Opus.
+				frameSamples := playRate / 50
+				pt, ts, marker := playPT, playTS, markerFirst
+				var payload []byte
+				// What the caller hears from this frame, as the echo canceller's reference.
+				heard, heardRate := []int16(nil), playRate
+				if f, ok := dtmfOut.next(playTS, dtmfTicks); ok {
+					// A digit is playing; queued AI audio waits until it's done.
+					if f.event != nil {
+						pt, ts, payload = cs.dtmfPT, f.ts, f.event
+						heard = make([]int16, frameSamples)
+					} else {
+						payload = enc.encode8k(f.pcm)
+						heard, heardRate = f.pcm, 8000
 					}
-					buf = buf[frameSamples:]
+					marker = f.marker
 				} else {
-					// μ-law silence
-					for i := 0; i < frameSamples; i++ {
-						payload[i] = 0xFF
+					frame := make([]int16, frameSamples) // zeros => silence
+					playing := len(buf) >= frameSamples
+					if playing {
+						copy(frame, buf)
+						buf = buf[frameSamples:]
 					}
+					mu.Lock()
+					aiPlaying = playing
+					mu.Unlock()
+					switch {
+					case playing || cng == nil:
+						gapFrames = 0
+						if cng != nil {
+							cng.learn(frame)
+						}
+						payload = encode(frame)
+						markerFirst = payload == nil
+					case sidPT != 0 && gapFrames >= cnSidAfterFrames:
+						// A long gap: a SID now and then and the caller's phone makes the noise; the
+						// next audio packet starts a talkspurt.
+						if (gapFrames-cnSidAfterFrames)%cnSidEveryFrames == 0 {
+							pt, payload, marker = sidPT, cng.sid(), false
+						}
+						gapFrames++
+						markerFirst = true
+					default:
+						gapFrames++
+						frame = cng.generate(frameSamples)
+						payload = encode(frame)
+						markerFirst = payload == nil
+					}
+					heard = frame
+				}
+				if aec != nil {
+					aec.reference(refConv.Process(heard, heardRate))
+				}
+				if rec != nil {
+					rec.write(recBot, recConv.Process(heard, heardRate))
+				}
+				if payload == nil {
+					// DTX: nothing sent, the next packet starts a talkspurt.
+					playTS += uint32(playTicks)
+					continue
 				}
 
 				p := rtp.Packet{
 					Header: rtp.Header{
 						Version:        2,
-						Marker:         markerFirst,
-						PayloadType:    0, // PCMU
+						Marker:         marker,
+						PayloadType:    pt,
 						SequenceNumber: playSeq,
-						Timestamp:      playTS,
+						Timestamp:      ts,
 						SSRC:           playSSRC,
 					},
 					Payload: payload,
 				}
-				markerFirst = false
 				raw, err := p.Marshal()
 				if err == nil {
 					_, _ = cs.rtp.WriteTo(raw, addr)
 				}
 				playSeq++
-				playTS += frameSamples
+				playTS += uint32(playTicks)
 			}
 		}
 	}()
 
 	// Beep immediately so we can confirm downlink audio even before Gemini speaks.
 	select {
-	case playQ <- genBeepPcm8k(440, 180):
+	case playQ <- resample.Convert(genBeepPcm8k(440, 180), 8000, playRate):
 	default:
 	}
 
+	// reconnect replaces a dead backend connection, with hold audio for the caller meanwhile. It
+	// returns nil when the session is over: the call ended, the backend closed the session, or the
+	// backend stayed away and the fallback takes over.
+	reconnects := 0
+	reconnect := func(dead *websocket.Conn, cause error) *websocket.Conn {
+		wsw.drop(dead)
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		if websocket.IsCloseError(cause, websocket.CloseNormalClosure) {
+			logger.Printf("ws stream: backend closed the session (call-id=%s)", cs.callID)
+			hangupCall(logger, st, cs, q850NormalClearing, "ai session ended")
+			return nil
+		}
+		lost := time.Now()
+		logger.Printf("ws stream: connection lost (call-id=%s): %v", cs.callID, cause)
+		flushPlayback()
+		stopHold, holdDone := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(holdDone)
+			playOutage(logger, cs, playQ, playRate, stopHold)
+		}()
+		stopOutage := func() {
+			close(stopHold)
+			<-holdDone
+		}
+		for {
+			ws := redialWs(logger, cs, u.String(), lost)
+			if ws == nil {
+				break
+			}
+			armWs(ws, cs.opts.wsKeepalive)
+			resume := map[string]any{
+				"type":       "resume",
+				"reconnects": reconnects + 1,
+				"outageMs":   time.Since(lost).Milliseconds(),
+			}
+			for k, v := range meta {
+				resume[k] = v
+			}
+			if err := wsw.resume(ws, resume); err != nil {
+				logger.Printf("ws stream: resume failed (call-id=%s): %v", cs.callID, err)
+				_ = ws.Close()
+				continue
+			}
+			reconnects++
+			stopOutage()
+			flushPlayback()
+			mu.Lock()
+			bargedIn = false
+			mu.Unlock()
+			return ws
+		}
+		stopOutage()
+		select {
+		case <-cs.stopCh:
+		default:
+			logger.Printf("ws stream: backend unavailable for %s (call-id=%s)", time.Since(lost).Round(time.Second), cs.callID)
+			endSession(true)
+		}
+		return nil
+	}
+
 	// consume server messages and play audio back to caller
 	go func() {
+		conn := ws
 		aiLogged := false
 		aiBegan := false
+		// AI audio arrives in chunks of one stream: the resampler keeps its filter state across them.
+		aiConv := resample.NewConverter(playRate)
+		aiDsp := newDSPChain(cs.opts.dspDownlink, playRate)
 		for {
 			select {
-			case <-cs.stopCh:
+			case <-done:
 				return
 			default:
 			}
-			mt, msg, err := ws.ReadMessage()
+			mt, msg, err := conn.ReadMessage()
 			if err != nil {
-				return
+				if conn = reconnect(conn, err); conn == nil {
+					return
+				}
+				continue
 			}
+			_ = conn.SetReadDeadline(time.Now().Add(wsDeadAfterPings * cs.opts.wsKeepalive))
 			if mt != websocket.TextMessage {
 				continue
 			}
@@ -1427,11 +2313,38 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 			if err := json.Unmarshal(msg, &m); err != nil {
 				continue
 			}
-			if m.Type != "streamAudio" {
+			if tr != nil && m.Type != "streamAudio" {
+				tr.message(m.Type, msg)
+			}
+			switch m.Type {
+			case "sendDtmf":
+				sendDtmf(logger, st, cs, dtmfOut, m.Digits, m.DurationMs)
+				continue
+			case "killAudio", "clearAudio", "clear", "interrupt":
+				// The backend interrupted itself (e.g. its own turn detection heard the caller).
+				flushPlayback()
+				logger.Printf("ws stream: playback flushed by backend %q (call-id=%s)", m.Type, cs.callID)
+				continue
+			case "streamAudio":
+			default:
 				continue
 			}
+			mu.Lock()
+			drop := bargedIn
+			restart := aiRestart && !drop
+			if restart {
+				aiRestart = false
+			}
+			mu.Unlock()
+			if drop {
+				continue
+			}
+			if restart {
+				aiConv = resample.NewConverter(playRate)
+				aiDsp = newDSPChain(cs.opts.dspDownlink, playRate)
+			}
 			typ := strings.ToLower(strings.TrimSpace(m.Data.AudioDataType))
-			var pcm8k []int16
+			var pcmPlay []int16
 			switch typ {
 			case "wav":
 				wavBytes, err := base64.StdEncoding.DecodeString(m.Data.AudioData)
@@ -1445,10 +2358,7 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 				if m.Data.SampleRate > 0 {
 					rate = m.Data.SampleRate
 				}
-				if rate != 8000 {
-					continue
-				}
-				pcm8k = pcm
+				pcmPlay = aiConv.Process(pcm, rate)
 			case "pcm16le":
 				raw, err := base64.StdEncoding.DecodeString(m.Data.AudioData)
 				if err != nil || len(raw) < 2 {
@@ -1462,13 +2372,16 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 				for i := 0; i < len(in); i++ {
 					in[i] = int16(binary.LittleEndian.Uint16(raw[i*2 : i*2+2]))
 				}
-				pcm8k = downsampleTo8k(in, rate)
-				if len(pcm8k) == 0 {
+				pcmPlay = aiConv.Process(in, rate)
+				if len(pcmPlay) == 0 {
 					continue
 				}
 			default:
 				continue
 			}
+			if aiDsp != nil {
+				pcmPlay = aiDsp.process(pcmPlay)
+			}
 
 			// If this looks like Gemini (24k/16k), flush hold queue so AI starts immediately.
 			if !aiBegan && (m.Data.SampleRate >= 16000) {
@@ -1484,21 +2397,21 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 			if !aiLogged {
 				aiLogged = true
 				// rough RMS to catch "all zeros" problems
-				samples := len(pcm8k)
+				samples := len(pcmPlay)
 				n := samples
 				if n > 800 {
 					n = 800
 				}
 				var sumSq float64
 				for i := 0; i < n; i++ {
-					v := float64(pcm8k[i])
+					v := float64(pcmPlay[i])
 					sumSq += v * v
 				}
 				rms := 0.0
 				if n > 0 {
 					rms = (sumSq / float64(n))
 				}
-				logger.Printf("ws stream: ai audio in type=%s rate=%d samples8k=%d rms≈%.0f", typ, m.Data.SampleRate, len(pcm8k), rms)
+				logger.Printf("ws stream: ai audio in type=%s rate=%d samples=%d playRate=%d rms≈%.0f", typ, m.Data.SampleRate, len(pcmPlay), playRate, rms)
 			}
 
 			// wait for RTP remote addr (learned from inbound RTP)
@@ -1512,7 +2425,7 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 					break
 				}
 				select {
-				case <-cs.stopCh:
+				case <-done:
 					return
 				case <-time.After(10 * time.Millisecond):
 				}
@@ -1525,14 +2438,14 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 			// Never silently drop whole chunks (causes missing words).
 			// If queue is full, drop one older chunk to make room and log once in a while.
 			select {
-			case playQ <- pcm8k:
+			case playQ <- pcmPlay:
 			default:
 				select {
 				case <-playQ:
 				default:
 				}
 				select {
-				case playQ <- pcm8k:
+				case playQ <- pcmPlay:
 				case <-time.After(20 * time.Millisecond):
 					// give up; better to drop than block websocket read forever
 					logger.Printf("ws stream: playback queue full, dropping chunk (ext=%s call-id=%s)", cs.extID, cs.callID)
@@ -1541,14 +2454,201 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 		}
 	}()
 
-	buf := make([]byte, 2048)
+	var inband *inbandDtmfDetector
+	if cs.opts.inbandDtmf {
+		inband = newInbandDtmfDetector()
+	}
+	var bargeVad *vad
+	if cs.opts.bargeIn {
+		bargeVad = newVAD(newVadConfig(cs.opts.bargeInSensitivity, cs.opts.bargeInHangover))
+	}
+	var speech *speechTracker
+	if cs.opts.vadMode != vadModeOff {
+		speech = newSpeechTracker(cs.callID, cs.opts)
+	}
+	dec := newRtpDecoder(cs.codecs)
+	// Caller audio at the echo canceller's rate, at 8 kHz (silence guard, in-band DTMF, barge-in)
+	// and at the uplink rate.
+	toAec, to8k, toUp := resample.NewConverter(refConv.OutRate), resample.NewConverter(8000), resample.NewConverter(upRate)
+
+	// Caller RTP goes through the jitter buffer; the playout goroutine decodes, conceals losses
+	// and streams the audio to the backend at a steady pace.
+	jb := newJitterBuffer(cs.opts.jitterMin, cs.opts.jitterMax)
+	defer func() {
+		logger.Printf("ws stream: jitter buffer (call-id=%s) %s", cs.callID, jb.snapshot())
+	}()
+	go func() {
+		var (
+			plc      *plcState
+			cnRx     *comfortNoise // set from the caller's last CN packet until its audio resumes
+			upDsp    *dspChain
+			recConv  = resample.NewConverter(playRate)
+			lastPT   uint8
+			frameLen int
+			sent     uint64
+		)
+		// forward sends one frame of caller audio (real or concealed) to the backend. Frames are
+		// dropped while it is reconnecting.
+		forward := func(pcm []int16, rate int, real bool) {
+			if rec != nil {
+				rec.write(recCaller, recConv.Process(pcm, rate))
+			}
+			if aec != nil {
+				pcm, rate = aec.process(toAec.Process(pcm, rate), real), aec.rate
+			}
+			if cs.opts.dspUplink != dspOff {
+				if upDsp == nil || upDsp.rate != rate {
+					upDsp = newDSPChain(cs.opts.dspUplink, rate)
+				}
+				pcm = upDsp.process(pcm)
+			}
+			pcm8k := to8k.Process(pcm, rate)
+			vadPcm := pcm8k
+			if !real {
+				vadPcm = nil
+			}
+			if real {
+				cs.noteCallerAudio(pcm8k)
+				if bargeVad != nil {
+					switch ev, _ := bargeVad.process(pcm8k, 8000); ev {
+					case vadSpeechStart:
+						mu.Lock()
+						interrupt := aiPlaying
+						bargedIn = interrupt
+						mu.Unlock()
+						if interrupt {
+							flushPlayback()
+							_ = wsw.writeJSON(bargeInMsg(cs))
+							logger.Printf("ws stream: barge-in, playback flushed (call-id=%s)", cs.callID)
+						}
+					case vadSpeechEnd:
+						mu.Lock()
+						bargedIn = false
+						mu.Unlock()
+					}
+				}
+				if inband != nil && cs.detectInbandDtmf(logger, inband, pcm8k) {
+					pcm = make([]int16, len(pcm))
+				}
+			}
+			pcmUp := toUp.Process(pcm, rate)
+
+			// Convert to little-endian bytes.
+			out := make([]byte, len(pcmUp)*2)
+			for i, s := range pcmUp {
+				off := i * 2
+				out[off] = byte(s)
+				out[off+1] = byte(uint16(s) >> 8)
+			}
+			frames := [][]byte{out}
+			if speech != nil {
+				var events []map[string]any
+				events, frames = speech.frame(vadPcm, out, time.Duration(len(pcm))*time.Second/time.Duration(rate))
+				for _, ev := range events {
+					_ = wsw.writeJSON(ev)
+				}
+			}
+			for _, f := range frames {
+				if err := wsw.write(websocket.BinaryMessage, f); err != nil {
+					continue
+				}
+				sent++
+				if sent == 1 {
+					logger.Printf("ws stream: first pcm frame bytes=%d pt=%d", len(f), lastPT)
+				}
+			}
+		}
+
+		// comfort sends d of noise at the level of the caller's CN packet.
+		comfort := func(d time.Duration) {
+			forward(cnRx.generate(int(d*time.Duration(cnRx.rate)/time.Second)), cnRx.rate, false)
+		}
+
+		report := time.NewTicker(30 * time.Second)
+		defer report.Stop()
+		var reported uint64
+		next := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-report.C:
+				if s := jb.snapshot(); s.received != reported {
+					reported = s.received
+					logger.Printf("ws stream: jitter buffer (call-id=%s) %s", cs.callID, s)
+					if aec != nil {
+						logger.Printf("ws stream: echo canceller (call-id=%s) %s", cs.callID, aec.snapshot())
+					}
+				}
+				continue
+			case <-time.After(time.Until(next)):
+			}
+
+			p, res := jb.pop()
+			switch res {
+			case jbWait:
+				if cnRx == nil {
+					next = time.Now().Add(5 * time.Millisecond)
+					continue
+				}
+				// The caller sends nothing while silent after CN: keep the backend's stream going.
+				next = next.Add(defaultFrameDur)
+				comfort(defaultFrameDur)
+			case jbLost:
+				next = next.Add(jb.frameDur())
+				if cnRx != nil {
+					comfort(jb.frameDur())
+					break
+				}
+				// Opus rebuilds the gap itself (FEC/PLC) when the next packet is decoded.
+				if plc == nil || dec.concealsLoss(lastPT) {
+					continue
+				}
+				forward(plc.conceal(frameLen), plc.rate, false)
+			case jbPacket:
+				if cs.isComfortNoise(p.PayloadType) {
+					// RFC 3389 SID: noise at its level, at the rate of the caller's audio.
+					rate := 8000
+					if plc != nil {
+						rate = plc.rate
+					}
+					if cnRx == nil || cnRx.rate != rate {
+						cnRx = newComfortNoise(rate)
+					}
+					cnRx.setSID(p.Payload)
+					next = next.Add(defaultFrameDur)
+					comfort(defaultFrameDur)
+					break
+				}
+				cnRx = nil
+				// Decode RTP payload to PCM16 (8k for G.711, 16k for G.722, 24k for Opus, L16 at its own rate).
+				pcm, rate := dec.decode(p)
+				if len(pcm) == 0 {
+					next = next.Add(jb.frameDur())
+					continue
+				}
+				next = next.Add(time.Duration(len(pcm)) * time.Second / time.Duration(rate))
+				if plc == nil || plc.rate != rate {
+					plc = newPLC(rate)
+				}
+				lastPT, frameLen = p.PayloadType, len(pcm)
+				forward(plc.good(pcm), rate, true)
+			}
+			// After a stall don't burst to catch up; the buffer absorbs it.
+			if now := time.Now(); now.Sub(next) > 100*time.Millisecond {
+				next = now
+			}
+		}
+	}()
+
+	buf := make([]byte, 4096)
 	var p rtp.Packet
 
 	for {
 		_ = cs.rtp.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
 		n, addr, err := cs.rtp.ReadFrom(buf)
 		select {
-		case <-cs.stopCh:
+		case <-done:
 			return
 		default:
 		}
@@ -1565,58 +2665,89 @@ func runRTPWsStreamCall(logger *log.Logger, cs *callSession, wsURL string) {
 		lastAddr = addr
 		rx++
 		mu.Unlock()
-		pt := p.PayloadType
-		payload := p.Payload
-		if len(payload) == 0 {
+		cs.markRtp()
+		if len(p.Payload) == 0 {
 			continue
 		}
-
-		// Decode RTP payload to PCM16 @ 8k.
-		var pcm8k []int16
-		switch pt {
-		case 0: // PCMU
-			pcm8k = make([]int16, len(payload))
-			for i, b := range payload {
-				pcm8k[i] = muLawToLinear(b)
-			}
-		case 8: // PCMA
-			pcm8k = make([]int16, len(payload))
-			for i, b := range payload {
-				pcm8k[i] = aLawToLinear(b)
-			}
-		default:
+		if cs.handleTelephoneEvent(logger, &p) {
+			continue
+		}
+		clock := cs.rtpClock(dec, p.PayloadType)
+		if clock == 0 {
 			// Unsupported codec; ignore.
 			continue
 		}
+		jb.push(&p, clock, time.Now())
+	}
+}
 
-		// Upsample 8k -> 16k by simple duplication (good enough for voice).
-		pcm16k := make([]int16, len(pcm8k)*2)
-		for i, s := range pcm8k {
-			j := i * 2
-			pcm16k[j] = s
-			pcm16k[j+1] = s
-		}
+// wsWriter serializes writes to the backend WebSocket; gorilla allows only one concurrent writer.
+type wsWriter struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
 
-		// Convert to little-endian bytes.
-		out := make([]byte, len(pcm16k)*2)
-		for i, s := range pcm16k {
-			off := i * 2
-			out[off] = byte(s)
-			out[off+1] = byte(uint16(s) >> 8)
-		}
+// While the backend is reconnecting writes are dropped (errWsDown). A failed write closes the
+// connection, so the reader notices and reconnects.
+func (w *wsWriter) write(mt int, b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ws == nil {
+		return errWsDown
+	}
+	_ = w.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := w.ws.WriteMessage(mt, b); err != nil {
+		_ = w.ws.Close()
+		w.ws = nil
+		return err
+	}
+	return nil
+}
 
-		if err := ws.WriteMessage(websocket.BinaryMessage, out); err != nil {
-			return
-		}
-		if rx == 1 {
-			logger.Printf("ws stream: first pcm frame bytes=%d pt=%d", len(out), pt)
-		}
+func (w *wsWriter) writeJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
+	return w.write(websocket.TextMessage, b)
+}
+
+// closeWsSession tells the backend why the call ended and closes the WebSocket with a normal close frame.
+func closeWsSession(w *wsWriter, cs *callSession) {
+	reason := cs.hangupReason()
+	if reason == "" {
+		reason = "call ended"
+	}
+	msg := map[string]any{
+		"type":   "hangup",
+		"callId": cs.callID,
+		"reason": reason,
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ws := w.ws
+	if ws == nil {
+		return
+	}
+	w.ws = nil
+	if b, err := json.Marshal(msg); err == nil {
+		_ = ws.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = ws.WriteMessage(websocket.TextMessage, b)
+	}
+	// Close reason must fit in a control frame (125 bytes incl. 2-byte code).
+	if len(reason) > 120 {
+		reason = reason[:120]
+	}
+	_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(time.Second))
+	_ = ws.Close()
 }
 
 type wsStreamMsg struct {
 	Type string `json:"type"`
-	Data struct {
+	// sendDtmf
+	Digits     string `json:"digits"`
+	DurationMs int    `json:"durationMs"`
+	Data       struct {
 		AudioDataType string `json:"audioDataType"`
 		SampleRate    int    `json:"sampleRate"`
 		AudioData     string `json:"audioData"`
@@ -1647,52 +2778,8 @@ func wavToPCM16Mono(wav []byte) ([]int16, int, error) {
 	return out, sampleRate, nil
 }
 
-func downsampleTo8k(in []int16, inRate int) []int16 {
-	// Generic linear-resampler to 8k for speech.
-	// Handles any reasonable Gemini output rate (8k..48k) without aliasing.
-	if inRate <= 0 {
-		return nil
-	}
-	if inRate == 8000 {
-		out := make([]int16, len(in))
-		copy(out, in)
-		return out
-	}
-	if inRate < 8000 || inRate > 48000 {
-		return nil
-	}
-	if len(in) < 2 {
-		return nil
-	}
-	outLen := (len(in) * 8000) / inRate
-	if outLen < 1 {
-		outLen = 1
-	}
-	out := make([]int16, outLen)
-	step := float64(inRate) / 8000.0
-	for i := 0; i < outLen; i++ {
-		pos := float64(i) * step
-		idx := int(pos)
-		if idx >= len(in)-1 {
-			out[i] = in[len(in)-1]
-			continue
-		}
-		frac := pos - float64(idx)
-		a := float64(in[idx])
-		b := float64(in[idx+1])
-		v := a + (b-a)*frac
-		if v > 32767 {
-			v = 32767
-		} else if v < -32768 {
-			v = -32768
-		}
-		out[i] = int16(v)
-	}
-	return out
-}
-
-func sendPcm8kToRtpPcmu(cs *callSession, addr net.Addr, pcm8k []int16, ssrc uint32, seq uint16, ts uint32) (uint16, uint32) {
-	// 20ms @ 8k = 160 samples
+func sendPcm8kToRtp(cs *callSession, enc *rtpEncoder, addr net.Addr, pcm8k []int16, ssrc uint32, seq uint16, ts uint32) (uint16, uint32) {
+	// 20ms @ 8k = 160 samples, sent in the negotiated codec
 	const frameSamples = 160
 
 	firstPkt := true
@@ -1702,28 +2789,27 @@ func sendPcm8kToRtpPcmu(cs *callSession, addr net.Addr, pcm8k []int16, ssrc uint
 			return seq, ts
 		default:
 		}
-		payload := make([]byte, frameSamples)
-		for i := 0; i < frameSamples; i++ {
-			payload[i] = linearToMuLaw(pcm8k[off+i])
-		}
-		p := rtp.Packet{
-			Header: rtp.Header{
-				Version:        2,
-				Marker:         firstPkt,
-				PayloadType:    0, // PCMU
-				SequenceNumber: seq,
-				Timestamp:      ts,
-				SSRC:           ssrc,
-			},
-			Payload: payload,
-		}
-		firstPkt = false
-		raw, err := p.Marshal()
-		if err == nil {
-			_, _ = cs.rtp.WriteTo(raw, addr)
+		payload := enc.encode8k(pcm8k[off : off+frameSamples])
+		if payload != nil {
+			p := rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Marker:         firstPkt,
+					PayloadType:    enc.pt(),
+					SequenceNumber: seq,
+					Timestamp:      ts,
+					SSRC:           ssrc,
+				},
+				Payload: payload,
+			}
+			firstPkt = false
+			raw, err := p.Marshal()
+			if err == nil {
+				_, _ = cs.rtp.WriteTo(raw, addr)
+			}
+			seq++
 		}
-		seq++
-		ts += frameSamples
+		ts += uint32(enc.frameTicks())
 		time.Sleep(20 * time.Millisecond)
 	}
 	return seq, ts
@@ -1758,6 +2844,30 @@ func linearToMuLaw(sample int16) byte {
 	return u
 }
 
+func linearToALaw(sample int16) byte {
+	// Linear PCM16 to G.711 A-law (13-bit magnitude, even bits inverted)
+	s := int(sample) >> 3
+	mask := 0xD5
+	if s < 0 {
+		mask = 0x55
+		s = -s - 1
+	}
+	seg := 0
+	for end := 0x1F; seg < 8 && s > end; end = end<<1 | 1 {
+		seg++
+	}
+	if seg >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	a := seg << 4
+	if seg < 2 {
+		a |= (s >> 1) & 0x0F
+	} else {
+		a |= (s >> seg) & 0x0F
+	}
+	return byte(a ^ mask)
+}
+
 func genBeepPcm8k(freqHz int, ms int) []int16 {
 	// Square-ish beep (no floats) - enough to validate downlink RTP audio.
 	if freqHz <= 0 || ms <= 0 {
@@ -1784,11 +2894,12 @@ func genBeepPcm8k(freqHz int, ms int) []int16 {
 }
 
 func runRTPFallbackToneCall(logger *log.Logger, cs *callSession) {
-	// Fallback when WS is unavailable or resets: keep RTP flowing so endpoints don't hang up
-	// after ~30s of perceived "no media".
+	// Hold loop of the "hold" fallback policy (AI backend unavailable): keep RTP flowing so endpoints
+	// don't hang up after ~30s of perceived "no media".
 	//
-	// We send 20ms PCMU frames to the RTP peer we learn from inbound packets.
+	// We send 20ms frames in the negotiated codec to the RTP peer we learn from inbound packets.
 	// (FreeSWITCH will always send us RTP; we learn the addr quickly.)
+	enc := cs.newEncoder(logger)
 	playSSRC := rand.Uint32()
 	playSeq := uint16(rand.Uint32())
 	playTS := uint32(rand.Uint32())
@@ -1802,6 +2913,15 @@ func runRTPFallbackToneCall(logger *log.Logger, cs *callSession) {
 		lastAddr = cs.remoteRtp
 	}
 
+	// A digit restarts the beep cycle, so the caller hears the key press was received.
+	digit := make(chan struct{}, 1)
+	go cs.watchDtmf(logger, nil, func(dtmfEvent) {
+		select {
+		case digit <- struct{}{}:
+		default:
+		}
+	})
+
 	// Sender: 20ms pacing, beep bursts.
 	go func() {
 		t := time.NewTicker(20 * time.Millisecond)
@@ -1817,6 +2937,9 @@ func runRTPFallbackToneCall(logger *log.Logger, cs *callSession) {
 			select {
 			case <-cs.stopCh:
 				return
+			case <-digit:
+				cyclePos = 0
+				beepOff = 0
 			case <-t.C:
 				mu.Lock()
 				addr := lastAddr
@@ -1845,18 +2968,19 @@ func runRTPFallbackToneCall(logger *log.Logger, cs *callSession) {
 					beepOff = 0
 				}
 
-				payload := make([]byte, frameSamples)
-				for i := 0; i < frameSamples; i++ {
-					payload[i] = linearToMuLaw(pcm[i])
+				payload := enc.encode8k(pcm)
+				ts := playTS
+				playTS += uint32(enc.frameTicks())
+				if payload == nil {
+					continue
 				}
-
 				p := rtp.Packet{
 					Header: rtp.Header{
 						Version:        2,
 						Marker:         false,
-						PayloadType:    0, // PCMU
+						PayloadType:    enc.pt(),
 						SequenceNumber: playSeq,
-						Timestamp:      playTS,
+						Timestamp:      ts,
 						SSRC:           playSSRC,
 					},
 					Payload: payload,
@@ -1866,13 +2990,13 @@ func runRTPFallbackToneCall(logger *log.Logger, cs *callSession) {
 					_, _ = cs.rtp.WriteTo(raw, addr)
 				}
 				playSeq++
-				playTS += frameSamples
 			}
 		}
 	}()
 
 	// Receiver: learn RTP peer addr and keep consuming inbound.
-	buf := make([]byte, 2048)
+	dec := newRtpDecoder(cs.codecs)
+	buf := make([]byte, 4096)
 	var p rtp.Packet
 	var logged bool
 	for {
@@ -1895,6 +3019,10 @@ func runRTPFallbackToneCall(logger *log.Logger, cs *callSession) {
 		mu.Lock()
 		lastAddr = addr
 		mu.Unlock()
+		cs.markRtp()
+		if !cs.handleTelephoneEvent(logger, &p) {
+			cs.noteCallerAudio(dec.decode8k(&p))
+		}
 		if !logged {
 			logged = true
 			logger.Printf("ws stream: fallback tone active (ext=%s call-id=%s rtp-peer=%s)", cs.extID, cs.callID, addr.String())
@@ -1934,9 +3062,27 @@ func aLawToLinear(a byte) int16 {
 	return int16(sample)
 }
 
+// decodeG711 decodes a PCMU/PCMA payload to PCM16 @ 8k; nil for any other payload type.
+func decodeG711(pt uint8, payload []byte) []int16 {
+	var dec func(byte) int16
+	switch pt {
+	case 0: // PCMU
+		dec = muLawToLinear
+	case 8: // PCMA
+		dec = aLawToLinear
+	default:
+		return nil
+	}
+	out := make([]int16, len(payload))
+	for i, b := range payload {
+		out[i] = dec(b)
+	}
+	return out
+}
+
 func runRTPDrainCall(logger *log.Logger, cs *callSession) {
 	// AI mode placeholder: we currently just read RTP and do not echo it back.
-	buf := make([]byte, 2048)
+	buf := make([]byte, 4096)
 	var p rtp.Packet
 
 	var (
@@ -1985,5 +3131,6 @@ func runRTPDrainCall(logger *log.Logger, cs *callSession) {
 		lastPT = p.PayloadType
 		rx++
 		mu.Unlock()
+		cs.markRtp()
 	}
 }
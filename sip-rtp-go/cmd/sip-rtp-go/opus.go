@@ -0,0 +1,132 @@
+//go:build opus
+
+package main
+
+// Opus via libopus (cgo). Built only with -tags opus, since it needs libopus and its headers
+// (pkg-config opus); without the tag Opus is simply not offered (see opus_stub.go).
+
+/*
+#cgo pkg-config: opus
+#include <opus.h>
+
+// opus_*_ctl are variadic, which cgo can't call directly.
+static int sip_opus_enc_setup(OpusEncoder *e, int fec, int dtx, int lossPct) {
+	int err = opus_encoder_ctl(e, OPUS_SET_SIGNAL(OPUS_SIGNAL_VOICE));
+	if (err == OPUS_OK) err = opus_encoder_ctl(e, OPUS_SET_INBAND_FEC(fec));
+	if (err == OPUS_OK) err = opus_encoder_ctl(e, OPUS_SET_PACKET_LOSS_PERC(lossPct));
+	if (err == OPUS_OK) err = opus_encoder_ctl(e, OPUS_SET_DTX(dtx));
+	return err;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+const opusAvailable = true
+
+// opusEncoder encodes mono PCM16 frames; state carries across frames.
+type opusEncoder struct {
+	st  *C.OpusEncoder
+	dtx bool
+	buf []byte
+}
+
+func newOpusEncoder(sampleRate int, fec, dtx bool) (*opusEncoder, error) {
+	var cerr C.int
+	st := C.opus_encoder_create(C.opus_int32(sampleRate), 1, C.OPUS_APPLICATION_VOIP, &cerr)
+	if cerr != C.OPUS_OK || st == nil {
+		return nil, fmt.Errorf("opus encoder: %s", C.GoString(C.opus_strerror(cerr)))
+	}
+	loss := 0
+	if fec {
+		// FEC is only added when the encoder expects losses.
+		loss = opusExpectedLossPct
+	}
+	if cerr = C.sip_opus_enc_setup(st, cBool(fec), cBool(dtx), C.int(loss)); cerr != C.OPUS_OK {
+		C.opus_encoder_destroy(st)
+		return nil, fmt.Errorf("opus encoder setup: %s", C.GoString(C.opus_strerror(cerr)))
+	}
+	e := &opusEncoder{st: st, dtx: dtx, buf: make([]byte, opusMaxPacket)}
+	runtime.SetFinalizer(e, func(e *opusEncoder) { C.opus_encoder_destroy(e.st) })
+	return e, nil
+}
+
+// encode codes one frame (2.5-60 ms of audio). It returns nil for frames DTX leaves out.
+func (e *opusEncoder) encode(pcm []int16) []byte {
+	if len(pcm) == 0 {
+		return nil
+	}
+	n := C.opus_encode(e.st, (*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)),
+		(*C.uchar)(unsafe.Pointer(&e.buf[0])), C.opus_int32(len(e.buf)))
+	if n < 0 {
+		return nil
+	}
+	// With DTX a 1-2 byte packet means "nothing new": it need not be sent (RFC 7587 §3.1.3).
+	if e.dtx && n <= 2 {
+		return nil
+	}
+	return append([]byte(nil), e.buf[:n]...)
+}
+
+// opusDecoder decodes Opus (mono or stereo, downmixed) to mono PCM16 at its sample rate.
+type opusDecoder struct {
+	st   *C.OpusDecoder
+	rate int
+	fec  bool
+	buf  []int16
+}
+
+func newOpusDecoder(sampleRate int, fec bool) (*opusDecoder, error) {
+	var cerr C.int
+	st := C.opus_decoder_create(C.opus_int32(sampleRate), 1, &cerr)
+	if cerr != C.OPUS_OK || st == nil {
+		return nil, fmt.Errorf("opus decoder: %s", C.GoString(C.opus_strerror(cerr)))
+	}
+	// 120 ms is the longest Opus packet.
+	d := &opusDecoder{st: st, rate: sampleRate, fec: fec, buf: make([]int16, sampleRate*120/1000)}
+	runtime.SetFinalizer(d, func(d *opusDecoder) { C.opus_decoder_destroy(d.st) })
+	return d, nil
+}
+
+func (d *opusDecoder) decode(payload []byte) []int16 {
+	return d.run(payload, len(d.buf), false)
+}
+
+// decodeLost rebuilds lost frames of samples each before next arrives: the last one from next's
+// in-band FEC data when enabled, the others by packet loss concealment.
+func (d *opusDecoder) decodeLost(next []byte, lost, samples int) []int16 {
+	var out []int16
+	for i := 0; i < lost; i++ {
+		if i == lost-1 && d.fec && len(next) > 0 {
+			out = append(out, d.run(next, samples, true)...)
+		} else {
+			out = append(out, d.run(nil, samples, false)...)
+		}
+	}
+	return out
+}
+
+func (d *opusDecoder) run(payload []byte, samples int, fec bool) []int16 {
+	samples = min(samples, len(d.buf))
+	var data *C.uchar
+	if len(payload) > 0 {
+		data = (*C.uchar)(unsafe.Pointer(&payload[0]))
+	}
+	n := C.opus_decode(d.st, data, C.opus_int32(len(payload)),
+		(*C.opus_int16)(unsafe.Pointer(&d.buf[0])), C.int(samples), cBool(fec))
+	if n <= 0 {
+		return nil
+	}
+	return append([]int16(nil), d.buf[:n]...)
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,28 @@
+//go:build !opus
+
+package main
+
+import "errors"
+
+// Without -tags opus there is no Opus implementation and the codec is not offered.
+const opusAvailable = false
+
+var errOpusUnavailable = errors.New("opus: not built in (build with -tags opus)")
+
+type opusEncoder struct{}
+
+func newOpusEncoder(sampleRate int, fec, dtx bool) (*opusEncoder, error) {
+	return nil, errOpusUnavailable
+}
+
+func (e *opusEncoder) encode(pcm []int16) []byte { return nil }
+
+type opusDecoder struct{}
+
+func newOpusDecoder(sampleRate int, fec bool) (*opusDecoder, error) {
+	return nil, errOpusUnavailable
+}
+
+func (d *opusDecoder) decode(payload []byte) []int16 { return nil }
+
+func (d *opusDecoder) decodeLost(next []byte, lost, samples int) []int16 { return nil }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultMessageIdleTimeout = 5 * time.Minute
+	// MESSAGE transactions remembered per session to spot UDP retransmissions.
+	pagerSeenMax = 32
+)
+
+// pagerSession is one pager-mode (RFC 3428 MESSAGE) text conversation between a sender and an agent.
+// Incoming MESSAGEs go to the agent's backend over a text-only WebSocket session; replies come back
+// as MESSAGE requests to the sender. In echo mode (no backend URL) texts are echoed back.
+type pagerSession struct {
+	key   string
+	agent agentRuntime
+	from  string // sender URI
+	// Out-of-dialog "conversation": fixed Call-ID/From-tag, a fresh CSeq per MESSAGE we send.
+	dlg *sipDialog
+
+	ready   chan struct{} // closed once the backend is connected (or the dial failed)
+	openErr error
+	ws      *websocket.Conn // nil in echo mode
+	wsMu    sync.Mutex
+
+	mu         sync.Mutex
+	lastActive time.Time
+	seen       []string // Call-ID+CSeq of the last MESSAGEs forwarded (UDP retransmissions), oldest first
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// wsTextMsg is a text event to/from the backend on a pager session.
+type wsTextMsg struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	From        string `json:"from,omitempty"`
+	To          string `json:"to,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+func handleMessage(logger *log.Logger, conn net.PacketConn, addr net.Addr, m sipMsg, c cfg, st *runtimeState) {
+	extID := parseToUser(m)
+	st.mu.RLock()
+	agent, ok := st.agentByUser[extID]
+	contactHost := st.sipContactHost
+	st.mu.RUnlock()
+	if extID == "" || !ok || !agent.enabled {
+		sendSIPResponse(conn, addr, m, "", "", 404, "Not Found", nil, nil)
+		return
+	}
+	ct := strings.ToLower(strings.TrimSpace(m.header("content-type")))
+	if ct != "" && !strings.HasPrefix(ct, "text/") {
+		sendSIPResponse(conn, addr, m, "", "", 415, "Unsupported Media Type", map[string][]string{
+			"Accept": {"text/plain"},
+		}, nil)
+		return
+	}
+
+	fromURI := extractURI(m.header("from"))
+	text := string(m.body)
+	logger.Printf("sip recv: MESSAGE ext=%s from=%s bytes=%d", extID, fromURI, len(m.body))
+	if strings.TrimSpace(contactHost) == "" {
+		contactHost = detectLocalIPv4()
+	}
+
+	// The 202 waits until the text is with the backend, so the sender learns when it isn't.
+	ps, err := getPagerSession(logger, conn, addr, c, st, agent, fromURI, contactHost)
+	if err != nil {
+		logger.Printf("pager: ext=%s from=%s: %v", extID, fromURI, err)
+		sendSIPResponse(conn, addr, m, "", "", 503, "Service Unavailable", nil, nil)
+		return
+	}
+	if !ps.markSeen(m.header("call-id") + " " + m.header("cseq")) {
+		sendSIPResponse(conn, addr, m, "", "", 202, "Accepted", nil, nil)
+		return
+	}
+	if ps.ws == nil {
+		sendSIPResponse(conn, addr, m, "", "", 202, "Accepted", nil, nil)
+		go ps.sendMessage(logger, st, text)
+		return
+	}
+	if err := ps.writeJSON(wsTextMsg{Type: "textMessage", Text: text, From: fromURI, To: extID, ContentType: ct}); err != nil {
+		logger.Printf("pager: ws write failed (ext=%s from=%s): %v", extID, fromURI, err)
+		ps.close(st, "ws write failed")
+		sendSIPResponse(conn, addr, m, "", "", 480, "Temporarily Unavailable", nil, nil)
+		return
+	}
+	sendSIPResponse(conn, addr, m, "", "", 202, "Accepted", nil, nil)
+}
+
+func getPagerSession(logger *log.Logger, conn net.PacketConn, addr net.Addr, c cfg, st *runtimeState, agent agentRuntime, fromURI, contactHost string) (*pagerSession, error) {
+	key := agent.user + "|" + fromURI
+	st.mu.Lock()
+	ps := st.pagers[key]
+	created := ps == nil
+	if created {
+		_, sipListenPort, _ := net.SplitHostPort(c.sipListenAddr)
+		ps = &pagerSession{
+			key:        key,
+			agent:      agent,
+			from:       fromURI,
+			ready:      make(chan struct{}),
+			lastActive: time.Now(),
+			done:       make(chan struct{}),
+			dlg: &sipDialog{
+				conn:         conn,
+				peer:         addr,
+				callID:       fmt.Sprintf("%s@%s", randHex(16), contactHost),
+				localURI:     fmt.Sprintf("<sip:%s@%s>;tag=%s", agent.user, agent.sipDomain, randHex(10)),
+				remoteURI:    "<" + fromURI + ">",
+				remoteTarget: fromURI,
+				viaHost:      contactHost,
+				viaPort:      sipListenPort,
+				cseq:         1,
+			},
+		}
+		st.pagers[key] = ps
+	}
+	st.mu.Unlock()
+
+	if !created {
+		<-ps.ready
+		if ps.openErr != nil {
+			return nil, ps.openErr
+		}
+		ps.mu.Lock()
+		ps.lastActive = time.Now()
+		ps.mu.Unlock()
+		return ps, nil
+	}
+
+	// First message of the conversation: connect the backend and start the idle watcher.
+	defer close(ps.ready)
+	wsURL := firstNonEmpty(agent.opts.messageSocketURL, agent.geminiSocketURL)
+	if wsURL != "" {
+		// Bounded well inside the MESSAGE transaction timeout: the sender is waiting for our answer.
+		ctx, cancel := context.WithTimeout(context.Background(), wsDialTimeout)
+		ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+		cancel()
+		if err != nil {
+			ps.openErr = fmt.Errorf("ws dial %q: %w", wsURL, err)
+			ps.close(st, "ws dial failed")
+			return nil, ps.openErr
+		}
+		ps.ws = ws
+		meta := map[string]any{
+			"source":    "sip-rtp-go",
+			"channel":   "text",
+			"sessionId": ps.dlg.callID,
+			"extension": agent.user,
+			"from":      fromURI,
+		}
+		if err := ps.writeJSON(meta); err != nil {
+			ps.openErr = fmt.Errorf("ws meta: %w", err)
+			ps.close(st, "ws write failed")
+			return nil, ps.openErr
+		}
+		go ps.readBackend(logger, st)
+		logger.Printf("pager: session opened ext=%s from=%s ws=%q", agent.user, fromURI, wsURL)
+	} else {
+		logger.Printf("pager: session opened ext=%s from=%s mode=echo", agent.user, fromURI)
+	}
+	go ps.watchIdle(logger, st)
+	return ps, nil
+}
+
+// markSeen records a MESSAGE transaction; false means it is a retransmission we already forwarded.
+func (ps *pagerSession) markSeen(id string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, s := range ps.seen {
+		if s == id {
+			return false
+		}
+	}
+	if len(ps.seen) >= pagerSeenMax {
+		ps.seen = append(ps.seen[:0], ps.seen[1:]...)
+	}
+	ps.seen = append(ps.seen, id)
+	return true
+}
+
+func (ps *pagerSession) writeJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	ps.wsMu.Lock()
+	defer ps.wsMu.Unlock()
+	_ = ps.ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return ps.ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// readBackend relays backend text replies to the sender as MESSAGE requests.
+func (ps *pagerSession) readBackend(logger *log.Logger, st *runtimeState) {
+	for {
+		mt, msg, err := ps.ws.ReadMessage()
+		if err != nil {
+			ps.close(st, "backend disconnected")
+			return
+		}
+		if mt != websocket.TextMessage {
+			continue
+		}
+		var m wsTextMsg
+		if err := json.Unmarshal(msg, &m); err != nil {
+			continue
+		}
+		switch m.Type {
+		case "textMessage", "message", "text":
+			if strings.TrimSpace(m.Text) == "" {
+				continue
+			}
+			ps.mu.Lock()
+			ps.lastActive = time.Now()
+			ps.mu.Unlock()
+			go ps.sendMessage(logger, st, m.Text)
+		case "hangup", "end":
+			ps.close(st, "backend hangup")
+			return
+		}
+	}
+}
+
+func (ps *pagerSession) sendMessage(logger *log.Logger, st *runtimeState, text string) {
+	resp, err := ps.dlg.sendRequestAuth(st, "MESSAGE", map[string][]string{
+		"Content-Type": {"text/plain;charset=UTF-8"},
+	}, []byte(text), ps.agent.user, ps.agent.sipPass)
+	if err != nil {
+		logger.Printf("pager: MESSAGE to %s failed: %v", ps.from, err)
+		return
+	}
+	if resp.status >= 300 {
+		logger.Printf("pager: MESSAGE to %s got %d %s", ps.from, resp.status, resp.reason)
+	}
+}
+
+func (ps *pagerSession) watchIdle(logger *log.Logger, st *runtimeState) {
+	idle := ps.agent.opts.messageIdleTimeout
+	if idle <= 0 {
+		idle = defaultMessageIdleTimeout
+	}
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ps.done:
+			return
+		case now := <-t.C:
+			ps.mu.Lock()
+			last := ps.lastActive
+			ps.mu.Unlock()
+			if now.Sub(last) >= idle {
+				logger.Printf("pager: session idle, closing ext=%s from=%s", ps.agent.user, ps.from)
+				ps.close(st, "idle")
+				return
+			}
+		}
+	}
+}
+
+// close ends the session; reason goes to the backend in the hangup message and the close frame.
+func (ps *pagerSession) close(st *runtimeState, reason string) {
+	ps.closeOnce.Do(func() {
+		st.mu.Lock()
+		if st.pagers[ps.key] == ps {
+			delete(st.pagers, ps.key)
+		}
+		st.mu.Unlock()
+		close(ps.done)
+		if ps.ws != nil {
+			_ = ps.writeJSON(map[string]any{"type": "hangup", "sessionId": ps.dlg.callID, "reason": reason})
+			ps.wsMu.Lock()
+			_ = ps.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason), time.Now().Add(time.Second))
+			ps.wsMu.Unlock()
+			_ = ps.ws.Close()
+		}
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Retransmissions are spotted, and the set of remembered transactions stays bounded.
+func TestPagerMarkSeen(t *testing.T) {
+	ps := &pagerSession{}
+	id := func(i int) string { return fmt.Sprintf("call-%d 1 MESSAGE", i) }
+	for i := 0; i < 3*pagerSeenMax; i++ {
+		if !ps.markSeen(id(i)) {
+			t.Fatalf("new MESSAGE %d taken for a retransmission", i)
+		}
+		if ps.markSeen(id(i)) {
+			t.Fatalf("retransmission of MESSAGE %d forwarded again", i)
+		}
+	}
+	if len(ps.seen) != pagerSeenMax {
+		t.Errorf("%d transactions remembered, want %d", len(ps.seen), pagerSeenMax)
+	}
+	if ps.markSeen(id(3*pagerSeenMax - 1)) {
+		t.Error("latest MESSAGE forgotten")
+	}
+}
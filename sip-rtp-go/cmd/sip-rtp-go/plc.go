@@ -0,0 +1,158 @@
+package main
+
+import "math"
+
+// Packet loss concealment after ITU-T G.711 Appendix I, on decoded PCM at any rate (the constants
+// are the Appendix's 8 kHz values, scaled): a lost frame is rebuilt by repeating the last pitch
+// period of the history, widened to up to three periods as the erasure goes on, attenuated 20% per
+// 10 ms after the first 10 ms and muted after 60 ms. Joins are smoothed with overlap-adds.
+const (
+	plcHistMs   = 48.75 // 390 samples at 8 kHz: 3 periods of the lowest pitch plus overlap
+	plcPitchMin = 40    // 200 Hz, in 8 kHz samples
+	plcPitchMax = 120   // 66 Hz
+	plcCorrLen  = 160   // 20 ms correlation window
+	plcMuteMs   = 60
+)
+
+type plcState struct {
+	rate  int
+	scale float64 // samples per 8 kHz sample
+	hist  []float64
+
+	// Erasure in progress.
+	lost     int // samples concealed so far
+	pitch    int
+	pitchBuf []float64 // last 3 periods of the history when the erasure began
+	periods  int       // periods being repeated
+	pos      int       // read position in the repeated periods
+	fadeFrom int       // periods repeated before the last widening, faded out over fadeLeft samples
+	fadeLeft int
+}
+
+func newPLC(rate int) *plcState {
+	s := &plcState{rate: rate, scale: float64(rate) / 8000}
+	s.hist = make([]float64, int(plcHistMs*float64(rate)/1000))
+	return s
+}
+
+func (s *plcState) samples(n8k float64) int { return int(n8k * s.scale) }
+
+// good takes a received frame. The first one after an erasure is cross-faded from the synthetic
+// signal (4 ms, plus 4 ms per extra 10 ms lost, at most 10 ms).
+func (s *plcState) good(pcm []int16) []int16 {
+	if s.lost > 0 {
+		lostMs := s.lost * 1000 / s.rate
+		olaMs := min(4+4*max(lostMs/10-1, 0), 10)
+		n := min(s.rate*olaMs/1000, len(pcm))
+		synth := s.synth(n)
+		out := make([]int16, len(pcm))
+		copy(out, pcm)
+		for i := 0; i < n; i++ {
+			w := float64(i+1) / float64(n+1)
+			out[i] = sat16f(synth[i]*(1-w) + float64(pcm[i])*w)
+		}
+		pcm = out
+		s.lost = 0
+	}
+	s.remember(pcm)
+	return pcm
+}
+
+// conceal returns n samples standing in for a lost frame.
+func (s *plcState) conceal(n int) []int16 {
+	if s.lost == 0 {
+		s.pitch = s.findPitch()
+		s.pitchBuf = append(s.pitchBuf[:0], s.hist[len(s.hist)-3*s.pitch:]...)
+		s.periods = 1
+		s.pos = 0
+		s.fadeLeft = 0
+	}
+	synth := s.synth(n)
+	out := make([]int16, n)
+	for i, v := range synth {
+		out[i] = sat16f(v)
+	}
+	s.remember(out)
+	return out
+}
+
+// synth continues the synthetic signal by n samples.
+func (s *plcState) synth(n int) []float64 {
+	out := make([]float64, n)
+	tenMs := s.rate / 100
+	mute := s.rate * plcMuteMs / 1000
+	for i := range out {
+		at := s.lost + i
+		// Every 10 ms into the erasure repeat one more period (up to 3), cross-fading over
+		// a quarter period so the switch doesn't click.
+		if at > 0 && at%tenMs == 0 && s.periods < 3 {
+			s.fadeFrom, s.fadeLeft = s.periods, s.pitch/4
+			s.periods++
+		}
+		v := s.periodSample(s.periods, s.pos)
+		if s.fadeLeft > 0 {
+			q := s.pitch / 4
+			w := float64(q-s.fadeLeft+1) / float64(q+1)
+			v = s.periodSample(s.fadeFrom, s.pos)*(1-w) + v*w
+			s.fadeLeft--
+		}
+		s.pos++
+
+		gain := 1.0
+		if at >= mute {
+			gain = 0
+		} else if at >= tenMs {
+			gain = 1 - 0.2*float64(at-tenMs)/float64(tenMs)
+		}
+		out[i] = v * math.Max(gain, 0)
+	}
+	s.lost += n
+	return out
+}
+
+// periodSample is sample pos of the last k periods repeated, starting k periods before the end.
+func (s *plcState) periodSample(k, pos int) float64 {
+	span := k * s.pitch
+	return s.pitchBuf[len(s.pitchBuf)-span+pos%span]
+}
+
+// findPitch returns the lag in [plcPitchMin, plcPitchMax] (scaled) with the best normalized
+// correlation between the last 20 ms of history and the history before it.
+func (s *plcState) findPitch() int {
+	lo, hi, n := s.samples(plcPitchMin), s.samples(plcPitchMax), s.samples(plcCorrLen)
+	x := s.hist
+	end := len(x)
+	best, bestScore := hi, math.Inf(-1)
+	for p := lo; p <= hi; p++ {
+		var corr, energy float64
+		for i := end - n; i < end; i++ {
+			corr += x[i] * x[i-p]
+			energy += x[i-p] * x[i-p]
+		}
+		if energy == 0 {
+			continue
+		}
+		if score := corr / math.Sqrt(energy); score > bestScore {
+			best, bestScore = p, score
+		}
+	}
+	return best
+}
+
+func (s *plcState) remember(pcm []int16) {
+	if len(pcm) >= len(s.hist) {
+		for i := range s.hist {
+			s.hist[i] = float64(pcm[len(pcm)-len(s.hist)+i])
+		}
+		return
+	}
+	copy(s.hist, s.hist[len(pcm):])
+	tail := s.hist[len(s.hist)-len(pcm):]
+	for i, v := range pcm {
+		tail[i] = float64(v)
+	}
+}
+
+func sat16f(v float64) int16 {
+	return int16(sat16(int(math.Round(v))))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Option tags we understand in a Require header; anything else gets 420 Bad Extension.
+var supportedOptionTags = map[string]bool{
+	"100rel":   true,
+	"timer":    true,
+	"replaces": true,
+}
+
+var (
+	errNoPrack        = errors.New("reliable provisional not acknowledged")
+	errInviteCanceled = errors.New("invite canceled")
+)
+
+// unsupportedRequire returns the Require option tags of req that we don't support.
+func unsupportedRequire(req sipMsg) []string {
+	var out []string
+	for _, v := range req.headers("require") {
+		for _, t := range strings.Split(v, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t != "" && !supportedOptionTags[t] {
+				out = append(out, t)
+			}
+		}
+	}
+	return out
+}
+
+// uasInvite is an initial INVITE we are still answering (no final response sent yet).
+// It sends provisional responses, reliably (RFC 3262) when the caller requires or supports 100rel.
+type uasInvite struct {
+	conn      net.PacketConn
+	addr      net.Addr
+	req       sipMsg
+	toWithTag string
+	contact   string
+	reliable  bool
+
+	mu       sync.Mutex
+	rseq     uint32
+	pending  map[uint32]chan sipMsg // unacknowledged reliable provisionals by RSeq
+	acked    map[uint32]bool        // so PRACK retransmissions still get 200
+	canceled chan struct{}
+	finished bool // final response sent, or canceled
+}
+
+func newUASInvite(conn net.PacketConn, addr net.Addr, req sipMsg, toWithTag, contact string, o callOptions) *uasInvite {
+	reliable := hasOptionTag(req, "require", "100rel") ||
+		(hasOptionTag(req, "supported", "100rel") && o.reliableProvisionals != "off")
+	return &uasInvite{
+		conn:      conn,
+		addr:      addr,
+		req:       req,
+		toWithTag: toWithTag,
+		contact:   contact,
+		reliable:  reliable,
+		// RFC 3262 §3: initial RSeq is random in 1..2**31-1.
+		rseq:     uint32(rand.Int31n(1<<31-1)) + 1,
+		pending:  map[uint32]chan sipMsg{},
+		acked:    map[uint32]bool{},
+		canceled: make(chan struct{}),
+	}
+}
+
+func (st *runtimeState) addPendingInvite(callID string, tx *uasInvite) {
+	st.mu.Lock()
+	st.pendingInvites[callID] = tx
+	st.mu.Unlock()
+}
+
+// finishPendingInvite is called right before the final response; late PRACKs/CANCELs then miss.
+// It returns false when the INVITE was already canceled (and answered with 487).
+func (st *runtimeState) finishPendingInvite(callID string, tx *uasInvite) bool {
+	st.mu.Lock()
+	if st.pendingInvites[callID] == tx {
+		delete(st.pendingInvites, callID)
+	}
+	st.mu.Unlock()
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.finished {
+		return false
+	}
+	tx.finished = true
+	return true
+}
+
+// sendProvisional sends a 1xx. When 100rel is in use it adds RSeq/Require and retransmits
+// (T1 doubling, 32s total) until the matching PRACK arrives; the returned PRACK may carry an SDP answer.
+func (tx *uasInvite) sendProvisional(status int, reason string, extra map[string][]string, body []byte) (sipMsg, error) {
+	if !tx.reliable || status == 100 {
+		sendSIPResponse(tx.conn, tx.addr, tx.req, tx.toWithTag, tx.contact, status, reason, extra, body)
+		return sipMsg{}, nil
+	}
+
+	tx.mu.Lock()
+	tx.rseq++
+	rseq := tx.rseq
+	ch := make(chan sipMsg, 1)
+	tx.pending[rseq] = ch
+	tx.mu.Unlock()
+	defer func() {
+		tx.mu.Lock()
+		delete(tx.pending, rseq)
+		tx.mu.Unlock()
+	}()
+
+	hdr := map[string][]string{}
+	for k, v := range extra {
+		hdr[k] = v
+	}
+	hdr["Require"] = []string{"100rel"}
+	hdr["RSeq"] = []string{strconv.FormatUint(uint64(rseq), 10)}
+
+	deadline := time.NewTimer(32 * time.Second)
+	defer deadline.Stop()
+	interval := 500 * time.Millisecond
+	for {
+		sendSIPResponse(tx.conn, tx.addr, tx.req, tx.toWithTag, tx.contact, status, reason, hdr, body)
+		retrans := time.NewTimer(interval)
+		select {
+		case prack := <-ch:
+			retrans.Stop()
+			return prack, nil
+		case <-tx.canceled:
+			retrans.Stop()
+			return sipMsg{}, errInviteCanceled
+		case <-deadline.C:
+			retrans.Stop()
+			return sipMsg{}, errNoPrack
+		case <-retrans.C:
+		}
+		interval *= 2
+	}
+}
+
+// parseRAck parses "RAck: <rseq> <cseq> <method>".
+func parseRAck(v string) (uint32, int, string, error) {
+	f := strings.Fields(v)
+	if len(f) != 3 {
+		return 0, 0, "", fmt.Errorf("bad RAck %q", v)
+	}
+	rseq, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("bad RAck %q", v)
+	}
+	cseq, err := strconv.Atoi(f[1])
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("bad RAck %q", v)
+	}
+	return uint32(rseq), cseq, strings.ToUpper(f[2]), nil
+}
+
+func cseqNumber(m sipMsg) int {
+	f := strings.Fields(m.header("cseq"))
+	if len(f) == 0 {
+		return 0
+	}
+	n, _ := strconv.Atoi(f[0])
+	return n
+}
+
+// handlePrack matches a PRACK's RAck to an outstanding reliable provisional (RFC 3262 §4).
+func handlePrack(logger *log.Logger, conn net.PacketConn, addr net.Addr, m sipMsg, st *runtimeState) {
+	allow := map[string][]string{
+		"Allow": {sipAllow},
+	}
+	callID := m.header("call-id")
+	rseq, cseq, method, err := parseRAck(m.header("rack"))
+	if err != nil {
+		sendSIPResponse(conn, addr, m, "", "", 400, "Bad Request", allow, nil)
+		return
+	}
+
+	st.mu.RLock()
+	tx := st.pendingInvites[callID]
+	st.mu.RUnlock()
+	var (
+		ch    chan sipMsg
+		dupOK bool
+	)
+	if tx != nil && method == "INVITE" && cseq == cseqNumber(tx.req) {
+		tx.mu.Lock()
+		ch = tx.pending[rseq]
+		dupOK = tx.acked[rseq]
+		if ch != nil {
+			tx.acked[rseq] = true
+		}
+		tx.mu.Unlock()
+	}
+	if dupOK {
+		sendSIPResponse(conn, addr, m, "", "", 200, "OK", allow, nil)
+		return
+	}
+	if ch == nil {
+		logger.Printf("sip recv: PRACK call-id=%s rack=%q matches nothing", callID, m.header("rack"))
+		sendSIPResponse(conn, addr, m, "", "", 481, "Call/Transaction Does Not Exist", allow, nil)
+		return
+	}
+	sendSIPResponse(conn, addr, m, "", "", 200, "OK", allow, nil)
+	select {
+	case ch <- m:
+	default:
+	}
+}
+
+// cancelPendingInvite handles CANCEL for an INVITE we haven't answered yet: 487 for the INVITE.
+func cancelPendingInvite(st *runtimeState, callID string) bool {
+	st.mu.Lock()
+	tx := st.pendingInvites[callID]
+	if tx != nil {
+		delete(st.pendingInvites, callID)
+	}
+	st.mu.Unlock()
+	if tx == nil {
+		return false
+	}
+	tx.mu.Lock()
+	finished := tx.finished
+	tx.finished = true
+	tx.mu.Unlock()
+	if finished {
+		return false
+	}
+	close(tx.canceled)
+	sendSIPResponse(tx.conn, tx.addr, tx.req, tx.toWithTag, "", 487, "Request Terminated", nil, nil)
+	return true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"sip-rtp-go/internal/resample"
+)
+
+// Backend WebSocket keepalive and reconnect (AI mode). The backend is pinged every wsKeepalive; a
+// connection with no message or pong for wsDeadAfterPings intervals is dead, as is one with a read
+// or write error. The call stays up meanwhile: the caller hears hold audio while the backend is
+// redialed with backoff, and the new connection starts with a resume message carrying the Call-ID.
+// When the reconnect budget runs out the agent's fallback policy takes over (fallback.go).
+const (
+	defaultWsKeepalive       = 5 * time.Second
+	wsDeadAfterPings         = 3
+	wsWriteTimeout           = 2 * time.Second
+	defaultWsReconnectBudget = 30 * time.Second
+	wsDialTimeout            = 5 * time.Second
+	wsBackoffMin             = 250 * time.Millisecond
+	wsBackoffMax             = 5 * time.Second
+	// Hold audio is queued for playback in chunks of this length.
+	outageChunk = 200 * time.Millisecond
+)
+
+var errWsDown = errors.New("backend websocket down")
+
+// armWs sets a connection's read deadline and extends it on every pong; the reader extends it on
+// every message.
+func armWs(ws *websocket.Conn, keepalive time.Duration) {
+	_ = ws.SetReadDeadline(time.Now().Add(wsDeadAfterPings * keepalive))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(wsDeadAfterPings * keepalive))
+	})
+}
+
+// runPings pings the current connection every interval until stop closes.
+func (w *wsWriter) runPings(every time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		w.mu.Lock()
+		if w.ws != nil {
+			_ = w.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		}
+		w.mu.Unlock()
+	}
+}
+
+// drop closes a dead connection; writes are dropped until resume installs the next one.
+func (w *wsWriter) drop(ws *websocket.Conn) {
+	w.mu.Lock()
+	if w.ws == ws {
+		w.ws = nil
+	}
+	w.mu.Unlock()
+	_ = ws.Close()
+}
+
+// resume installs a new connection, with msg as the first message on it.
+func (w *wsWriter) resume(ws *websocket.Conn, msg any) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_ = ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := ws.WriteJSON(msg); err != nil {
+		return err
+	}
+	w.ws = ws
+	return nil
+}
+
+// redialWs dials the backend with backoff until it answers, the budget (from since) runs out or the
+// call ends; it returns nil in the latter two cases.
+func redialWs(logger *log.Logger, cs *callSession, wsURL string, since time.Time) *websocket.Conn {
+	budget := cs.opts.wsReconnectBudget
+	if budget < 0 {
+		return nil
+	}
+	deadline := since.Add(budget)
+	backoff := wsBackoffMin
+	for attempt := 1; ; attempt++ {
+		dialBy := time.Now().Add(wsDialTimeout)
+		if deadline.Before(dialBy) {
+			dialBy = deadline
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), dialBy)
+		go func() {
+			select {
+			case <-cs.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		ws, _, err := websocket.DefaultDialer.DialContext(ctx, wsURL, nil)
+		cancel()
+		if err == nil {
+			logger.Printf("ws stream: reconnected after %s, attempt %d (call-id=%s)", time.Since(since).Round(time.Millisecond), attempt, cs.callID)
+			return ws
+		}
+		logger.Printf("ws stream: reconnect attempt %d failed (call-id=%s): %v", attempt, cs.callID, err)
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		backoff = min(2*backoff, wsBackoffMax)
+		if time.Now().Add(wait).After(deadline) {
+			return nil
+		}
+		select {
+		case <-cs.stopCh:
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// playOutage queues hold audio (the agent's wsOutageAudio, else the hold tone) for playback in real
+// time until stop closes.
+func playOutage(logger *log.Logger, cs *callSession, playQ chan<- []int16, playRate int, stop <-chan struct{}) {
+	var hold []int16
+	if path := cs.opts.wsOutageAudio; path != "" {
+		pcm, err := loadPromptPcm8k(path)
+		if err != nil {
+			logger.Printf("ws stream: outage audio %q: %v", path, err)
+		} else {
+			hold = pcm
+		}
+	}
+	chunk := int(outageChunk.Seconds() * 8000)
+	conv := resample.NewConverter(playRate)
+	pos := 0
+	next := func() []int16 {
+		var pcm []int16
+		if len(hold) == 0 {
+			pcm = defaultHoldTone.pcm8k(pos, chunk)
+			pos += chunk
+		} else {
+			for len(pcm) < chunk {
+				n := min(chunk-len(pcm), len(hold)-pos)
+				pcm = append(pcm, hold[pos:pos+n]...)
+				pos = (pos + n) % len(hold)
+			}
+		}
+		return conv.Process(pcm, 8000)
+	}
+
+	t := time.NewTicker(outageChunk)
+	defer t.Stop()
+	// One chunk ahead, so timer jitter doesn't leave gaps.
+	for i := 0; i < 2; i++ {
+		select {
+		case playQ <- next():
+		default:
+		}
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-cs.stopCh:
+			return
+		case <-t.C:
+			select {
+			case playQ <- next():
+			default:
+			}
+		}
+	}
+}
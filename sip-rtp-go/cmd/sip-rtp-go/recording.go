@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-call recording of AI calls: the caller (as received, after loss concealment) and the bot (what
+// the caller heard) on the two channels of a stereo WAV, or in two mono WAVs. Both channels follow the
+// wall clock: a channel that falls behind (no RTP, a stalled jitter buffer) is padded with silence,
+// so they stay aligned. Files are written as .part and renamed when the call ends.
+const (
+	recordOff    = "off"
+	recordStereo = "stereo"
+	recordMono   = "mono"
+
+	defaultRecordDir      = "recordings"
+	defaultRecordFileName = "{date}/{callId}_{ext}_{time}"
+	// How far a channel may lag the wall clock before it is padded.
+	recordSlack = 200 * time.Millisecond
+
+	recCaller = 0
+	recBot    = 1
+
+	recordSweepEvery = time.Hour
+)
+
+func parseRecordMode(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "stereo", "on", "true":
+		return recordStereo
+	case "mono":
+		return recordMono
+	default:
+		return recordOff
+	}
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// recordPath expands a file name template ({callId}, {ext}, {date}, {time}) under dir. Values are made
+// safe for file names; "/" in the template itself makes subdirectories.
+func recordPath(dir, tmpl string, cs *callSession, at time.Time) string {
+	at = at.UTC()
+	r := strings.NewReplacer(
+		"{callId}", unsafeFileChars.ReplaceAllString(cs.callID, "_"),
+		"{ext}", unsafeFileChars.ReplaceAllString(cs.extID, "_"),
+		"{date}", at.Format("2006-01-02"),
+		"{time}", at.Format("20060102T150405Z"),
+	)
+	return filepath.Join(dir, filepath.FromSlash(r.Replace(tmpl)))
+}
+
+type recChannel struct {
+	pending []int16
+	pos     int64 // samples written or pending, padding included
+}
+
+type callRecorder struct {
+	mu     sync.Mutex
+	logger *log.Logger
+	callID string
+	rate   int
+	start  time.Time
+	ch     [2]recChannel
+	files  []*wavWriter // stereo: one file; mono: caller, bot
+	failed bool
+}
+
+func startRecording(logger *log.Logger, cs *callSession, rate int) (*callRecorder, error) {
+	o := cs.opts
+	now := time.Now()
+	base := recordPath(o.recordDir, o.recordFileName, cs, now)
+	r := &callRecorder{logger: logger, callID: cs.callID, rate: rate, start: now}
+	if o.record == recordStereo {
+		w, err := createWav(base+".wav", 2, rate)
+		if err != nil {
+			return nil, err
+		}
+		r.files = []*wavWriter{w}
+		return r, nil
+	}
+	for _, suffix := range []string{"-caller.wav", "-ai.wav"} {
+		w, err := createWav(base+suffix, 1, rate)
+		if err != nil {
+			for _, f := range r.files {
+				f.abort()
+			}
+			return nil, err
+		}
+		r.files = append(r.files, w)
+	}
+	return r, nil
+}
+
+// write adds audio at the recorder's rate to one channel, just played (bot) or just received (caller).
+func (r *callRecorder) write(ch int, pcm []int16) {
+	r.writeAt(ch, pcm, time.Now())
+}
+
+// writeAt places pcm so it ends at now on the call's clock, the same reference for both channels, so
+// audio written to both at the same moment lines up: a gap before it is padded with silence, and the
+// part overlapping audio already recorded on the channel (a burst after a stall) is dropped. Both
+// channels are then padded up to recordSlack behind the clock, so one that gets nothing doesn't hold
+// the other back.
+func (r *callRecorder) writeAt(ch int, pcm []int16, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failed {
+		return
+	}
+	at := int64(now.Sub(r.start).Seconds() * float64(r.rate))
+	slack := int64(recordSlack.Seconds() * float64(r.rate))
+	c := &r.ch[ch]
+	start := at - int64(len(pcm))
+	if start > c.pos {
+		c.pending = append(c.pending, make([]int16, start-c.pos)...)
+		c.pos = start
+	}
+	pcm = pcm[min(c.pos-start, int64(len(pcm))):]
+	c.pending = append(c.pending, pcm...)
+	c.pos += int64(len(pcm))
+	for i := range r.ch {
+		if o := &r.ch[i]; at-slack > o.pos {
+			o.pending = append(o.pending, make([]int16, at-slack-o.pos)...)
+			o.pos = at - slack
+		}
+	}
+	if err := r.flushLocked(false); err != nil {
+		r.failed = true
+		r.logger.Printf("recording: write failed (call-id=%s): %v", r.callID, err)
+	}
+}
+
+// flushLocked writes what both channels have (mono: everything; stereo: the common part). When
+// final, the shorter channel is first padded with silence to the other's length.
+func (r *callRecorder) flushLocked(final bool) error {
+	a, b := &r.ch[recCaller], &r.ch[recBot]
+	if final {
+		// Both channels end at the same time.
+		end := a.pos
+		if b.pos > end {
+			end = b.pos
+		}
+		for _, c := range []*recChannel{a, b} {
+			c.pending = append(c.pending, make([]int16, end-c.pos)...)
+			c.pos = end
+		}
+	}
+	if len(r.files) == 2 {
+		for i, c := range []*recChannel{a, b} {
+			if err := r.files[i].write(c.pending); err != nil {
+				return err
+			}
+			c.pending = c.pending[:0]
+		}
+		return nil
+	}
+	n := min(len(a.pending), len(b.pending))
+	if n == 0 {
+		return nil
+	}
+	frames := make([]int16, 2*n)
+	for i := 0; i < n; i++ {
+		frames[2*i], frames[2*i+1] = a.pending[i], b.pending[i]
+	}
+	a.pending = append(a.pending[:0], a.pending[n:]...)
+	b.pending = append(b.pending[:0], b.pending[n:]...)
+	return r.files[0].write(frames)
+}
+
+// close finishes the files (renaming them into place) and returns their paths.
+func (r *callRecorder) close() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	if !r.failed {
+		firstErr = r.flushLocked(true)
+	}
+	var paths []string
+	for _, f := range r.files {
+		if r.failed || firstErr != nil {
+			f.abort()
+			continue
+		}
+		if err := f.finish(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		paths = append(paths, f.path)
+	}
+	r.failed = true
+	return paths, firstErr
+}
+
+// wavWriter writes a PCM16 WAV to path+".part"; finish fills in the sizes and renames it to path.
+type wavWriter struct {
+	path     string
+	f        *os.File
+	w        *bufio.Writer
+	channels int
+	rate     int
+	data     int64 // bytes of samples written
+}
+
+func createWav(path string, channels, rate int) (*wavWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".part", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &wavWriter{path: path, f: f, w: bufio.NewWriterSize(f, 64*1024), channels: channels, rate: rate}
+	if _, err := w.w.Write(w.header()); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *wavWriter) header() []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+w.data))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], uint16(w.channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(w.rate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(w.rate*w.channels*2))
+	binary.LittleEndian.PutUint16(h[32:], uint16(w.channels*2))
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(w.data))
+	return h
+}
+
+func (w *wavWriter) write(samples []int16) error {
+	b := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(b[2*i:], uint16(s))
+	}
+	n, err := w.w.Write(b)
+	w.data += int64(n)
+	return err
+}
+
+func (w *wavWriter) finish() error {
+	if err := w.w.Flush(); err != nil {
+		w.abort()
+		return err
+	}
+	if _, err := w.f.WriteAt(w.header(), 0); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		_ = os.Remove(w.f.Name())
+		return err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+// abort drops a file that could not be finished.
+func (w *wavWriter) abort() {
+	_ = w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
+
+// runRecordingSweeper deletes recordings and transcripts older than their agents'
+// recordRetentionDays, hourly (first a minute after start, once the config is loaded). A directory
+// shared by agents keeps files for the longest of their retentions.
+func runRecordingSweeper(logger *log.Logger, st *runtimeState) {
+	wait := time.Minute
+	for {
+		time.Sleep(wait)
+		wait = recordSweepEvery
+		st.mu.RLock()
+		keep := map[string]int{}
+		for _, a := range st.agentByUser {
+			days := a.opts.recordRetentionDays
+			if days <= 0 {
+				continue
+			}
+			if a.opts.record != recordOff {
+				keep[a.opts.recordDir] = max(keep[a.opts.recordDir], days)
+			}
+			if a.opts.transcript != transcriptOff {
+				keep[a.opts.transcriptDir] = max(keep[a.opts.transcriptDir], days)
+			}
+		}
+		st.mu.RUnlock()
+		for dir, days := range keep {
+			sweepRecordings(logger, dir, time.Now().AddDate(0, 0, -days))
+		}
+	}
+}
+
+func sweepRecordings(logger *log.Logger, dir string, before time.Time) {
+	removed := 0
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if !strings.HasSuffix(path, ".wav") && !strings.HasSuffix(path, ".wav.part") && !strings.HasSuffix(path, ".jsonl") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Printf("recording: retention: remove %s: %v", path, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		logger.Printf("recording: retention: removed %d file(s) older than %s from %s", removed, before.Format(time.RFC3339), dir)
+	}
+}
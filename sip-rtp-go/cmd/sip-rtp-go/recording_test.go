@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testRecorder(t *testing.T, mode string) (*callRecorder, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cs := &callSession{callID: "abc@host", extID: "100", opts: callOptions{
+		record:         mode,
+		recordDir:      dir,
+		recordFileName: "rec",
+	}}
+	r, err := startRecording(log.New(io.Discard, "", 0), cs, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, dir
+}
+
+// readWav checks the header of a PCM16 WAV and returns its channels, rate and interleaved samples.
+func readWav(t *testing.T, path string) (int, int, []int16) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 44 || string(b[0:4]) != "RIFF" || string(b[8:16]) != "WAVEfmt " || string(b[36:40]) != "data" {
+		t.Fatalf("%s: not a WAV header: %q", path, b[:min(len(b), 44)])
+	}
+	le := binary.LittleEndian
+	channels, rate := int(le.Uint16(b[22:])), int(le.Uint32(b[24:]))
+	data := int(le.Uint32(b[40:]))
+	switch {
+	case le.Uint32(b[4:]) != uint32(36+data):
+		t.Errorf("%s: RIFF size %d, want %d", path, le.Uint32(b[4:]), 36+data)
+	case data != len(b)-44:
+		t.Errorf("%s: data size %d, file has %d bytes of samples", path, data, len(b)-44)
+	case le.Uint16(b[20:]) != 1 || le.Uint16(b[34:]) != 16:
+		t.Errorf("%s: format %d/%d bits, want PCM/16", path, le.Uint16(b[20:]), le.Uint16(b[34:]))
+	case le.Uint32(b[28:]) != uint32(rate*channels*2) || le.Uint16(b[32:]) != uint16(channels*2):
+		t.Errorf("%s: byte rate/block align inconsistent", path)
+	}
+	pcm := make([]int16, (len(b)-44)/2)
+	for i := range pcm {
+		pcm[i] = int16(le.Uint16(b[44+2*i:]))
+	}
+	return channels, rate, pcm
+}
+
+// Audio written to both channels at the same moment lands at the same position, whatever either
+// channel did before (gaps, jitter, bursts).
+func TestRecorderChannelsAligned(t *testing.T) {
+	const frame = 160 // 20 ms at 8 kHz
+	click := func() []int16 {
+		pcm := make([]int16, frame)
+		pcm[frame/2] = 20000
+		return pcm
+	}
+	for _, tc := range []struct {
+		name string
+		// Whether each channel writes on tick i, and how late; the click tick is written on time.
+		caller, bot func(i int) (bool, time.Duration)
+	}{
+		{"both-steady",
+			func(int) (bool, time.Duration) { return true, 0 },
+			func(int) (bool, time.Duration) { return true, 0 }},
+		{"caller-silent-until-click",
+			func(i int) (bool, time.Duration) { return i >= 40, 0 },
+			func(int) (bool, time.Duration) { return true, 0 }},
+		{"caller-gap",
+			func(i int) (bool, time.Duration) { return i < 10 || i > 25, 0 },
+			func(int) (bool, time.Duration) { return true, 0 }},
+		{"bot-jitter",
+			func(int) (bool, time.Duration) { return true, 0 },
+			func(i int) (bool, time.Duration) { return true, time.Duration(i%3) * 7 * time.Millisecond }},
+		{"bot-stall",
+			func(int) (bool, time.Duration) { return true, 0 },
+			func(i int) (bool, time.Duration) { return i < 20 || i > 30, 0 }},
+		{"caller-runs-early",
+			func(int) (bool, time.Duration) { return true, -5 * time.Millisecond },
+			func(int) (bool, time.Duration) { return true, 0 }},
+	} {
+		for _, mode := range []string{recordStereo, recordMono} {
+			t.Run(tc.name+"-"+mode, func(t *testing.T) {
+				r, dir := testRecorder(t, mode)
+				const clickTick = 50
+				for i := 1; i <= 80; i++ {
+					tick := r.start.Add(time.Duration(i) * 20 * time.Millisecond)
+					for ch, f := range map[int]func(int) (bool, time.Duration){recCaller: tc.caller, recBot: tc.bot} {
+						ok, late := f(i)
+						if !ok {
+							continue
+						}
+						pcm := make([]int16, frame)
+						if i == clickTick {
+							pcm, late = click(), 0
+						}
+						r.writeAt(ch, pcm, tick.Add(late))
+					}
+				}
+				if _, err := r.close(); err != nil {
+					t.Fatal(err)
+				}
+
+				var caller, bot []int16
+				if mode == recordStereo {
+					_, _, pcm := readWav(t, filepath.Join(dir, "rec.wav"))
+					for i := 0; i+1 < len(pcm); i += 2 {
+						caller, bot = append(caller, pcm[i]), append(bot, pcm[i+1])
+					}
+				} else {
+					_, _, caller = readWav(t, filepath.Join(dir, "rec-caller.wav"))
+					_, _, bot = readWav(t, filepath.Join(dir, "rec-ai.wav"))
+				}
+				if len(caller) != len(bot) {
+					t.Errorf("caller %d samples, bot %d", len(caller), len(bot))
+				}
+				at := func(pcm []int16) int {
+					for i, v := range pcm {
+						if v != 0 {
+							return i
+						}
+					}
+					return -1
+				}
+				if c, b := at(caller), at(bot); c != b || c < 0 {
+					t.Errorf("click at caller sample %d, bot sample %d", c, b)
+				}
+			})
+		}
+	}
+}
+
+// Files are .part while recording and renamed into place with a complete header when the call ends.
+func TestRecorderFiles(t *testing.T) {
+	for _, tc := range []struct {
+		mode     string
+		files    []string
+		channels int
+	}{
+		{recordStereo, []string{"rec.wav"}, 2},
+		{recordMono, []string{"rec-caller.wav", "rec-ai.wav"}, 1},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			r, dir := testRecorder(t, tc.mode)
+			for i := 1; i <= 50; i++ {
+				at := r.start.Add(time.Duration(i) * 20 * time.Millisecond)
+				r.writeAt(recCaller, make([]int16, 160), at)
+				r.writeAt(recBot, make([]int16, 160), at)
+			}
+			for _, f := range tc.files {
+				if _, err := os.Stat(filepath.Join(dir, f+".part")); err != nil {
+					t.Errorf("while recording: %v", err)
+				}
+				if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+					t.Errorf("%s exists before the call ended", f)
+				}
+			}
+
+			paths, err := r.close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(paths) != len(tc.files) {
+				t.Fatalf("paths %v, want %v", paths, tc.files)
+			}
+			for i, f := range tc.files {
+				if paths[i] != filepath.Join(dir, f) {
+					t.Errorf("path %s, want %s", paths[i], filepath.Join(dir, f))
+				}
+				if _, err := os.Stat(paths[i] + ".part"); err == nil {
+					t.Errorf("%s.part left behind", f)
+				}
+				channels, rate, pcm := readWav(t, paths[i])
+				if channels != tc.channels || rate != 8000 {
+					t.Errorf("%s: %d channels at %d Hz, want %d at 8000", f, channels, rate, tc.channels)
+				}
+				if got, want := len(pcm)/channels, 50*160; got != want {
+					t.Errorf("%s: %d samples per channel, want %d", f, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSweepRecordings(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-72 * time.Hour)
+	files := map[string]bool{ // name: removed
+		"2024-01-01/a.wav":      true,
+		"2024-01-01/a.wav.part": true,
+		"2024-01-01/a.jsonl":    true,
+		"2024-01-01/notes.txt":  false,
+		"new.wav":               false,
+		"new.jsonl":             false,
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "new.wav" && name != "new.jsonl" {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sweepRecordings(log.New(io.Discard, "", 0), dir, time.Now().Add(-48*time.Hour))
+	for name, removed := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if gone := os.IsNotExist(err); gone != removed {
+			t.Errorf("%s: removed=%v, want %v", name, gone, removed)
+		}
+	}
+}
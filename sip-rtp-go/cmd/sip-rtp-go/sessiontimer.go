@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 4028 says Min-SE must never be below 90 seconds.
+const defaultMinSE = 90
+
+// sessionTimer is the negotiated RFC 4028 state of one dialog.
+type sessionTimer struct {
+	mu sync.Mutex
+	// interval is the negotiated Session-Expires; 0 means no session timer.
+	interval time.Duration
+	// weRefresh is true when we are the refresher (refresher=uas on the INVITE we answered).
+	weRefresh   bool
+	lastRefresh time.Time
+	// Capabilities the peer advertised in its INVITE.
+	peerUpdate bool
+	peerTimer  bool
+}
+
+// sessionTimerAnswer is the outcome of negotiating one INVITE/UPDATE that we answer.
+type sessionTimerAnswer struct {
+	// reject means "answer 422 Session Interval Too Small" with Min-SE: minSE.
+	reject    bool
+	minSE     int
+	interval  int    // seconds; 0 = no session timer
+	refresher string // "uac" (the peer) | "uas" (us)
+	extra     map[string][]string
+}
+
+func (o callOptions) minSE() int {
+	if o.minSessionExpires > defaultMinSE {
+		return o.minSessionExpires
+	}
+	return defaultMinSE
+}
+
+func hasOptionTag(m sipMsg, hdr, tag string) bool {
+	for _, v := range m.headers(hdr) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseSessionExpires parses "1800;refresher=uas" into (1800, "uas").
+func parseSessionExpires(v string) (int, string) {
+	parts := strings.Split(strings.TrimSpace(v), ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || n <= 0 {
+		return 0, ""
+	}
+	refresher := ""
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "refresher") {
+			refresher = strings.ToLower(strings.TrimSpace(kv[1]))
+		}
+	}
+	return n, refresher
+}
+
+func sessionExpiresHeader(m sipMsg) string {
+	if v := m.header("session-expires"); v != "" {
+		return v
+	}
+	// compact form
+	return m.header("x")
+}
+
+// negotiateSessionTimer applies RFC 4028 UAS rules to an INVITE/UPDATE we are about to answer.
+func negotiateSessionTimer(req sipMsg, o callOptions) sessionTimerAnswer {
+	ans := sessionTimerAnswer{
+		minSE: o.minSE(),
+		extra: map[string][]string{"Supported": {"replaces, timer, 100rel"}},
+	}
+	peerTimer := hasOptionTag(req, "supported", "timer") || hasOptionTag(req, "require", "timer")
+	se, refresher := parseSessionExpires(sessionExpiresHeader(req))
+	reqMinSE, _ := strconv.Atoi(strings.TrimSpace(req.header("min-se")))
+
+	if se > 0 && se < ans.minSE {
+		if peerTimer {
+			ans.reject = true
+			ans.extra["Min-SE"] = []string{strconv.Itoa(ans.minSE)}
+			return ans
+		}
+		// §9: a UAC without timer support couldn't retry after a 422 (a proxy inserted the header),
+		// so the interval is raised instead and we do the refreshing.
+		se = ans.minSE
+	}
+	if se == 0 && o.sessionExpires > 0 {
+		// Peer didn't ask for a timer; we may still insert one.
+		se = max(o.sessionExpires, max(reqMinSE, ans.minSE))
+	}
+	if se == 0 {
+		return ans
+	}
+	if !peerTimer || refresher != "uac" && refresher != "uas" {
+		// The choice is ours. A UAC without timer support can't refresh, so it falls to us.
+		refresher = "uas"
+		if peerTimer && o.sessionRefresher != "uas" {
+			refresher = "uac"
+		}
+	}
+	ans.interval = se
+	ans.refresher = refresher
+	ans.extra["Session-Expires"] = []string{fmt.Sprintf("%d;refresher=%s", se, refresher)}
+	if peerTimer {
+		ans.extra["Require"] = []string{"timer"}
+	}
+	return ans
+}
+
+func sendSessionIntervalTooSmall(conn net.PacketConn, addr net.Addr, req sipMsg, ans sessionTimerAnswer) {
+	sendSIPResponse(conn, addr, req, "", "", 422, "Session Interval Too Small", map[string][]string{
+		"Min-SE": {strconv.Itoa(ans.minSE)},
+	}, nil)
+}
+
+// apply records a (re)negotiated timer from a request we answered. The peer sent that request,
+// so refresher=uac is the peer and refresher=uas is us.
+func (t *sessionTimer) apply(ans sessionTimerAnswer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.interval = time.Duration(ans.interval) * time.Second
+	t.weRefresh = ans.refresher == "uas"
+	t.lastRefresh = time.Now()
+}
+
+func (t *sessionTimer) snapshot() (time.Duration, bool, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.interval, t.weRefresh, t.lastRefresh
+}
+
+// runSessionTimer sends our refreshes at half the interval when we are the refresher, and hangs up
+// when the peer is the refresher but lets the session expire.
+func runSessionTimer(logger *log.Logger, st *runtimeState, cs *callSession) {
+	if cs.timer == nil || cs.dlg == nil {
+		return
+	}
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	var nextTry time.Time
+	for {
+		select {
+		case <-cs.stopCh:
+			return
+		case now := <-t.C:
+			interval, weRefresh, last := cs.timer.snapshot()
+			if interval <= 0 {
+				continue
+			}
+			elapsed := now.Sub(last)
+			if weRefresh {
+				if elapsed >= interval {
+					hangupCall(logger, st, cs, q850RecoveryOnTimeout, "session refresh failed")
+					return
+				}
+				if elapsed >= interval/2 && now.After(nextTry) {
+					if !refreshSession(logger, st, cs) {
+						return
+					}
+					nextTry = time.Now().Add(5 * time.Second)
+				}
+				continue
+			}
+			// RFC 4028 §10: BYE slightly before expiry if the refresher went quiet.
+			guard := interval / 3
+			if guard > 32*time.Second {
+				guard = 32 * time.Second
+			}
+			if elapsed >= interval-guard {
+				hangupCall(logger, st, cs, q850RecoveryOnTimeout, "session timer expired")
+				return
+			}
+		}
+	}
+}
+
+// refreshSession sends one session refresh (UPDATE if the peer allows it, re-INVITE otherwise).
+// It returns false when the call was torn down.
+func refreshSession(logger *log.Logger, st *runtimeState, cs *callSession) bool {
+	t := cs.timer
+	t.mu.Lock()
+	se := int(t.interval / time.Second)
+	useUpdate := t.peerUpdate
+	peerTimer := t.peerTimer
+	t.mu.Unlock()
+
+	for attempt := 0; attempt < 3; attempt++ {
+		extra := map[string][]string{
+			// We send the request, so refresher=uac keeps the refresh duty with us.
+			"Session-Expires": {fmt.Sprintf("%d;refresher=uac", se)},
+			"Min-SE":          {strconv.Itoa(cs.opts.minSE())},
+			"Supported":       {"timer"},
+		}
+		if peerTimer {
+			extra["Require"] = []string{"timer"}
+		}
+		method := "UPDATE"
+		var (
+			resp sipMsg
+			err  error
+		)
+		if useUpdate {
+			resp, err = cs.dlg.sendRequest(st, "UPDATE", extra, nil)
+		} else {
+			method = "INVITE"
+			extra["Content-Type"] = []string{"application/sdp"}
+			resp, err = cs.dlg.sendInvite(st, extra, []byte(cs.currentLocalSDP()))
+		}
+		if err != nil {
+			logger.Printf("session timer: %s refresh failed (call-id=%s): %v", method, cs.callID, err)
+			hangupCall(logger, st, cs, q850RecoveryOnTimeout, "session refresh failed")
+			return false
+		}
+		switch {
+		case resp.status >= 200 && resp.status < 300:
+			n, refresher := parseSessionExpires(sessionExpiresHeader(resp))
+			t.mu.Lock()
+			t.lastRefresh = time.Now()
+			if n == 0 {
+				// No Session-Expires in the 2xx: the peer turned the timer off.
+				t.interval = 0
+			} else {
+				t.interval = time.Duration(n) * time.Second
+				// In the response to our request, refresher=uac means us.
+				t.weRefresh = refresher != "uas"
+			}
+			t.mu.Unlock()
+			logger.Printf("session timer: refreshed via %s (call-id=%s se=%ds refresher=%s)", method, cs.callID, n, refresher)
+			return true
+		case resp.status == 422:
+			if n, err := strconv.Atoi(strings.TrimSpace(resp.header("min-se"))); err == nil && n > se {
+				se = n
+				t.mu.Lock()
+				t.interval = time.Duration(se) * time.Second
+				t.mu.Unlock()
+			}
+		case resp.status == 491:
+			// Glare with a peer request; retry after a short random pause (RFC 3261 §14.1).
+			time.Sleep(time.Duration(rand.Intn(2000)) * time.Millisecond)
+		case (resp.status == 405 || resp.status == 501) && useUpdate:
+			useUpdate = false
+			t.mu.Lock()
+			t.peerUpdate = false
+			t.mu.Unlock()
+		case resp.status == 408 || resp.status == 481:
+			logger.Printf("session timer: %s refresh got %d %s (call-id=%s)", method, resp.status, resp.reason, cs.callID)
+			hangupCall(logger, st, cs, q850RecoveryOnTimeout, "session refresh failed")
+			return false
+		default:
+			// Any other failure leaves the session alive (RFC 4028 §10); try again shortly.
+			logger.Printf("session timer: %s refresh got %d %s (call-id=%s)", method, resp.status, resp.reason, cs.callID)
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestNegotiateSessionTimer(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		headers   string
+		opts      callOptions
+		reject    bool
+		interval  int
+		refresher string
+	}{
+		{"no timer", "", callOptions{}, false, 0, ""},
+		{"peer refreshes", "Supported: timer\r\nSession-Expires: 1800\r\n", callOptions{}, false, 1800, "uac"},
+		{"peer picks us", "Supported: timer\r\nSession-Expires: 1800;refresher=uas\r\n", callOptions{}, false, 1800, "uas"},
+		{"too small with timer", "Supported: timer\r\nSession-Expires: 30\r\n", callOptions{}, true, 0, ""},
+		{"too small for our Min-SE", "Supported: timer\r\nSession-Expires: 120\r\n", callOptions{minSessionExpires: 300}, true, 0, ""},
+		// Inserted by a proxy for a UAC that can't answer a 422: raised, and we refresh.
+		{"too small without timer", "Session-Expires: 30\r\n", callOptions{}, false, defaultMinSE, "uas"},
+		{"too small without timer, our Min-SE", "Session-Expires: 30;refresher=uac\r\n", callOptions{minSessionExpires: 300}, false, 300, "uas"},
+		{"we insert one", "", callOptions{sessionExpires: 600}, false, 600, "uas"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := parseSIP([]byte("INVITE sip:100@example.com SIP/2.0\r\n" + tc.headers + "\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ans := negotiateSessionTimer(req, tc.opts)
+			if ans.reject != tc.reject || ans.interval != tc.interval || ans.refresher != tc.refresher {
+				t.Errorf("reject=%v interval=%d refresher=%q, want reject=%v interval=%d refresher=%q",
+					ans.reject, ans.interval, ans.refresher, tc.reject, tc.interval, tc.refresher)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Turn-taking hints for backends without their own endpointing: caller speech starts and ends go
+// to the backend as events, and in gate mode only speech (with some padding either side) is
+// streamed, with a marker every second of silence instead of the audio.
+const (
+	vadModeOff    = "off"
+	vadModeEvents = "events"
+	vadModeGate   = "gate"
+
+	defaultVadHangover = 500 * time.Millisecond
+	defaultVadPadding  = 300 * time.Millisecond
+	silenceMarkerEvery = time.Second
+)
+
+func parseVadMode(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "events":
+		return vadModeEvents
+	case "gate":
+		return vadModeGate
+	default:
+		return vadModeOff
+	}
+}
+
+type uplinkFrame struct {
+	audio []byte
+	dur   time.Duration
+}
+
+// speechTracker follows one call's uplink. Timestamps are milliseconds of caller audio since the
+// stream started, sent or not, so they line up with the audio the backend received.
+type speechTracker struct {
+	callID  string
+	vad     *vad
+	gate    bool
+	padding time.Duration
+
+	pos     time.Duration
+	held    []uplinkFrame // gated audio kept as lead-in for the next speech
+	heldDur time.Duration
+	tail    time.Duration // padding still to send after speech ended
+	quiet   time.Duration // gated audio since the last silence marker
+}
+
+func newSpeechTracker(callID string, o callOptions) *speechTracker {
+	return &speechTracker{
+		callID:  callID,
+		vad:     newVAD(newVadConfig(o.vadSensitivity, o.vadHangover)),
+		gate:    o.vadMode == vadModeGate,
+		padding: o.vadPadding,
+	}
+}
+
+// frame takes one uplink frame: pcm8k feeds the VAD (nil for concealed audio) and audio is what the
+// backend would get. It returns the events to send, then the audio frames to send after them.
+func (t *speechTracker) frame(pcm8k []int16, audio []byte, dur time.Duration) (events []map[string]any, out [][]byte) {
+	t.pos += dur
+	if pcm8k != nil {
+		switch ev, lag := t.vad.process(pcm8k, 8000); ev {
+		case vadSpeechStart:
+			events = append(events, t.event("speechStarted", t.pos-lag))
+		case vadSpeechEnd:
+			events = append(events, t.event("speechEnded", t.pos-lag))
+			// This frame is still hangover; the padding comes after it.
+			t.tail = t.padding + dur
+		}
+	}
+	if !t.gate {
+		return events, [][]byte{audio}
+	}
+
+	switch {
+	case t.vad.speech:
+		for _, f := range t.held {
+			out = append(out, f.audio)
+		}
+		t.held, t.heldDur, t.quiet = t.held[:0], 0, 0
+		return events, append(out, audio)
+	case t.tail > 0:
+		t.tail -= dur
+		return events, [][]byte{audio}
+	}
+
+	// Silence: keep enough for the padding before the next speech, which is only recognized in the
+	// frame that completes its onset (so the held frames cover all of the onset but that frame).
+	t.held = append(t.held, uplinkFrame{audio: audio, dur: dur})
+	t.heldDur += dur
+	for len(t.held) > 1 && t.heldDur-t.held[0].dur >= t.padding+t.vad.cfg.onset-dur {
+		t.heldDur -= t.held[0].dur
+		t.held = t.held[1:]
+	}
+	t.quiet += dur
+	if t.quiet >= silenceMarkerEvery {
+		m := t.event("silence", t.pos)
+		m["durationMs"] = t.quiet.Milliseconds()
+		events = append(events, m)
+		t.quiet = 0
+	}
+	return events, nil
+}
+
+func (t *speechTracker) event(typ string, at time.Duration) map[string]any {
+	return map[string]any{
+		"type":        typ,
+		"callId":      t.callID,
+		"timestampMs": at.Milliseconds(),
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// vadSeg is a stretch of caller audio: noise at the background level, plus a 300 Hz tone at
+// speechDB when speechDB isn't 0.
+type vadSeg struct {
+	dur      time.Duration
+	speechDB float64
+}
+
+// vadFrames renders segments as 20 ms frames at 8 kHz over -60 dBFS noise.
+func vadFrames(segs ...vadSeg) [][]int16 {
+	rng := rand.New(rand.NewSource(1))
+	var pcm []int16
+	for _, s := range segs {
+		amp := 0.0
+		if s.speechDB != 0 {
+			amp = 32768 * math.Sqrt2 * math.Pow(10, s.speechDB/20)
+		}
+		for i := 0; i < int(s.dur.Seconds()*8000); i++ {
+			v := 32768 * 1e-3 * rng.NormFloat64()
+			v += amp * math.Sin(2*math.Pi*300*float64(len(pcm))/8000)
+			pcm = append(pcm, sat16f(v))
+		}
+	}
+	var frames [][]int16
+	for i := 0; i+160 <= len(pcm); i += 160 {
+		frames = append(frames, pcm[i:i+160])
+	}
+	return frames
+}
+
+// Speech starts and ends are reported with the time they happened, which is the onset or hangover
+// before the frame that decided them.
+func TestVADEvents(t *testing.T) {
+	type ev struct {
+		e  vadEvent
+		at time.Duration
+	}
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	speech := []vadSeg{{time.Second, 0}, {time.Second, -20}, {1500 * time.Millisecond, 0}}
+	for _, tc := range []struct {
+		name        string
+		sensitivity string
+		hangover    time.Duration
+		segs        []vadSeg
+		want        []ev
+	}{
+		{"medium", vadSensitivityMedium, 500 * time.Millisecond, speech, []ev{{vadSpeechStart, ms(1000)}, {vadSpeechEnd, ms(2000)}}},
+		{"low", vadSensitivityLow, 500 * time.Millisecond, speech, []ev{{vadSpeechStart, ms(1000)}, {vadSpeechEnd, ms(2000)}}},
+		{"high, short hangover", vadSensitivityHigh, defaultBargeInHangover, speech, []ev{{vadSpeechStart, ms(1000)}, {vadSpeechEnd, ms(2000)}}},
+		{"click shorter than onset", vadSensitivityMedium, 500 * time.Millisecond,
+			[]vadSeg{{time.Second, 0}, {60 * time.Millisecond, -20}, {time.Second, 0}}, nil},
+		{"pause shorter than hangover", vadSensitivityMedium, 500 * time.Millisecond,
+			[]vadSeg{{time.Second, 0}, {500 * time.Millisecond, -20}, {300 * time.Millisecond, 0}, {500 * time.Millisecond, -20}, {time.Second, 0}},
+			[]ev{{vadSpeechStart, ms(1000)}, {vadSpeechEnd, ms(2300)}}},
+		{"pause longer than hangover", vadSensitivityMedium, 200 * time.Millisecond,
+			[]vadSeg{{time.Second, 0}, {500 * time.Millisecond, -20}, {300 * time.Millisecond, 0}, {500 * time.Millisecond, -20}, {time.Second, 0}},
+			[]ev{{vadSpeechStart, ms(1000)}, {vadSpeechEnd, ms(1500)}, {vadSpeechStart, ms(1800)}, {vadSpeechEnd, ms(2300)}}},
+		{"below the medium minimum", vadSensitivityMedium, 500 * time.Millisecond,
+			[]vadSeg{{time.Second, 0}, {time.Second, -48}, {time.Second, 0}}, nil},
+		{"above the high minimum", vadSensitivityHigh, 500 * time.Millisecond,
+			[]vadSeg{{time.Second, 0}, {time.Second, -48}, {time.Second, 0}}, []ev{{vadSpeechStart, ms(1000)}, {vadSpeechEnd, ms(2000)}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newVAD(newVadConfig(tc.sensitivity, tc.hangover))
+			var got []ev
+			var pos time.Duration
+			for _, f := range vadFrames(tc.segs...) {
+				pos += 20 * time.Millisecond
+				if e, lag := v.process(f, 8000); e != vadNone {
+					got = append(got, ev{e, pos - lag})
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("events %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSpeechTracker(t *testing.T) {
+	const frame = 20 * time.Millisecond
+	// Speech from 1000 to 2000 ms, silence until 5000 ms.
+	frames := vadFrames(vadSeg{time.Second, 0}, vadSeg{time.Second, -20}, vadSeg{3 * time.Second, 0})
+	for _, tc := range []struct {
+		name                string
+		opts                callOptions
+		onset               time.Duration
+		firstSent, lastSent time.Duration // start of the first and end of the last frame streamed (gate)
+		silenceMarkers      []int64       // timestampMs of the silence markers (gate)
+	}{
+		{"events", callOptions{vadMode: vadModeEvents, vadHangover: 500 * time.Millisecond}, 100 * time.Millisecond, 0, 5 * time.Second, nil},
+		// Gate: the lead-in is the padding before the speech started, though the start was only
+		// recognized an onset later; after the end (recognized a hangover later) the padding follows.
+		{"gate", callOptions{vadMode: vadModeGate, vadHangover: 500 * time.Millisecond, vadPadding: 300 * time.Millisecond},
+			100 * time.Millisecond, 700 * time.Millisecond, 2800 * time.Millisecond, []int64{1000, 3800, 4800}},
+		{"gate, high sensitivity, short padding", callOptions{vadMode: vadModeGate, vadSensitivity: vadSensitivityHigh, vadHangover: 200 * time.Millisecond, vadPadding: 100 * time.Millisecond},
+			60 * time.Millisecond, 900 * time.Millisecond, 2300 * time.Millisecond, []int64{1000, 3300, 4300}},
+		{"gate, low sensitivity, no padding", callOptions{vadMode: vadModeGate, vadSensitivity: vadSensitivityLow, vadHangover: 500 * time.Millisecond},
+			160 * time.Millisecond, 1000 * time.Millisecond, 2500 * time.Millisecond, []int64{1000, 3500, 4500}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := tc.opts
+			o.vadSensitivity = parseVadSensitivity(o.vadSensitivity)
+			st := newSpeechTracker("c1", o)
+			if st.vad.cfg.onset != tc.onset {
+				t.Fatalf("onset %s, want %s", st.vad.cfg.onset, tc.onset)
+			}
+
+			var starts, ends, markers []int64
+			var sent []int
+			for i, f := range frames {
+				events, out := st.frame(f, []byte{byte(i >> 8), byte(i)}, frame)
+				for _, ev := range events {
+					if ev["callId"] != "c1" {
+						t.Errorf("event %v without the call id", ev)
+					}
+					at := ev["timestampMs"].(int64)
+					switch ev["type"] {
+					case "speechStarted":
+						starts = append(starts, at)
+					case "speechEnded":
+						ends = append(ends, at)
+					case "silence":
+						markers = append(markers, at)
+						if d := ev["durationMs"].(int64); d != silenceMarkerEvery.Milliseconds() {
+							t.Errorf("silence marker at %d ms for %d ms", at, d)
+						}
+					}
+				}
+				for _, a := range out {
+					sent = append(sent, int(a[0])<<8|int(a[1]))
+				}
+			}
+
+			if fmt.Sprint(starts, ends) != "[1000] [2000]" {
+				t.Errorf("speech started %v, ended %v; want [1000] [2000]", starts, ends)
+			}
+			if fmt.Sprint(markers) != fmt.Sprint(tc.silenceMarkers) {
+				t.Errorf("silence markers at %v ms, want %v", markers, tc.silenceMarkers)
+			}
+			// One continuous stretch, in order.
+			first, last := int(tc.firstSent/frame), int(tc.lastSent/frame)-1
+			if len(sent) != last-first+1 || sent[0] != first || sent[len(sent)-1] != last {
+				t.Fatalf("streamed %d frames, %v..%v; want frames %d..%d", len(sent), sent[:min(len(sent), 1)], sent[max(len(sent)-1, 0):], first, last)
+			}
+			for i, n := range sent {
+				if n != first+i {
+					t.Fatalf("frame %d streamed out of order: %v", n, sent)
+				}
+			}
+		})
+	}
+}
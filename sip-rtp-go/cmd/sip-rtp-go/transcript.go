@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-call transcripts of AI calls: a JSONL file with a line per backend text message other than
+// audio. Final transcript lines are written in one shape whatever the backend calls them: speaker
+// ("caller" or "ai") and text.
+const (
+	transcriptOff  = "off"
+	transcriptText = "text" // caller/AI transcript lines only
+	transcriptAll  = "all"  // plus every other non-audio message
+
+	defaultTranscriptDir = "transcripts"
+
+	speakerCaller = "caller"
+	speakerAI     = "ai"
+)
+
+func parseTranscriptMode(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "text", "on", "true":
+		return transcriptText
+	case "all":
+		return transcriptAll
+	default:
+		return transcriptOff
+	}
+}
+
+// Message types that carry one side's transcript; "transcript" itself names the side in a field.
+var transcriptTypes = map[string]string{
+	"usertranscript":         speakerCaller,
+	"callertranscript":       speakerCaller,
+	"inputtranscript":        speakerCaller,
+	"inputtranscription":     speakerCaller,
+	"aitranscript":           speakerAI,
+	"bottranscript":          speakerAI,
+	"assistanttranscript":    speakerAI,
+	"outputtranscript":       speakerAI,
+	"outputtranscription":    speakerAI,
+	"agenttranscript":        speakerAI,
+	"transcript":             "",
+	"transcription":          "",
+	"conversationtranscript": "",
+}
+
+// transcriptLine is a transcript message as sent by the backend. Each field may be at the top level
+// or under "data"; the top level wins.
+type transcriptLine struct {
+	Speaker    string `json:"speaker"`
+	Role       string `json:"role"`
+	Text       string `json:"text"`
+	Transcript string `json:"transcript"`
+	Final      *bool  `json:"final"`
+	IsFinal    *bool  `json:"isFinal"`
+}
+
+// transcriptSpeakers maps the names backends use for each side.
+var transcriptSpeakers = map[string]string{
+	"caller":    speakerCaller,
+	"user":      speakerCaller,
+	"human":     speakerCaller,
+	"customer":  speakerCaller,
+	"ai":        speakerAI,
+	"bot":       speakerAI,
+	"assistant": speakerAI,
+	"agent":     speakerAI,
+	"model":     speakerAI,
+}
+
+// normalizeTranscript returns the speaker, text and finality of a transcript message, or ok=false
+// for anything else (or a transcript without text or a recognizable speaker).
+func normalizeTranscript(typ string, msg []byte) (speaker, text string, final, ok bool) {
+	speaker, known := transcriptTypes[strings.ToLower(typ)]
+	if !known {
+		return "", "", false, false
+	}
+	var m struct {
+		transcriptLine
+		Data transcriptLine `json:"data"`
+	}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return "", "", false, false
+	}
+	top, data := m.transcriptLine, m.Data
+	if speaker == "" {
+		// Speaker and role separately: a name in one ("speaker":"Anna") doesn't hide the side in the other.
+		for _, who := range []string{top.Speaker, top.Role, data.Speaker, data.Role} {
+			if s, ok := transcriptSpeakers[strings.ToLower(strings.TrimSpace(who))]; ok {
+				speaker = s
+				break
+			}
+		}
+		if speaker == "" {
+			return "", "", false, false
+		}
+	}
+	for _, t := range []string{top.Text, top.Transcript, data.Text, data.Transcript} {
+		if text = strings.TrimSpace(t); text != "" {
+			break
+		}
+	}
+	final = true // a backend that doesn't say only sends final lines
+	for _, f := range []*bool{top.Final, top.IsFinal, data.Final, data.IsFinal} {
+		if f != nil {
+			final = *f
+			break
+		}
+	}
+	return speaker, text, final, text != ""
+}
+
+type callTranscript struct {
+	mu     sync.Mutex
+	logger *log.Logger
+	callID string
+	mode   string
+	start  time.Time
+	path   string
+	f      *os.File
+}
+
+// startTranscript creates the call's transcript file, named like its recording, and notes its path
+// on the call for the call record.
+func startTranscript(logger *log.Logger, cs *callSession) (*callTranscript, error) {
+	o := cs.opts
+	now := time.Now()
+	path := recordPath(o.transcriptDir, o.recordFileName, cs, now) + ".jsonl"
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	t := &callTranscript{logger: logger, callID: cs.callID, mode: o.transcript, start: now, path: path, f: f}
+	t.writeLine(map[string]any{"type": "callStarted", "callId": cs.callID, "ext": cs.extID})
+	cs.mu.Lock()
+	cs.transcriptPath = path
+	cs.mu.Unlock()
+	return t, nil
+}
+
+// message records one non-audio backend message.
+func (t *callTranscript) message(typ string, msg []byte) {
+	if speaker, text, final, ok := normalizeTranscript(typ, msg); ok && final {
+		t.writeLine(map[string]any{"type": "transcript", "speaker": speaker, "text": text})
+		return
+	}
+	// Partial transcripts are only kept with everything else.
+	if t.mode != transcriptAll {
+		return
+	}
+	line := map[string]any{"type": "event", "event": typ}
+	if json.Valid(msg) {
+		line["message"] = json.RawMessage(msg)
+	} else {
+		line["message"] = string(msg)
+	}
+	t.writeLine(line)
+}
+
+// close ends the transcript with the call's end reason, if known.
+func (t *callTranscript) close(reason string) {
+	line := map[string]any{"type": "callEnded"}
+	if reason != "" {
+		line["reason"] = reason
+	}
+	t.writeLine(line)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return
+	}
+	if err := t.f.Close(); err != nil {
+		t.logger.Printf("transcript: close failed (call-id=%s): %v", t.callID, err)
+	}
+	t.f = nil
+}
+
+// writeLine adds the time and the offset into the call, and writes one line.
+func (t *callTranscript) writeLine(line map[string]any) {
+	now := time.Now()
+	line["ts"] = now.UTC().Format(time.RFC3339Nano)
+	line["offsetMs"] = now.Sub(t.start).Milliseconds()
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return
+	}
+	if _, err := t.f.Write(append(b, '\n')); err != nil {
+		t.logger.Printf("transcript: write failed (call-id=%s): %v", t.callID, err)
+		_ = t.f.Close()
+		t.f = nil
+	}
+}
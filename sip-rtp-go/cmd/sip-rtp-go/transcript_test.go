@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestNormalizeTranscript(t *testing.T) {
+	for _, tc := range []struct {
+		name, typ, msg string
+		speaker, text  string
+		final, ok      bool
+	}{
+		{"side from type", "userTranscript", `{"type":"userTranscript","text":" hello "}`, speakerCaller, "hello", true, true},
+		{"side from type, under data", "outputTranscription", `{"data":{"transcript":"hi there","isFinal":false}}`, speakerAI, "hi there", false, true},
+		{"speaker field", "transcript", `{"speaker":"assistant","text":"ok"}`, speakerAI, "ok", true, true},
+		{"role field", "transcript", `{"role":"user","text":"ok"}`, speakerCaller, "ok", true, true},
+		{"speaker is a name, role is the side", "transcript", `{"speaker":"Anna","role":"customer","text":"ok"}`, speakerCaller, "ok", true, true},
+		{"speaker and role both set", "transcript", `{"speaker":"bot","role":"assistant","text":"ok"}`, speakerAI, "ok", true, true},
+		{"top-level speaker, text under data", "transcript", `{"speaker":"user","data":{"text":"from data","final":true}}`, speakerCaller, "from data", true, true},
+		{"top-level role, speaker under data", "transcript", `{"role":"model","data":{"speaker":"Gemini","text":"x"}}`, speakerAI, "x", true, true},
+		{"top level wins", "transcript", `{"speaker":"user","text":"top","data":{"speaker":"ai","text":"data"}}`, speakerCaller, "top", true, true},
+		{"finality under data", "transcript", `{"speaker":"user","text":"par","data":{"final":false}}`, speakerCaller, "par", false, true},
+		{"unknown side", "transcript", `{"speaker":"Anna","text":"ok"}`, "", "", false, false},
+		{"no text", "transcript", `{"speaker":"user","text":"  "}`, speakerCaller, "", true, false},
+		{"not a transcript", "toolCall", `{"speaker":"user","text":"ok"}`, "", "", false, false},
+		{"bad JSON", "transcript", `{"speaker":`, "", "", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			speaker, text, final, ok := normalizeTranscript(tc.typ, []byte(tc.msg))
+			if speaker != tc.speaker || text != tc.text || final != tc.final || ok != tc.ok {
+				t.Errorf("got (%q, %q, %v, %v), want (%q, %q, %v, %v)", speaker, text, final, ok, tc.speaker, tc.text, tc.final, tc.ok)
+			}
+		})
+	}
+}
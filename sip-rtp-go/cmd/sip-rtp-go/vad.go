@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// Energy VAD on decoded caller audio: a frame is speech when its level is a margin above a tracked
+// noise floor (and above an absolute minimum). Speech starts after it has lasted the onset time, so
+// clicks and coughs don't count, and ends after the hangover time of non-speech.
+const (
+	vadSensitivityLow    = "low"
+	vadSensitivityMedium = "medium"
+	vadSensitivityHigh   = "high"
+
+	defaultBargeInHangover = 200 * time.Millisecond
+	// Noise floor (starting at the first frame that isn't digital silence): how fast it follows the level down (time
+	// constant) and up (dB/s). While the frame looks like speech it rises four times slower, so a
+	// steady new noise is learned within seconds but a long sentence isn't.
+	vadFloorFall    = 100 * time.Millisecond
+	vadFloorRiseDBs = 3.0
+)
+
+type vadConfig struct {
+	snrDB    float64 // level above the noise floor that counts as speech
+	minDBFS  float64 // never speech below this level
+	onset    time.Duration
+	hangover time.Duration
+}
+
+func parseVadSensitivity(s string) string {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return vadSensitivityLow
+	case "high":
+		return vadSensitivityHigh
+	default:
+		return vadSensitivityMedium
+	}
+}
+
+func newVadConfig(sensitivity string, hangover time.Duration) vadConfig {
+	var c vadConfig
+	switch sensitivity {
+	case vadSensitivityLow:
+		c = vadConfig{snrDB: 14, minDBFS: -40, onset: 160 * time.Millisecond}
+	case vadSensitivityHigh:
+		c = vadConfig{snrDB: 6, minDBFS: -50, onset: 60 * time.Millisecond}
+	default:
+		c = vadConfig{snrDB: 9, minDBFS: -45, onset: 100 * time.Millisecond}
+	}
+	c.hangover = hangover
+	return c
+}
+
+type vadEvent int
+
+const (
+	vadNone vadEvent = iota
+	vadSpeechStart
+	vadSpeechEnd
+)
+
+type vad struct {
+	cfg    vadConfig
+	floor  float64 // dBFS
+	primed bool    // floor set from the first frame with a signal
+	speech bool
+	run    time.Duration // speech frames in a row (before onset) or non-speech frames in a row (hangover)
+}
+
+func newVAD(cfg vadConfig) *vad {
+	return &vad{cfg: cfg}
+}
+
+// process takes one frame of PCM at the given rate and reports a speech start or end, with how
+// long before the end of the frame it happened (the onset or hangover it took to decide).
+func (v *vad) process(pcm []int16, rate int) (vadEvent, time.Duration) {
+	if len(pcm) == 0 || rate <= 0 {
+		return vadNone, 0
+	}
+	dur := time.Duration(len(pcm)) * time.Second / time.Duration(rate)
+	level := levelDBFS(pcm)
+	if !v.primed {
+		if level <= -100 {
+			return vadNone, 0
+		}
+		v.floor, v.primed = level, true
+	}
+	active := level >= v.cfg.minDBFS && level-v.floor >= v.cfg.snrDB
+	if level < v.floor {
+		v.floor += (level - v.floor) * math.Min(1, float64(dur)/float64(vadFloorFall))
+	} else {
+		rise := vadFloorRiseDBs * dur.Seconds()
+		if active {
+			rise /= 4
+		}
+		v.floor += math.Min(level-v.floor, rise)
+	}
+
+	if !v.speech {
+		if !active {
+			v.run = 0
+			return vadNone, 0
+		}
+		v.run += dur
+		if v.run < v.cfg.onset {
+			return vadNone, 0
+		}
+		lag := v.run
+		v.speech, v.run = true, 0
+		return vadSpeechStart, lag
+	}
+	if active {
+		v.run = 0
+		return vadNone, 0
+	}
+	v.run += dur
+	if v.run < v.cfg.hangover {
+		return vadNone, 0
+	}
+	lag := v.run
+	v.speech, v.run = false, 0
+	return vadSpeechEnd, lag
+}
+
+// levelDBFS is the RMS level of pcm relative to full scale (-100 for digital silence).
+func levelDBFS(pcm []int16) float64 {
+	var sumSq float64
+	for _, s := range pcm {
+		f := float64(s)
+		sumSq += f * f
+	}
+	rms := math.Sqrt(sumSq / float64(len(pcm)))
+	if rms < 1e-5*32768 {
+		return -100
+	}
+	return 20 * math.Log10(rms/32768)
+}
+
+func bargeInMsg(cs *callSession) map[string]any {
+	return map[string]any{
+		"type":   "bargeIn",
+		"callId": cs.callID,
+	}
+}
@@ -0,0 +1,224 @@
+// Package resample converts mono PCM16 between sample rates with a polyphase windowed-sinc
+// (Kaiser) low-pass filter.
+//
+// Any rational ratio works (the rates are reduced by their GCD to up/down factors). The filter
+// passes up to 85% of the lower Nyquist frequency and attenuates by ~80 dB from the lower Nyquist
+// frequency up, so downsampled speech doesn't fold back into the band and upsampled audio has no
+// images.
+package resample
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	// Passband edge and stopband start as fractions of the lower of the two Nyquist frequencies.
+	passEdge = 0.85
+	stopEdge = 1.0
+	// Stopband attenuation (dB); sets the Kaiser window and the filter length.
+	attenuationDB = 80
+)
+
+// filter is the polyphase decomposition of one prototype low-pass filter.
+type filter struct {
+	up, down int
+	taps     int         // taps per phase
+	delay    int         // group delay in output samples
+	phases   [][]float32 // phases[p][k] = h[p + k*up], k counting back from the newest input
+}
+
+var filters sync.Map // [2]int{inRate, outRate} -> *filter
+
+func getFilter(inRate, outRate int) *filter {
+	key := [2]int{inRate, outRate}
+	if f, ok := filters.Load(key); ok {
+		return f.(*filter)
+	}
+	f, _ := filters.LoadOrStore(key, design(inRate, outRate))
+	return f.(*filter)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// design builds the Kaiser-windowed sinc prototype at the upsampled rate inRate*up and splits it
+// into up phases.
+func design(inRate, outRate int) *filter {
+	g := gcd(inRate, outRate)
+	up, down := outRate/g, inRate/g
+
+	minRate := float64(min(inRate, outRate))
+	nyq := minRate / 2
+	// Transition width as a fraction of the input rate gives the taps needed per input sample
+	// (Kaiser's estimate: N = (A - 7.95) / (14.36 * Δf/fs)).
+	width := (stopEdge - passEdge) * nyq / float64(inRate)
+	taps := int(math.Ceil((attenuationDB - 7.95) / (14.36 * width)))
+	taps = max(taps, 4)
+	n := taps * up
+
+	beta := 0.1102 * (attenuationDB - 8.7)
+	fc := (passEdge + stopEdge) / 2 * nyq / (float64(inRate) * float64(up)) // cycles per upsampled sample
+	// Center the sinc on a whole number of output samples so Convert can drop the delay exactly;
+	// the window stays centered on the filter.
+	half := float64(n-1) / 2
+	delay := int(math.Round(half / float64(down)))
+	center := float64(delay * down)
+	i0beta := besselI0(beta)
+
+	f := &filter{up: up, down: down, taps: taps, delay: delay, phases: make([][]float32, up)}
+	for p := range f.phases {
+		f.phases[p] = make([]float32, taps)
+	}
+	for j := 0; j < n; j++ {
+		x := float64(j) - center
+		h := 2 * fc
+		if x != 0 {
+			h = math.Sin(2*math.Pi*fc*x) / (math.Pi * x)
+		}
+		r := (float64(j) - half) / half
+		w := besselI0(beta*math.Sqrt(math.Max(0, 1-r*r))) / i0beta
+		// Gain up makes up for the zeros stuffed between input samples.
+		f.phases[j%up][j/up] = float32(h * w * float64(up))
+	}
+	return f
+}
+
+// besselI0 is the zeroth-order modified Bessel function of the first kind (series expansion).
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / 2) / float64(k)
+		sum += term * term
+		if term*term < sum*1e-12 {
+			break
+		}
+	}
+	return sum
+}
+
+// Resampler converts one stream; filter state carries across Process calls, so chunks join without
+// clicks and the output length tracks the input exactly over time. Output lags the input by the
+// filter's group delay. Not safe for concurrent use.
+type Resampler struct {
+	InRate, OutRate int
+
+	f    *filter
+	hist []float32 // last taps-1 input samples, then the current chunk
+	t    int       // next output position in upsampled samples, relative to hist[0]
+}
+
+// New returns a Resampler from inRate to outRate (both > 0).
+func New(inRate, outRate int) *Resampler {
+	r := &Resampler{InRate: inRate, OutRate: outRate}
+	if inRate != outRate {
+		r.f = getFilter(inRate, outRate)
+	}
+	r.Reset()
+	return r
+}
+
+// Reset drops the filter history, as for a new stream.
+func (r *Resampler) Reset() {
+	if r.f == nil {
+		return
+	}
+	r.hist = make([]float32, r.f.taps-1, 4*r.f.taps)
+	r.t = (r.f.taps - 1) * r.f.up
+}
+
+// Process converts the next chunk of the stream.
+func (r *Resampler) Process(in []int16) []int16 {
+	if r.f == nil {
+		return append([]int16(nil), in...)
+	}
+	f := r.f
+	x := r.hist
+	for _, s := range in {
+		x = append(x, float32(s))
+	}
+	out := make([]int16, 0, (len(in)*f.up)/f.down+1)
+	for {
+		i := r.t / f.up
+		if i >= len(x) {
+			break
+		}
+		h := f.phases[r.t%f.up]
+		var acc float32
+		for k, c := range h {
+			acc += c * x[i-k]
+		}
+		out = append(out, clamp16(acc))
+		r.t += f.down
+	}
+	// Keep the last taps-1 samples for the next chunk.
+	if drop := len(x) - (f.taps - 1); drop > 0 {
+		n := copy(x, x[drop:])
+		x = x[:n]
+		r.t -= drop * f.up
+	}
+	r.hist = x
+	return out
+}
+
+func clamp16(v float32) int16 {
+	v = float32(math.Round(float64(v)))
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return int16(v)
+}
+
+// Convert resamples a complete buffer (a prompt, a tone) with the filter delay removed: the output
+// has len(in)*outRate/inRate samples aligned with the input.
+func Convert(in []int16, inRate, outRate int) []int16 {
+	if inRate <= 0 || outRate <= 0 {
+		return nil
+	}
+	if inRate == outRate {
+		return append([]int16(nil), in...)
+	}
+	r := New(inRate, outRate)
+	want := len(in) * outRate / inRate
+	d := r.f.delay
+	out := r.Process(in)
+	// Flush the filter with silence until the delayed tail is out.
+	pad := make([]int16, r.f.taps)
+	for len(out) < want+d {
+		out = append(out, r.Process(pad)...)
+	}
+	return out[d : d+want]
+}
+
+// Converter resamples a stream whose input rate may change (e.g. the caller switches codec); it
+// starts a fresh Resampler when it does.
+type Converter struct {
+	OutRate int
+	r       *Resampler
+}
+
+// NewConverter returns a Converter to outRate.
+func NewConverter(outRate int) *Converter {
+	return &Converter{OutRate: outRate}
+}
+
+// Process converts the next chunk, recorded at inRate.
+func (c *Converter) Process(in []int16, inRate int) []int16 {
+	if inRate <= 0 {
+		return nil
+	}
+	if inRate == c.OutRate {
+		return append([]int16(nil), in...)
+	}
+	if c.r == nil || c.r.InRate != inRate {
+		c.r = New(inRate, c.OutRate)
+	}
+	return c.r.Process(in)
+}
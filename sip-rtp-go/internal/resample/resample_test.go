@@ -0,0 +1,154 @@
+package resample
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var ratePairs = [][2]int{
+	{8000, 16000},
+	{16000, 8000},
+	{24000, 8000},
+	{24000, 16000},
+	{16000, 24000},
+	{48000, 8000},
+	{8000, 48000},
+	{44100, 16000},
+}
+
+func tone(freq float64, rate, n int, amp float64) []int16 {
+	out := make([]int16, n)
+	for i := range out {
+		out[i] = int16(amp * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return out
+}
+
+// level returns the amplitude of the freq component of pcm (single-bin DFT), skipping the filter
+// warm-up at the start.
+func level(pcm []int16, freq float64, rate int) float64 {
+	skip := len(pcm) / 4
+	var re, im float64
+	n := 0
+	for i := skip; i < len(pcm); i++ {
+		ph := 2 * math.Pi * freq * float64(i) / float64(rate)
+		re += float64(pcm[i]) * math.Cos(ph)
+		im += float64(pcm[i]) * math.Sin(ph)
+		n++
+	}
+	return 2 * math.Hypot(re, im) / float64(n)
+}
+
+func db(ratio float64) float64 { return 20 * math.Log10(ratio) }
+
+func TestPassbandRipple(t *testing.T) {
+	const amp = 10000
+	for _, p := range ratePairs {
+		in, out := p[0], p[1]
+		t.Run(fmt.Sprintf("%d-%d", in, out), func(t *testing.T) {
+			edge := passEdge * float64(min(in, out)) / 2
+			lo, hi := math.Inf(1), math.Inf(-1)
+			for f := 100.0; f <= edge; f += edge / 20 {
+				y := New(in, out).Process(tone(f, in, in/2, amp))
+				g := db(level(y, f, out) / amp)
+				lo, hi = math.Min(lo, g), math.Max(hi, g)
+			}
+			if lo < -0.1 || hi > 0.1 {
+				t.Errorf("passband gain %.3f..%.3f dB, want within ±0.1 dB", lo, hi)
+			}
+		})
+	}
+}
+
+func TestAliasing(t *testing.T) {
+	const amp = 10000
+	for _, p := range ratePairs {
+		in, out := p[0], p[1]
+		if in <= out {
+			continue
+		}
+		t.Run(fmt.Sprintf("%d-%d", in, out), func(t *testing.T) {
+			// Tones between the output Nyquist frequency and the input's fold back to |f - k*out|.
+			worst := math.Inf(-1)
+			for f := float64(out) / 2 * stopEdge; f < 0.95*float64(in)/2; f += float64(in) / 37 {
+				y := New(in, out).Process(tone(f, in, in/2, amp))
+				alias := math.Abs(f - float64(out)*math.Round(f/float64(out)))
+				worst = math.Max(worst, db(level(y, alias, out)/amp))
+			}
+			if worst > -60 {
+				t.Errorf("worst alias %.1f dB, want below -60 dB", worst)
+			}
+		})
+	}
+}
+
+func TestImaging(t *testing.T) {
+	const amp = 10000
+	for _, p := range ratePairs {
+		in, out := p[0], p[1]
+		if in >= out {
+			continue
+		}
+		t.Run(fmt.Sprintf("%d-%d", in, out), func(t *testing.T) {
+			worst := math.Inf(-1)
+			for f := 200.0; f < passEdge*float64(in)/2; f += float64(in) / 23 {
+				y := New(in, out).Process(tone(f, in, in/2, amp))
+				// The first image of f sits at in - f.
+				worst = math.Max(worst, db(level(y, float64(in)-f, out)/amp))
+			}
+			if worst > -60 {
+				t.Errorf("worst image %.1f dB, want below -60 dB", worst)
+			}
+		})
+	}
+}
+
+func TestStreamingMatchesOneShot(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	in := make([]int16, 8000)
+	for i := range in {
+		in[i] = int16(rng.Intn(20000) - 10000)
+	}
+	for _, p := range ratePairs {
+		whole := New(p[0], p[1]).Process(in)
+		r := New(p[0], p[1])
+		var chunked []int16
+		for off := 0; off < len(in); {
+			n := min(1+rng.Intn(500), len(in)-off)
+			chunked = append(chunked, r.Process(in[off:off+n])...)
+			off += n
+		}
+		if len(chunked) != len(whole) {
+			t.Fatalf("%d-%d: chunked %d samples, whole %d", p[0], p[1], len(chunked), len(whole))
+		}
+		for i := range whole {
+			if chunked[i] != whole[i] {
+				t.Fatalf("%d-%d: sample %d differs: %d vs %d", p[0], p[1], i, chunked[i], whole[i])
+			}
+		}
+	}
+}
+
+func TestConvertAlignment(t *testing.T) {
+	for _, p := range ratePairs {
+		in, out := p[0], p[1]
+		x := tone(300, in, in/10, 10000)
+		y := Convert(x, in, out)
+		if want := len(x) * out / in; len(y) != want {
+			t.Fatalf("%d-%d: got %d samples, want %d", in, out, len(y), want)
+		}
+		// With the delay removed, the output follows the same 300 Hz sine in phase.
+		ref := tone(300, out, len(y), 10000)
+		var errSum, refSum float64
+		for i := len(y) / 4; i < 3*len(y)/4; i++ {
+			d := float64(y[i] - ref[i])
+			errSum += d * d
+			refSum += float64(ref[i]) * float64(ref[i])
+		}
+		if snr := 10 * math.Log10(refSum/errSum); snr < 40 {
+			t.Errorf("%d-%d: SNR vs ideal %.1f dB, want >= 40 dB", in, out, snr)
+		}
+	}
+}